@@ -0,0 +1,280 @@
+/*
+ * Typed arrays on top of Client.Access
+ *
+ * Elements are turned into a fixed number of bytes by an Encoder and laid
+ * out over the 8-byte block values: small elements are packed several to a
+ * block, large ones span consecutive blocks.
+ */
+
+package oram2pc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+)
+
+// bytes of payload in each block (the value half of block_encode)
+const block_payload = 8
+
+/*
+ * Converts elements of type T to and from exactly Size() bytes
+ */
+type Encoder[T any] interface {
+	Size() int
+	Encode(v T, buf []byte) error
+	Decode(buf []byte) (T, error)
+}
+
+// fixed-width integer types
+type Integer interface {
+	~int8 | ~int16 | ~int32 | ~int64 | ~uint8 | ~uint16 | ~uint32 | ~uint64
+}
+
+// little endian fixed-width integers
+type IntEncoder[T Integer] struct{}
+
+func (IntEncoder[T]) Size() int {
+	var v T
+	return binary.Size(v)
+}
+
+func (e IntEncoder[T]) Encode(v T, buf []byte) error {
+	u := uint64(v)
+	for i := 0; i < e.Size(); i++ {
+		buf[i] = byte(u >> uint(8*i))
+	}
+
+	return nil
+}
+
+func (e IntEncoder[T]) Decode(buf []byte) (T, error) {
+	var u uint64
+	for i := 0; i < e.Size(); i++ {
+		u |= uint64(buf[i]) << uint(8*i)
+	}
+
+	return T(u), nil
+}
+
+// byte strings of exactly Len bytes
+type BytesEncoder struct {
+	Len int
+}
+
+func (e BytesEncoder) Size() int {
+	return e.Len
+}
+
+func (e BytesEncoder) Encode(v []byte, buf []byte) error {
+	if len(v) != e.Len {
+		return errors.New("Byte string has the wrong length!")
+	}
+	copy(buf, v)
+
+	return nil
+}
+
+func (e BytesEncoder) Decode(buf []byte) ([]byte, error) {
+	return append([]byte{}, buf[:e.Len]...), nil
+}
+
+// fixed-size values (structs of fixed-width fields, arrays, ...) with
+// encoding/binary
+type BinaryEncoder[T any] struct{}
+
+func (BinaryEncoder[T]) Size() int {
+	var v T
+	return binary.Size(v)
+}
+
+func (BinaryEncoder[T]) Encode(v T, buf []byte) error {
+	var b bytes.Buffer
+	err := binary.Write(&b, binary.LittleEndian, v)
+	if err != nil {
+		return err
+	}
+	copy(buf, b.Bytes())
+
+	return nil
+}
+
+func (BinaryEncoder[T]) Decode(buf []byte) (T, error) {
+	var v T
+	err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &v)
+	return v, err
+}
+
+/*
+ * Any gob-encodable value that fits in Len bytes
+ *
+ * The gob is stored after a 2-byte length, an all-zero slot decodes to the
+ * zero value of T.
+ */
+type GobEncoder[T any] struct {
+	Len int
+}
+
+func (e GobEncoder[T]) Size() int {
+	return e.Len + 2
+}
+
+func (e GobEncoder[T]) Encode(v T, buf []byte) error {
+	var b bytes.Buffer
+	err := gob.NewEncoder(&b).Encode(v)
+	if err != nil {
+		return err
+	}
+	if b.Len() > e.Len {
+		return errors.New("Value is too large for the gob encoder!")
+	}
+
+	for i := range buf {
+		buf[i] = 0
+	}
+	binary.LittleEndian.PutUint16(buf, uint16(b.Len()))
+	copy(buf[2:], b.Bytes())
+
+	return nil
+}
+
+func (e GobEncoder[T]) Decode(buf []byte) (T, error) {
+	var v T
+	n := int(binary.LittleEndian.Uint16(buf))
+	if n == 0 {
+		return v, nil
+	}
+	if n > e.Len {
+		return v, errors.New("Corrupt gob length!")
+	}
+
+	err := gob.NewDecoder(bytes.NewReader(buf[2 : 2+n])).Decode(&v)
+	return v, err
+}
+
+/*
+ * An array of n elements of type T stored in the blocks of one server
+ *
+ * The array uses block ids base, base+1, ... which have to be valid block
+ * numbers of the client. Get and Set both make one path access to every
+ * block of the element, so the server can't tell them apart.
+ */
+type ObliviousArray[T any] struct {
+	c      *Client
+	server string
+	base   int
+	n      int
+	enc    Encoder[T]
+
+	per_block int // elements per block, if they are packed
+	span      int // blocks per element, if they span blocks
+}
+
+func NewObliviousArray[T any](c *Client, server string, base int, n int, enc Encoder[T]) (*ObliviousArray[T], error) {
+	_, prs := c.servers[server]
+	if prs == false {
+		return nil, errors.New("No server exists by that name!")
+	}
+
+	size := enc.Size()
+	if size <= 0 {
+		return nil, errors.New("Encoder must have a positive fixed size!")
+	}
+
+	arr := &ObliviousArray[T]{c: c, server: server, base: base, n: n, enc: enc}
+	if size <= block_payload {
+		arr.per_block = block_payload / size
+		arr.span = 1
+	} else {
+		arr.per_block = 1
+		arr.span = (size + block_payload - 1) / block_payload
+	}
+
+	if base < 0 || base+arr.NumBlocks() > c.N {
+		return nil, errors.New("Array doesn't fit in the client's blocks!")
+	}
+
+	return arr, nil
+}
+
+func (arr *ObliviousArray[T]) Len() int {
+	return arr.n
+}
+
+// number of blocks the array takes up
+func (arr *ObliviousArray[T]) NumBlocks() int {
+	if arr.span > 1 {
+		return arr.n * arr.span
+	}
+
+	return (arr.n + arr.per_block - 1) / arr.per_block
+}
+
+// first block and byte offset of element i
+func (arr *ObliviousArray[T]) locate(i int) (int, int) {
+	if arr.span > 1 {
+		return arr.base + i*arr.span, 0
+	}
+
+	return arr.base + i/arr.per_block, (i % arr.per_block) * arr.enc.Size()
+}
+
+/*
+ * Reads the blocks of element i and returns the element as it was, with one
+ * read-modify-write path access per block. If f isn't nil it runs inside
+ * each of those accesses, on the part of the element in that block and its
+ * offset in the element, and whatever it leaves there is written back.
+ */
+func (arr *ObliviousArray[T]) access(i int, f func(part []byte, at int)) ([]byte, error) {
+	if i < 0 || i >= arr.n {
+		return nil, range_err("array index %d", i)
+	}
+
+	blk, off := arr.locate(i)
+	size := arr.enc.Size()
+	buf := make([]byte, arr.span*block_payload)
+	for j := 0; j < arr.span; j++ {
+		// the part of the element in block j
+		lo, hi := max(off, j*block_payload), min(off+size, (j+1)*block_payload)
+		err := arr.c.update(arr.server, blk+j, func(v uint64) (uint64, bool) {
+			binary.LittleEndian.PutUint64(buf[j*block_payload:], v)
+			if f == nil {
+				return v, false
+			}
+
+			nb := make([]byte, block_payload)
+			binary.LittleEndian.PutUint64(nb, v)
+			f(nb[lo-j*block_payload:hi-j*block_payload], lo-off)
+			return binary.LittleEndian.Uint64(nb), true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return buf[off : off+size], nil
+}
+
+func (arr *ObliviousArray[T]) Get(i int) (T, error) {
+	var v T
+	buf, err := arr.access(i, nil)
+	if err != nil {
+		return v, err
+	}
+
+	return arr.enc.Decode(buf)
+}
+
+func (arr *ObliviousArray[T]) Set(i int, v T) error {
+	elem := make([]byte, arr.enc.Size())
+	err := arr.enc.Encode(v, elem)
+	if err != nil {
+		return err
+	}
+
+	_, err = arr.access(i, func(part []byte, at int) {
+		copy(part, elem[at:])
+	})
+	return err
+}
@@ -0,0 +1,149 @@
+package oram2pc
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+type test_point struct {
+	X, Y int32
+	Tag  uint16
+}
+
+type test_record struct {
+	Name string
+	Tags []string
+}
+
+func Test_array(t *testing.T) {
+	c := InitClient(128, 4)
+	c.AddServer("test", 128, 4, 4096)
+	defer c.RemoveServer("test")
+
+	// 4 uint16s per block
+	ints, err := NewObliviousArray[int16](c, "test", 0, 10, IntEncoder[int16]{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ints.NumBlocks() != 3 {
+		t.Errorf("int16 array uses %d blocks, want 3", ints.NumBlocks())
+	}
+
+	// 20-byte strings span 3 blocks each
+	strs, err := NewObliviousArray[[]byte](c, "test", ints.NumBlocks(), 5, BytesEncoder{Len: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := ints.NumBlocks() + strs.NumBlocks()
+	points, err := NewObliviousArray[test_point](c, "test", base, 4, BinaryEncoder[test_point]{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base += points.NumBlocks()
+	recs, err := NewObliviousArray[test_record](c, "test", base, 3, GobEncoder[test_record]{Len: 150})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want_ints := make([]int16, 10)
+	for k := 0; k < 40; k++ {
+		i := rand.Intn(10)
+		v := int16(rand.Intn(1<<16) - 1<<15)
+		if err := ints.Set(i, v); err != nil {
+			t.Fatal(err)
+		}
+		want_ints[i] = v
+	}
+	for i := range want_ints {
+		v, err := ints.Get(i)
+		if err != nil || v != want_ints[i] {
+			t.Errorf("ints[%d]: got %d, want %d (%v)", i, v, want_ints[i], err)
+		}
+	}
+
+	s := []byte("twenty bytes of data")
+	strs.Set(3, s)
+	if v, _ := strs.Get(3); !bytes.Equal(v, s) {
+		t.Errorf("strs[3]: got %q", v)
+	}
+	if v, _ := strs.Get(2); !bytes.Equal(v, make([]byte, 20)) {
+		t.Errorf("unset strs[2]: got %q", v)
+	}
+	if strs.Set(0, []byte("short")) == nil {
+		t.Error("expected an error for a short byte string")
+	}
+
+	p := test_point{X: -5, Y: 1 << 20, Tag: 7}
+	points.Set(1, p)
+	if v, _ := points.Get(1); v != p {
+		t.Errorf("points[1]: got %v, want %v", v, p)
+	}
+
+	r := test_record{Name: "alice", Tags: []string{"a", "bc"}}
+	if err := recs.Set(2, r); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := recs.Get(2); err != nil || v.Name != r.Name || len(v.Tags) != 2 {
+		t.Errorf("recs[2]: got %v (%v)", v, err)
+	}
+	if v, err := recs.Get(0); err != nil || v.Name != "" {
+		t.Errorf("unset recs[0]: got %v (%v)", v, err)
+	}
+
+	if _, err := ints.Get(10); err == nil {
+		t.Error("expected an out of range error")
+	}
+	if _, err := NewObliviousArray[int64](c, "test", 120, 10, IntEncoder[int64]{}); err == nil {
+		t.Error("expected an error for an array past the last block")
+	}
+}
+
+func Test_array_accesses(t *testing.T) {
+	c := InitClient(64, 4)
+	c.AddServer("test", 64, 4, 4096)
+	defer c.RemoveServer("test")
+	rm := &record_metrics{io: map[string]int{}}
+	c.SetMetrics(rm)
+
+	ints, err := NewObliviousArray[int16](c, "test", 0, 10, IntEncoder[int16]{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	strs, err := NewObliviousArray[[]byte](c, "test", ints.NumBlocks(), 5, BytesEncoder{Len: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// one path access per block of the element, whether reading or writing
+	cases := []struct {
+		name string
+		op   func() error
+		want int
+	}{
+		{"packed set", func() error { return ints.Set(5, 7) }, 1},
+		{"packed get", func() error { _, err := ints.Get(5); return err }, 1},
+		{"spanning set", func() error { return strs.Set(1, []byte("twenty bytes of data")) }, 3},
+		{"spanning get", func() error { _, err := strs.Get(1); return err }, 3},
+	}
+	for _, tc := range cases {
+		before := len(rm.accesses)
+		if err := tc.op(); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(rm.accesses) - before; n != tc.want {
+			t.Errorf("%s: %d path accesses, want %d", tc.name, n, tc.want)
+		}
+	}
+
+	// neighbours in the same block survive a set
+	ints.Set(4, -3)
+	ints.Set(6, 9)
+	for i, want := range map[int]int16{4: -3, 5: 7, 6: 9} {
+		if v, _ := ints.Get(i); v != want {
+			t.Errorf("ints[%d]: got %d, want %d", i, v, want)
+		}
+	}
+}
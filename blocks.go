@@ -35,22 +35,29 @@ func make_bucket(blks []Block, max int, key []byte) Bucket {
 }
 
 // splits a bucket into its plaintext blocks (opposite of make_bucket)
-func split_bucket(bucket Bucket, key []byte) []Block {
+func split_bucket(bucket Bucket, key []byte) ([]Block, error) {
 	blocks := make([]Block, len(bucket))
 	for i := range bucket {
-		blocks[i] = dec_block(bucket[i], key)
+		blk, err := dec_block(bucket[i], key)
+		if err != nil {
+			return nil, err
+		}
+		blocks[i] = blk
 	}
 
-	return blocks
+	return blocks, nil
 }
 
 // finds all non-dummy blocks in some buckets
-func find_nondummy(bux []Bucket, key []byte) []Block {
+func find_nondummy(bux []Bucket, key []byte) ([]Block, error) {
 	nondummy := make([]Block, len(bux)*len(bux[0]))
 	num_nd := 0
 	for i := range bux {
 		for j := range bux[i] {
-			cur_blk := dec_block(bux[i][j], key)
+			cur_blk, err := dec_block(bux[i][j], key)
+			if err != nil {
+				return nil, err
+			}
 			_, _, dummy := block_decode(cur_blk)
 			if !dummy {
 				nondummy[num_nd] = cur_blk
@@ -60,23 +67,26 @@ func find_nondummy(bux []Bucket, key []byte) []Block {
 		}
 	}
 
-	return nondummy[:num_nd]
+	return nondummy[:num_nd], nil
 }
 
 // find which bucket the block with id "id" is found
-func bucket_find_block(bux []Bucket, id int, key []byte) (int, uint64) {
+func bucket_find_block(bux []Bucket, id int, key []byte) (int, uint64, error) {
 	for i := range bux {
 		for j := range bux[i] {
-			cur_blk := bux[i][j]
-			cur_id, val, dummy := block_decode(dec_block(cur_blk, key))
+			cur_blk, err := dec_block(bux[i][j], key)
+			if err != nil {
+				return -1, 0, err
+			}
+			cur_id, val, dummy := block_decode(cur_blk)
 
 			if dummy == false && cur_id == id {
-				return i, val
+				return i, val, nil
 			}
 		}
 	}
 
-	return -1, 0
+	return -1, 0, nil
 }
 
 // do the same thing as bucket_find_block but in a slice of blocks
@@ -152,17 +162,27 @@ func enc_dummy_block(k []byte) Block {
 	return dummy_cip
 }
 
+/*
+ * Plaintext blocks have the format:
+ * | id | leaf | value |
+ * <- 32 bits -><- 32 bits -><- 64 bits ->
+ * where leaf is the leaf the block is currently mapped to. Ids are below
+ * 0xFFFFFFFF so a real block is never mistaken for the dummy block.
+ */
+
+// clients and servers hold fewer blocks than this, so every id fits
+const max_blocks = 1<<32 - 1
+
+// leaves are numbered in 32 bits too
+const max_leaves = 1 << 32
+
 // parse an id and value to create a plaintext block ready for encryption
 func block_encode(id int, val uint64) Block {
-	// left pad with the id, extended to 8 bytes so we know it's not a dummy blk
-	id_bytes := make([]byte, 8)
-	binary.LittleEndian.PutUint64(id_bytes, uint64(id))
-	val_bytes := make([]byte, 8)
-	binary.LittleEndian.PutUint64(val_bytes, val)
+	blk := make(Block, 16)
+	binary.LittleEndian.PutUint32(blk, uint32(id))
+	binary.LittleEndian.PutUint64(blk[8:], val)
 
-	blk_plain := append(id_bytes, val_bytes...)
-
-	return blk_plain
+	return blk
 }
 
 // do the opposite of block_encode
@@ -171,11 +191,20 @@ func block_decode(blk Block) (int, uint64, bool) {
 		return 0, uint64(0), true
 	}
 
-	id := binary.LittleEndian.Uint64(blk[:8])
+	id := binary.LittleEndian.Uint32(blk[:4])
 	val := binary.LittleEndian.Uint64(blk[8:])
 	return int(id), val, false
 }
 
+// the leaf a plaintext block is mapped to
+func block_leaf(blk Block) int {
+	return int(binary.LittleEndian.Uint32(blk[4:8]))
+}
+
+func block_set_leaf(blk Block, leaf int) {
+	binary.LittleEndian.PutUint32(blk[4:8], uint32(leaf))
+}
+
 /*
  * Returns an encrypted version of the encoded block
  */
@@ -184,9 +213,17 @@ func enc_block(blk Block, k []byte) Block {
 }
 
 /*
- * Returns the plaintext (a uint64) by decrypting an encrypted block if
- * the bool == false, else the block is a dummy block
+ * Returns the plaintext block by decrypting an encrypted block, or an
+ * ErrIntegrity if the ciphertext isn't a block
  */
-func dec_block(blk Block, k []byte) Block {
-	return Block(decrypt([]byte(blk), k))
+func dec_block(blk Block, k []byte) (Block, error) {
+	pt, err := decrypt([]byte(blk), k)
+	if err != nil {
+		return nil, err
+	}
+	if len(pt) != 16 {
+		return nil, integrity_err("decrypted block of %d bytes", len(pt))
+	}
+
+	return Block(pt), nil
 }
@@ -0,0 +1,391 @@
+/*
+ * An oblivious B+-tree of uint64 keys and values, on the ODS machinery of
+ * ods.go
+ *
+ * A node of order B is 1 + 2B blocks:
+ *
+ * leaf:     | count | keys | values |
+ * internal: | count | keys | child ids and leaves |
+ *
+ * where the key of a child is the smallest key under it, and the id and
+ * leaf of a child share a block. The count block also says whether the
+ * node is a leaf. Every node read is written back to a fresh leaf, its
+ * parent having been read before it.
+ *
+ * Nodes only split, so every node but the root is at least half full and
+ * a tree of capacity keys is never deeper than Depth(). Every operation
+ * reads Depth() levels whatever the height of the tree:
+ *
+ *   Get   reads one node per level and writes Depth() nodes back
+ *   Put   reads one node per level and writes 2 Depth() + 1 nodes back
+ *   Range reads Width() nodes per level and writes Width() Depth() back
+ *
+ * padding with dummy accesses. Width() nodes per level are enough to find
+ * the first MaxResults keys of any range, so a range query always does the
+ * same accesses however many keys it finds. There's no deletion.
+ */
+
+package oram2pc
+
+import (
+	"errors"
+	"sort"
+)
+
+type BTreeEntry struct {
+	Key   uint64
+	Value uint64
+}
+
+type BTree struct {
+	o           *ods
+	order       int // keys per leaf, children per internal node
+	capacity    int
+	max_results int
+	size        int
+
+	depth int // most levels the tree can have
+	width int // nodes read per level by a range query
+
+	height    int
+	root      int
+	root_leaf int
+	nodes     int // nodes made so far, the next one's id
+}
+
+// a node read into the client
+type bt_node struct {
+	id   int
+	leaf bool
+	keys []uint64
+	vals []uint64 // values of a leaf
+	kids []int    // child ids of an internal node
+	pos  []int    // leaves of the children
+}
+
+/*
+ * Makes a tree for up to capacity keys with nodes of the given order, at
+ * least 3, whose range queries return up to max_results entries
+ */
+func NewBTree(c *Client, name string, capacity int, order int, max_results int) (*BTree, error) {
+	if order < 3 {
+		return nil, errors.New("B+-tree order must be at least 3!")
+	}
+	if max_results < 1 {
+		return nil, errors.New("Range queries must return at least one result!")
+	}
+
+	// half of a split node, the fewest keys or children any node but the root has
+	m := (order + 1) / 2
+	depth := 1
+	for n := 2 * m; n <= capacity; n *= m {
+		depth += 1
+	}
+	o, err := new_ods(c, name, 2*(capacity/m+1)+1, 1+2*order)
+	if err != nil {
+		return nil, err
+	}
+
+	bt := &BTree{o: o, order: order, capacity: capacity, max_results: max_results, depth: depth, height: 1, nodes: 1}
+	bt.width = (max_results+m-1)/m + 2
+	bt.root_leaf = o.random_leaf()
+	err = o.write(0, bt.encode(&bt_node{leaf: true}), bt.root_leaf)
+	if err != nil {
+		return nil, err
+	}
+
+	return bt, nil
+}
+
+func (bt *BTree) Len() int {
+	return bt.size
+}
+
+// levels every operation reads
+func (bt *BTree) Depth() int {
+	return bt.depth
+}
+
+// nodes a range query reads on every level
+func (bt *BTree) Width() int {
+	return bt.width
+}
+
+func (bt *BTree) encode(n *bt_node) []uint64 {
+	vals := make([]uint64, 1+2*bt.order)
+	vals[0] = uint64(len(n.keys))
+	if n.leaf {
+		vals[0] |= 1 << 32
+	}
+	for i := range n.keys {
+		vals[1+i] = n.keys[i]
+		if n.leaf {
+			vals[1+bt.order+i] = n.vals[i]
+		} else {
+			vals[1+bt.order+i] = uint64(uint32(n.kids[i])) | uint64(n.pos[i])<<32
+		}
+	}
+
+	return vals
+}
+
+func (bt *BTree) read_node(id int, leaf int) (*bt_node, error) {
+	vals, err := bt.o.read(id, leaf)
+	if err != nil {
+		return nil, err
+	}
+
+	count := int(uint32(vals[0]))
+	if count > bt.order {
+		return nil, integrity_err("B+-tree node with %d keys", count)
+	}
+	n := &bt_node{id: id, leaf: vals[0]>>32 == 1, keys: vals[1 : 1+count]}
+	for i := 0; i < count; i++ {
+		v := vals[1+bt.order+i]
+		if n.leaf {
+			n.vals = append(n.vals, v)
+		} else {
+			n.kids = append(n.kids, int(uint32(v)))
+			n.pos = append(n.pos, int(v>>32))
+		}
+	}
+
+	return n, nil
+}
+
+// the child of an internal node whose keys key falls in
+func (n *bt_node) child(key uint64) int {
+	i := sort.Search(len(n.keys), func(i int) bool { return n.keys[i] > key }) - 1
+	return max(i, 0)
+}
+
+/*
+ * Writes back every node in cache with fresh leaves, children before
+ * parents, and returns how many there were
+ */
+func (bt *BTree) write_back(cache map[int]*bt_node) (int, error) {
+	written := 0
+	var write func(n *bt_node) (int, error)
+	write = func(n *bt_node) (int, error) {
+		for i, id := range n.kids {
+			if kid, prs := cache[id]; prs == true {
+				leaf, err := write(kid)
+				if err != nil {
+					return 0, err
+				}
+				n.pos[i] = leaf
+			}
+		}
+
+		leaf := bt.o.random_leaf()
+		written += 1
+		return leaf, bt.o.write(n.id, bt.encode(n), leaf)
+	}
+
+	leaf, err := write(cache[bt.root])
+	if err != nil {
+		return written, err
+	}
+	bt.root_leaf = leaf
+
+	return written, nil
+}
+
+// reads the nodes from the root down to the leaf key belongs in, padded to Depth() reads
+func (bt *BTree) descend(key uint64) ([]*bt_node, error) {
+	path := []*bt_node{}
+	id, leaf := bt.root, bt.root_leaf
+	for l := 0; l < bt.height; l++ {
+		n, err := bt.read_node(id, leaf)
+		if err != nil {
+			return nil, err
+		}
+		path = append(path, n)
+		if !n.leaf {
+			i := n.child(key)
+			id, leaf = n.kids[i], n.pos[i]
+		}
+	}
+
+	return path, bt.o.dummies(bt.depth - bt.height)
+}
+
+func path_cache(path []*bt_node) map[int]*bt_node {
+	cache := make(map[int]*bt_node)
+	for _, n := range path {
+		cache[n.id] = n
+	}
+
+	return cache
+}
+
+func (bt *BTree) Get(key uint64) (uint64, bool, error) {
+	path, err := bt.descend(key)
+	if err != nil {
+		return 0, false, err
+	}
+
+	var val uint64
+	found := false
+	leaf := path[len(path)-1]
+	i := sort.Search(len(leaf.keys), func(i int) bool { return leaf.keys[i] >= key })
+	if i < len(leaf.keys) && leaf.keys[i] == key {
+		val, found = leaf.vals[i], true
+	}
+
+	written, err := bt.write_back(path_cache(path))
+	if err != nil {
+		return 0, false, err
+	}
+
+	return val, found, bt.o.dummies(bt.depth - written)
+}
+
+// the entries of a leaf with keys from lo to hi
+func (n *bt_node) entries(lo uint64, hi uint64) []BTreeEntry {
+	found := []BTreeEntry{}
+	for i, k := range n.keys {
+		if k >= lo && k <= hi {
+			found = append(found, BTreeEntry{Key: k, Value: n.vals[i]})
+		}
+	}
+
+	return found
+}
+
+// moves the upper half of n into a new node
+func (bt *BTree) split(n *bt_node) *bt_node {
+	h := len(n.keys) / 2
+	r := &bt_node{id: bt.nodes, leaf: n.leaf}
+	bt.nodes += 1
+
+	r.keys = append([]uint64{}, n.keys[h:]...)
+	n.keys = n.keys[:h]
+	if n.leaf {
+		r.vals = append([]uint64{}, n.vals[h:]...)
+		n.vals = n.vals[:h]
+	} else {
+		r.kids = append([]int{}, n.kids[h:]...)
+		r.pos = append([]int{}, n.pos[h:]...)
+		n.kids = n.kids[:h]
+		n.pos = n.pos[:h]
+	}
+
+	return r
+}
+
+// sets the value of key, adding it if it isn't there
+func (bt *BTree) Put(key uint64, val uint64) error {
+	path, err := bt.descend(key)
+	if err != nil {
+		return err
+	}
+	cache := path_cache(path)
+
+	leaf := path[len(path)-1]
+	i := sort.Search(len(leaf.keys), func(i int) bool { return leaf.keys[i] >= key })
+	if i < len(leaf.keys) && leaf.keys[i] == key {
+		leaf.vals[i] = val
+	} else if bt.size == bt.capacity {
+		written, err := bt.write_back(cache)
+		if err == nil {
+			err = bt.o.dummies(2*bt.depth + 1 - written)
+		}
+		if err == nil {
+			err = errors.New("B+-tree is full!")
+		}
+		return err
+	} else {
+		leaf.keys = append(leaf.keys[:i], append([]uint64{key}, leaf.keys[i:]...)...)
+		leaf.vals = append(leaf.vals[:i], append([]uint64{val}, leaf.vals[i:]...)...)
+		bt.size += 1
+	}
+
+	// split full nodes from the leaf up, a new sibling goes right after n
+	for l := len(path) - 1; l >= 0 && len(path[l].keys) > bt.order; l-- {
+		n := path[l]
+		r := bt.split(n)
+		cache[r.id] = r
+
+		if l == 0 {
+			root := &bt_node{id: bt.nodes, keys: []uint64{n.keys[0], r.keys[0]}, kids: []int{n.id, r.id}, pos: []int{0, 0}}
+			bt.nodes += 1
+			bt.root = root.id
+			bt.height += 1
+			cache[root.id] = root
+			break
+		}
+
+		p := path[l-1]
+		j := 1
+		for p.kids[j-1] != n.id {
+			j += 1
+		}
+		p.keys = append(p.keys[:j], append([]uint64{r.keys[0]}, p.keys[j:]...)...)
+		p.kids = append(p.kids[:j], append([]int{r.id}, p.kids[j:]...)...)
+		p.pos = append(p.pos[:j], append([]int{0}, p.pos[j:]...)...)
+	}
+
+	written, err := bt.write_back(cache)
+	if err != nil {
+		return err
+	}
+
+	return bt.o.dummies(2*bt.depth + 1 - written)
+}
+
+/*
+ * Returns the entries with keys from lo to hi in order, the first
+ * MaxResults of them if there are more
+ */
+func (bt *BTree) Range(lo uint64, hi uint64) ([]BTreeEntry, error) {
+	cache := make(map[int]*bt_node)
+	results := []BTreeEntry{}
+	ids, leaves := []int{bt.root}, []int{bt.root_leaf}
+
+	for l := 0; l < bt.depth; l++ {
+		level := []*bt_node{}
+		for i := range ids {
+			n, err := bt.read_node(ids[i], leaves[i])
+			if err != nil {
+				return nil, err
+			}
+			cache[n.id] = n
+			level = append(level, n)
+		}
+		err := bt.o.dummies(bt.width - len(ids))
+		if err != nil {
+			return nil, err
+		}
+
+		// the children the range starts in, up to width of them
+		ids, leaves = ids[:0], leaves[:0]
+		for k, n := range level {
+			if n.leaf {
+				results = append(results, n.entries(lo, hi)...)
+				continue
+			}
+			start := 0
+			if k == 0 {
+				start = n.child(lo)
+			}
+			for i := start; i < len(n.kids) && len(ids) < bt.width; i++ {
+				if len(ids) > 0 && n.keys[i] > hi {
+					break
+				}
+				ids = append(ids, n.kids[i])
+				leaves = append(leaves, n.pos[i])
+			}
+		}
+	}
+
+	if len(results) > bt.max_results {
+		results = results[:bt.max_results]
+	}
+	written, err := bt.write_back(cache)
+	if err != nil {
+		return nil, err
+	}
+
+	return results, bt.o.dummies(bt.width*bt.depth - written)
+}
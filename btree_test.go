@@ -0,0 +1,114 @@
+package oram2pc
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func Test_btree(t *testing.T) {
+	for _, order := range []int{3, 4} {
+		c := InitClient(16, 4)
+		bt, err := NewBTree(c, "btree", 20, order, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ac := &access_counter{o: bt.o, want: map[string]int{
+			"get":   2 * bt.Depth(),
+			"put":   bt.Depth() + 2*bt.Depth() + 1,
+			"range": 2 * bt.Width() * bt.Depth(),
+		}}
+		rng := rand.New(rand.NewSource(int64(order)))
+		model := make(map[uint64]uint64)
+		for i := 0; i < 60; i++ {
+			k := uint64(rng.Intn(50))
+			switch rng.Intn(3) {
+			case 0:
+				if len(model) == 20 {
+					continue
+				}
+				ac.check(t, "put", func() error { return bt.Put(k, uint64(i)) })
+				model[k] = uint64(i)
+			case 1:
+				var v uint64
+				var found bool
+				ac.check(t, "get", func() error {
+					var err error
+					v, found, err = bt.Get(k)
+					return err
+				})
+				want, prs := model[k]
+				if found != prs || v != want {
+					t.Fatalf("order %d: get %d: got %d %v, want %d %v", order, k, v, found, want, prs)
+				}
+			case 2:
+				hi := k + uint64(rng.Intn(10))
+				var got []BTreeEntry
+				ac.check(t, "range", func() error {
+					var err error
+					got, err = bt.Range(k, hi)
+					return err
+				})
+				want := []BTreeEntry{}
+				for key, v := range model {
+					if key >= k && key <= hi {
+						want = append(want, BTreeEntry{key, v})
+					}
+				}
+				sort.Slice(want, func(i, j int) bool { return want[i].Key < want[j].Key })
+				want = want[:min(len(want), 4)]
+				if len(got) != len(want) {
+					t.Fatalf("order %d: range %d-%d: got %v, want %v", order, k, hi, got, want)
+				}
+				for j := range got {
+					if got[j] != want[j] {
+						t.Fatalf("order %d: range %d-%d: got %v, want %v", order, k, hi, got, want)
+					}
+				}
+			}
+		}
+		if bt.Len() != len(model) {
+			t.Errorf("order %d: %d keys, want %d", order, bt.Len(), len(model))
+		}
+		c.RemoveServer("btree")
+	}
+}
+
+// filled to capacity in order, the tree gets no deeper than Depth
+func Test_btree_full(t *testing.T) {
+	c := InitClient(16, 4)
+	bt, err := NewBTree(c, "btree", 30, 3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.RemoveServer("btree")
+
+	for k := 0; k < 30; k++ {
+		err := bt.Put(uint64(k), uint64(k*2))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bt.height > bt.Depth() {
+		t.Errorf("height %d, depth %d", bt.height, bt.Depth())
+	}
+	before := bt.o.accesses
+	if bt.Put(1000, 0) == nil {
+		t.Error("put a key in a full tree")
+	}
+	if n := bt.o.accesses - before; n != 3*bt.Depth()+1 {
+		t.Errorf("put in a full tree did %d accesses, want %d", n, 3*bt.Depth()+1)
+	}
+	if err := bt.Put(20, 7); err != nil {
+		t.Errorf("updating a key in a full tree: %v", err)
+	}
+
+	got, err := bt.Range(18, 200)
+	if err != nil || len(got) != 5 || got[0] != (BTreeEntry{18, 36}) || got[2] != (BTreeEntry{20, 7}) || got[4].Key != 22 {
+		t.Errorf("range: %v (%v)", got, err)
+	}
+	if got, _ := bt.Range(500, 600); len(got) != 0 {
+		t.Errorf("empty range: %v", got)
+	}
+}
@@ -0,0 +1,45 @@
+/*
+ * Message framing for the two-party protocols
+ */
+
+package oram2pc
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// largest message we are willing to receive, guards against bogus lengths
+const max_msg_len = 1 << 30
+
+// send a length-prefixed message over a connection
+func send_msg(w io.Writer, msg []byte) error {
+	hdr := make([]byte, 4)
+	binary.LittleEndian.PutUint32(hdr, uint32(len(msg)))
+
+	_, err := w.Write(append(hdr, msg...))
+	return err
+}
+
+// receive a message written by send_msg
+func recv_msg(r io.Reader) ([]byte, error) {
+	hdr := make([]byte, 4)
+	_, err := io.ReadFull(r, hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	n := binary.LittleEndian.Uint32(hdr)
+	if n > max_msg_len {
+		return nil, errors.New("Message too long!")
+	}
+
+	msg := make([]byte, n)
+	_, err = io.ReadFull(r, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,378 @@
+/*
+ * Boolean circuits and a small builder for the 2PC backends
+ */
+
+package oram2pc
+
+import (
+	"encoding/binary"
+)
+
+type gate_op uint8
+
+const (
+	gate_xor gate_op = iota
+	gate_and
+	gate_inv
+)
+
+type gate struct {
+	op  gate_op
+	a   int
+	b   int // unused for gate_inv
+	out int
+}
+
+// wire 0 always carries the constant false
+const wire_zero = 0
+
+/*
+ * A boolean circuit made of XOR, AND and INV gates
+ *
+ * Wires are numbered from 0, gates are stored in topological order.
+ * GarblerInputs and EvaluatorInputs list the input wires of each party,
+ * Outputs lists the wires revealed at the end of the computation.
+ */
+type Circuit struct {
+	NumWires        int
+	GarblerInputs   []int
+	EvaluatorInputs []int
+	Outputs         []int
+	gates           []gate
+}
+
+// number of AND gates, which is what costs anything in both backends
+func (c *Circuit) NumAND() int {
+	n := 0
+	for i := range c.gates {
+		if c.gates[i].op == gate_and {
+			n += 1
+		}
+	}
+
+	return n
+}
+
+// evaluate the circuit in the clear, used to check the 2PC backends
+func (c *Circuit) Eval(g_in []bool, e_in []bool) []bool {
+	w := make([]bool, c.NumWires)
+	for i := range c.GarblerInputs {
+		w[c.GarblerInputs[i]] = g_in[i]
+	}
+	for i := range c.EvaluatorInputs {
+		w[c.EvaluatorInputs[i]] = e_in[i]
+	}
+
+	for _, g := range c.gates {
+		switch g.op {
+		case gate_xor:
+			w[g.out] = w[g.a] != w[g.b]
+		case gate_and:
+			w[g.out] = w[g.a] && w[g.b]
+		case gate_inv:
+			w[g.out] = !w[g.a]
+		}
+	}
+
+	out := make([]bool, len(c.Outputs))
+	for i := range out {
+		out[i] = w[c.Outputs[i]]
+	}
+
+	return out
+}
+
+/*
+ * Builds a Circuit gate by gate
+ */
+type CircuitBuilder struct {
+	c *Circuit
+}
+
+func NewCircuitBuilder() *CircuitBuilder {
+	// reserve wire 0 for the constant false
+	return &CircuitBuilder{c: &Circuit{NumWires: 1}}
+}
+
+func (cb *CircuitBuilder) new_wire() int {
+	w := cb.c.NumWires
+	cb.c.NumWires += 1
+	return w
+}
+
+func (cb *CircuitBuilder) add_gate(op gate_op, a int, b int) int {
+	out := cb.new_wire()
+	cb.c.gates = append(cb.c.gates, gate{op: op, a: a, b: b, out: out})
+	return out
+}
+
+// allocate n input wires for the garbler (or first party)
+func (cb *CircuitBuilder) GarblerInput(n int) []int {
+	ws := make([]int, n)
+	for i := range ws {
+		ws[i] = cb.new_wire()
+	}
+	cb.c.GarblerInputs = append(cb.c.GarblerInputs, ws...)
+
+	return ws
+}
+
+// allocate n input wires for the evaluator (or second party)
+func (cb *CircuitBuilder) EvaluatorInput(n int) []int {
+	ws := make([]int, n)
+	for i := range ws {
+		ws[i] = cb.new_wire()
+	}
+	cb.c.EvaluatorInputs = append(cb.c.EvaluatorInputs, ws...)
+
+	return ws
+}
+
+// mark wires as outputs of the circuit
+func (cb *CircuitBuilder) Output(ws ...int) {
+	cb.c.Outputs = append(cb.c.Outputs, ws...)
+}
+
+func (cb *CircuitBuilder) Build() *Circuit {
+	return cb.c
+}
+
+func (cb *CircuitBuilder) Zero() int {
+	return wire_zero
+}
+
+func (cb *CircuitBuilder) One() int {
+	return cb.NOT(wire_zero)
+}
+
+func (cb *CircuitBuilder) XOR(a int, b int) int {
+	return cb.add_gate(gate_xor, a, b)
+}
+
+func (cb *CircuitBuilder) AND(a int, b int) int {
+	return cb.add_gate(gate_and, a, b)
+}
+
+func (cb *CircuitBuilder) NOT(a int) int {
+	return cb.add_gate(gate_inv, a, -1)
+}
+
+// a | b = (a ^ b) ^ (a & b)
+func (cb *CircuitBuilder) OR(a int, b int) int {
+	return cb.XOR(cb.XOR(a, b), cb.AND(a, b))
+}
+
+// bitwise XOR of two equal-length wire vectors
+func (cb *CircuitBuilder) XORBits(a []int, b []int) []int {
+	out := make([]int, len(a))
+	for i := range a {
+		out[i] = cb.XOR(a[i], b[i])
+	}
+
+	return out
+}
+
+// AND of all wires in a, as a balanced tree
+func (cb *CircuitBuilder) AllOf(a []int) int {
+	if len(a) == 0 {
+		return cb.One()
+	}
+
+	for len(a) > 1 {
+		next := make([]int, 0, (len(a)+1)/2)
+		for i := 0; i+1 < len(a); i += 2 {
+			next = append(next, cb.AND(a[i], a[i+1]))
+		}
+		if len(a)%2 == 1 {
+			next = append(next, a[len(a)-1])
+		}
+		a = next
+	}
+
+	return a[0]
+}
+
+// 1 iff the two wire vectors are equal
+func (cb *CircuitBuilder) Equal(a []int, b []int) int {
+	same := make([]int, len(a))
+	for i := range a {
+		same[i] = cb.NOT(cb.XOR(a[i], b[i]))
+	}
+
+	return cb.AllOf(same)
+}
+
+// 1 iff the wire vector equals the public constant k (little endian bits)
+func (cb *CircuitBuilder) EqualConst(a []int, k uint64) int {
+	same := make([]int, len(a))
+	for i := range a {
+		if i < 64 && (k>>uint(i))&1 == 1 {
+			same[i] = a[i]
+		} else {
+			same[i] = cb.NOT(a[i])
+		}
+	}
+
+	return cb.AllOf(same)
+}
+
+// returns b if s is set and a otherwise, one AND per bit
+func (cb *CircuitBuilder) Mux(s int, a []int, b []int) []int {
+	out := make([]int, len(a))
+	for i := range a {
+		out[i] = cb.XOR(a[i], cb.AND(s, cb.XOR(a[i], b[i])))
+	}
+
+	return out
+}
+
+/*
+ * Circuit versions of the block primitives in blocks.go
+ *
+ * A block is 128 wires in the bit order of block_bits, laid out like in
+ * blocks.go: 32 id wires, 32 leaf wires and 64 value wires. All ones marks a
+ * dummy block.
+ */
+
+// split block wires into id and value wires
+func block_wires(blk []int) ([]int, []int) {
+	return blk[:32], blk[64:128]
+}
+
+func block_leaf_wires(blk []int) []int {
+	return blk[32:64]
+}
+
+// 1 iff blk is the dummy block
+func (cb *CircuitBuilder) IsDummy(blk []int) int {
+	return cb.AllOf(blk)
+}
+
+// 1 iff blk is not a dummy and holds the block with the given id (32 wires)
+func (cb *CircuitBuilder) BlockMatch(blk []int, id []int) int {
+	blk_id, _ := block_wires(blk)
+	return cb.AND(cb.Equal(blk_id, id), cb.NOT(cb.IsDummy(blk)))
+}
+
+/*
+ * Circuit version of slice_find_block: scans every block in the stash and
+ * returns the value of the block with the given id and whether it was found.
+ * Every block is visited no matter where the match is.
+ */
+func (cb *CircuitBuilder) StashScan(stash [][]int, id []int) ([]int, int) {
+	val := make([]int, 64)
+	for i := range val {
+		val[i] = cb.Zero()
+	}
+	found := cb.Zero()
+
+	for i := range stash {
+		match := cb.BlockMatch(stash[i], id)
+		_, blk_val := block_wires(stash[i])
+		val = cb.Mux(match, val, blk_val)
+		found = cb.OR(found, match)
+	}
+
+	return val, found
+}
+
+// 1 iff blk's leaf and the leaf x (32 wires) agree above their lowest shift bits
+func (cb *CircuitBuilder) LeafPrefixMatch(blk []int, x []int, shift int) int {
+	leaf := block_leaf_wires(blk)
+	return cb.Equal(leaf[shift:], x[shift:])
+}
+
+/*
+ * Circuit version of stash.evict: fills the path to leaf x (32 wires) of a
+ * tree of height L from the leaf up, taking for each of the Z slots of a
+ * bucket the first real block whose leaf shares the bucket's prefix with x.
+ * Returns the stash with those blocks replaced by dummies and the buckets
+ * from the root down. Every block is visited for every slot.
+ */
+func (cb *CircuitBuilder) Evict(stash [][]int, x []int, L int, Z int) ([][]int, [][][]int) {
+	dummy := make([]int, 128)
+	for i := range dummy {
+		dummy[i] = cb.One()
+	}
+
+	stash = append([][]int{}, stash...)
+	bux := make([][][]int, L+1)
+	for l := L; l >= 0; l-- {
+		bux[l] = make([][]int, Z)
+		fits := make([]int, len(stash))
+		for i := range stash {
+			fits[i] = cb.LeafPrefixMatch(stash[i], x, L-l)
+		}
+
+		for z := 0; z < Z; z++ {
+			out := dummy
+			done := cb.Zero()
+			for i := range stash {
+				take := cb.AND(cb.AND(fits[i], cb.NOT(cb.IsDummy(stash[i]))), cb.NOT(done))
+				out = cb.Mux(take, out, stash[i])
+				stash[i] = cb.Mux(take, stash[i], dummy)
+				done = cb.OR(done, take)
+			}
+
+			bux[l][z] = out
+		}
+	}
+
+	return stash, bux
+}
+
+// reads table[idx] with a full scan, e.g. for a position map lookup
+func (cb *CircuitBuilder) ArrayRead(table [][]int, idx []int) []int {
+	out := make([]int, len(table[0]))
+	for i := range out {
+		out[i] = cb.Zero()
+	}
+
+	for i := range table {
+		hit := cb.EqualConst(idx, uint64(i))
+		out = cb.Mux(hit, out, table[i])
+	}
+
+	return out
+}
+
+// converts bytes to bits, least significant bit of each byte first
+func bytes_to_bits(b []byte) []bool {
+	bits := make([]bool, len(b)*8)
+	for i := range bits {
+		bits[i] = (b[i/8]>>uint(i%8))&1 == 1
+	}
+
+	return bits
+}
+
+// do the opposite of bytes_to_bits
+func bits_to_bytes(bits []bool) []byte {
+	b := make([]byte, (len(bits)+7)/8)
+	for i := range bits {
+		if bits[i] {
+			b[i/8] |= 1 << uint(i%8)
+		}
+	}
+
+	return b
+}
+
+func uint64_to_bits(v uint64) []bool {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+	return bytes_to_bits(b)
+}
+
+func uint32_to_bits(v uint32) []bool {
+	return uint64_to_bits(uint64(v))[:32]
+}
+
+func bits_to_uint64(bits []bool) uint64 {
+	return binary.LittleEndian.Uint64(bits_to_bytes(bits))
+}
+
+// the wire encoding of a plaintext block, matches block_wires
+func block_bits(blk Block) []bool {
+	return bytes_to_bits(blk)
+}
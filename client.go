@@ -4,28 +4,48 @@
 package oram2pc
 
 import (
-	"crypto/rand"
 	"errors"
-	"fmt"
-	"math"
+	"log/slog"
+	"path/filepath"
 	// "net"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 )
 
+// blocks kept in the stash between accesses before it overflows
+const default_stash_size = 128
+
 /*
  * The client
  */
 type Client struct {
-	N          int
-	L          int
-	B          int
-	Z          int
-	stash      map[string][]Block
-	pos        map[int]int
-	keys       map[string][]byte
-	servers    map[string]*Server
+	N       int
+	L       int
+	B       int
+	Z       int
+	S       int
+	stash   map[string]*stash
+	pos     map[string]map[int]int // leaf of every block written, per server
+	keys    map[string]*server_keys
+	servers map[string]*Server
+	dirty   map[string]int // leaf whose write back failed, per server
+	evict   map[string]*evict_state
+	wo      map[string]*wo_state // write-only servers, see writeonly.go
+
+	// write-ahead logs, only once the client has a state file
+	state     string
+	wals      map[string]*wal
+	pos_delta map[string]map[int]int // position map changes not logged yet
+
+	master   []byte            // every key is derived from it, nil until imported
+	check    []byte            // tells the master key from a wrong one
+	detached bool              // Save leaves the master key out
+	locked   map[string][]byte // sealed state of servers loaded without the master key
+
+	Logger  *slog.Logger // nil logs through the package logger
+	metrics Metrics
 }
 
 /*
@@ -36,29 +56,33 @@ type Client struct {
  *   L: height of the tree
  *   B: Number of bytes in each block (fixed to 32 bytes)
  *   Z: Number of blocks in each bucket
- *   S: size of client's stash in blocks
- *   key: 16-byte key to encrypt blocks with
+ *   S: size of client's stash in blocks, not counting the path being
+ *      evicted
+ *
+ * and a random master key (see keys.go). Block ids are 32 bits, so it
+ * panics if N isn't below 2^32-1.
  */
 func InitClient(N int, Z int) *Client {
-	c := &Client{N: N, B: 32, Z: Z, pos: make(map[int]int)}
-
-	// initialize pos map as random values
-	// create cryptographically secure shuffling of leaves
-	c.L = int(math.Ceil(math.Log2(float64(N))))
-	random_leaves := random_perm(1 << uint(c.L))
-
-	// assign each block with a unique random leaf
-	for i := 0; i < N; i++ {
-		// not all leaves will be used if N < 2^L but that's okay
-		c.pos[i] = int(random_leaves[i])
+	if N >= max_blocks {
+		panic("oram2pc: too many blocks for 32-bit ids")
 	}
+	c := &Client{N: N, B: 32, Z: Z, S: default_stash_size, pos: make(map[string]map[int]int)}
+	c.metrics = nop_metrics{}
+	c.L = ceil_log2(N)
 
 	// init stash map
-	c.stash = make(map[string][]Block)
+	c.stash = make(map[string]*stash)
 
 	// initialize empty server map and keys map
 	c.servers = make(map[string]*Server)
-	c.keys = make(map[string][]byte)
+	c.keys = make(map[string]*server_keys)
+	c.dirty = make(map[string]int)
+	c.evict = make(map[string]*evict_state)
+	c.wo = make(map[string]*wo_state)
+	c.wals = make(map[string]*wal)
+	c.pos_delta = make(map[string]map[int]int)
+	c.master = new_master_key()
+	c.check = key_check(c.master)
 
 	return c
 }
@@ -71,38 +95,183 @@ func (c *Client) ServerInfo(name string) string {
 
 	namestr := "Server: " + name
 	nstr := "\tN: " + strconv.Itoa(s.N)
-	zstr := "\tZ: " + strconv.Itoa(s.Z)
+	zstr := "\tZ: " + strconv.Itoa(s.Z) + "\n\tleaves: " + strconv.Itoa(s.leaves)
 	dirstr := "\tdir: " + s.dir
+	backstr := "\tbackend: " + s.backend.String() + ", " + s.format.String() + " buckets"
+	if s.backend == BackendSingle && s.subtree > 1 {
+		backstr += ", " + strconv.Itoa(s.subtree) + "-level subtrees"
+	}
+	if s.direct {
+		backstr += " (O_DIRECT)"
+	}
+	evictstr := "\teviction: " + c.evict[name].policy.String()
+	if _, prs := c.wo[name]; prs == true {
+		evictstr = "\tmode: write-only"
+	}
 
-	return strings.Join([]string{namestr, nstr, zstr, dirstr}, "\n")
+	return strings.Join([]string{namestr, nstr, zstr, dirstr, backstr, evictstr}, "\n")
+}
+
+// names of the client's servers, sorted
+func (c *Client) Servers() []string {
+	names := make([]string, 0, len(c.servers))
+	for name := range c.servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// I/O done on a server's tree so far
+func (c *Client) ServerIO(name string) IOStats {
+	s, prs := c.servers[name]
+	if prs == false {
+		return IOStats{}
+	}
+
+	return s.io_stats()
+}
+
+// number of real blocks in a server's stash
+func (c *Client) StashSize(name string) int {
+	c.settle(name)
+	st, prs := c.stash[name]
+	if prs == false {
+		return 0
+	}
+
+	return st.size()
 }
 
 func (c *Client) AddServer(name string, N int, Z int, fsize int) error {
+	return c.AddServerAt(name, N, Z, fsize, "")
+}
+
+// same as AddServer but keeps the tree in dir (a random temp dir if "")
+func (c *Client) AddServerAt(name string, N int, Z int, fsize int, dir string) error {
+	return c.AddServerWith(name, N, Z, ServerOptions{Fsize: fsize, Dir: dir})
+}
+
+// adds a server with a choice of storage backend
+func (c *Client) AddServerWith(name string, N int, Z int, opts ServerOptions) error {
 	_, prs := c.servers[name]
 	if prs == true {
 		return errors.New("A server already exists with that name!")
 	}
+	// the name goes into the paths of the server's log files
+	if strings.ContainsAny(name, "/"+string(filepath.Separator)) {
+		return errors.New("Server names can't contain a path separator!")
+	}
+	if c.master == nil {
+		return ErrNoKey
+	}
+	if opts.WriteOnly && opts.Eviction != nil {
+		return errors.New("Write-only servers don't evict!")
+	}
+	if N >= max_blocks || c.N >= max_blocks {
+		return range_err("%d blocks, ids are 32 bits", max(N, c.N))
+	}
+	if opts.Leaves > max_leaves {
+		return range_err("%d leaves, leaves are 32 bits", opts.Leaves)
+	}
+	c.settle_all()
+	if opts.Fsize <= 0 {
+		opts.Fsize = 4096
+	}
+
 	// add new server
-	c.servers[name] = init_server(N, Z, fsize)
+	srv := init_server(N, Z, opts.Fsize)
+	if opts.Dir != "" {
+		srv.dir = opts.Dir
+	}
+	if opts.Leaves < 0 {
+		return errors.New("Number of leaves can't be negative!")
+	}
+	if opts.Leaves > 0 {
+		srv.set_leaves(opts.Leaves)
+	}
+	if _, prs := format_names[opts.Format]; prs == false {
+		return errors.New("Unknown bucket format!")
+	}
+	srv.format = opts.Format
+	srv.backend = opts.Backend
+	srv.direct = opts.Direct
+	srv.subtree = opts.Subtree
+	err := srv.open_storage()
+	if err != nil {
+		return err
+	}
+	c.servers[name] = srv
+	c.servers[name].name = name
+	c.servers[name].metrics = c.metrics
+	c.pos[name] = make(map[int]int)
+	c.pos_delta[name] = make(map[int]int)
+
+	// derive the key of epoch 0 for that server
+	c.keys[name] = &server_keys{}
+	c.derive_keys(name)
+
+	// init stash, with room for what the eviction policy leaves in it on
+	// top of c.S
+	s := c.servers[name]
+	e := new_evict_state(opts.Eviction)
+	c.evict[name] = e
+	c.stash[name] = new_stash(c.S + e.policy.stash_room(s.L, s.Z))
+	if opts.WriteOnly {
+		c.wo[name] = new_wo_state(nil)
+		c.stash[name] = new_stash(c.S)
+	}
 
-	// generate random key for that server
-	key := make([]byte, 16)
-	rand.Read(key)
-	c.keys[name] = key
+	// initialize serverside storage as all dummy blocks
+	err = c.init_server_storage(name)
+	if err != nil {
+		delete(c.servers, name)
+		delete(c.keys, name)
+		delete(c.stash, name)
+		delete(c.evict, name)
+		delete(c.wo, name)
+		delete(c.pos, name)
+		delete(c.pos_delta, name)
+		s.remove_tree()
+		return err
+	}
 
-	// init stash
-	S := c.N * c.L
-	c.stash[name] = make([]Block, 0, S)
+	return nil
+}
 
-	// initialize serverside storage as all dummy blocks
-	err := c.init_server_storage(name, key)
+// closes the files of every server, their trees stay on disk
+func (c *Client) Close() error {
+	c.settle_all()
+	var first error
+	for _, s := range c.servers {
+		err := s.store.close()
+		if err != nil && first == nil {
+			first = err
+		}
+	}
 
-	return err
+	return first
 }
 
 func (c *Client) RemoveServer(name string) error {
+	c.settle_all()
 	s, prs := c.servers[name]
 	if prs == true {
+		delete(c.servers, name)
+		delete(c.keys, name)
+		delete(c.stash, name)
+		delete(c.locked, name)
+		delete(c.dirty, name)
+		delete(c.evict, name)
+		delete(c.wo, name)
+		delete(c.pos, name)
+		delete(c.pos_delta, name)
+		if w, prs := c.wals[name]; prs == true {
+			delete(c.wals, name)
+			w.reset()
+		}
+
 		err := s.remove_tree()
 		return err
 	}
@@ -110,19 +279,30 @@ func (c *Client) RemoveServer(name string) error {
 	return errors.New("No server exists by that name!")
 }
 
-func (c *Client) init_server_storage(name string, key []byte) error {
+func (c *Client) init_server_storage(name string) error {
 	s, prs := c.servers[name]
 	if prs == false {
 		return errors.New("No server found by that name!")
 	}
 
-	s.create_tree()
+	err := s.create_tree()
+	if err != nil {
+		return err
+	}
 
-	// encrypt c.Z dummy blocks to get a bucket, and write to every node in tree
+	// encrypt c.Z dummy blocks to get a bucket, and write to every node in
+	// tree, a level at a time
 	for i := 0; i <= s.L; i++ {
-		for j := 0; j < (1 << uint(i)); j++ {
-			bucket := make_bucket(nil, c.Z, key)
-			s.write_node(bucket, i, j)
+		nodes := make([]node, s.width(i))
+		bux := make([]Bucket, len(nodes))
+		for j := range nodes {
+			nodes[j] = node{i, j}
+			bux[j] = c.seal_bucket(name, nodes[j], nil)
+		}
+
+		err := s.write_nodes(nodes, bux)
+		if err != nil {
+			return err
 		}
 	}
 
@@ -131,161 +311,449 @@ func (c *Client) init_server_storage(name string, key []byte) error {
 
 func (c *Client) Access(name string, write bool, a int, data uint64) (uint64, error) {
 	var ret uint64 = 0
+	if _, prs := c.wo[name]; prs == true {
+		if write {
+			return data, c.wo_write(name, a, data)
+		}
+		return c.wo_read(name, a)
+	}
+
+	x, new_leaf, err := c.remap(name, a)
+	if err != nil {
+		return ret, err
+	}
+
+	// read or write block a without branching on the op or where it is,
+	// the position map only changes once the block in the stash has
+	err = c.access_path(name, x, func(st *stash) error {
+		var err error
+		ret, err = st.access(a, write, data, new_leaf)
+		if err == nil {
+			c.set_pos(name, a, new_leaf)
+		}
+		return err
+	})
+
+	return ret, err
+}
+
+/*
+ * Reads block a and stores f of its value, in a single path access. f runs
+ * once the path is in the stash and says whether to write at all, the stash
+ * is touched the same way either way.
+ */
+func (c *Client) update(name string, a int, f func(v uint64) (uint64, bool)) error {
+	if _, prs := c.wo[name]; prs == true {
+		v, err := c.wo_read(name, a)
+		if err != nil {
+			return err
+		}
+		v, write := f(v)
+		if write {
+			return c.wo_write(name, a, v)
+		}
+		return nil
+	}
+
+	x, new_leaf, err := c.remap(name, a)
+	if err != nil {
+		return err
+	}
 
+	return c.access_path(name, x, func(st *stash) error {
+		v, err := st.access(a, false, 0, new_leaf)
+		if err != nil {
+			return err
+		}
+		v, write := f(v)
+		_, err = st.access(a, write, v, new_leaf)
+		if err == nil {
+			c.set_pos(name, a, new_leaf)
+		}
+		return err
+	})
+}
+
+// returns the leaf block a is on and a new random leaf for it
+func (c *Client) remap(name string, a int) (int, int, error) {
 	// get server
 	s, prs := c.servers[name]
 	if prs == false {
-		return ret, errors.New("Could not find server by that name!")
+		return 0, 0, errors.New("Could not find server by that name!")
 	}
 
-	// get encryption key for this server
-	key, prs := c.keys[name]
-	if prs == false {
-		return ret, errors.New("Could not find server by that name!")
+	err := c.check_addr(a)
+	if err != nil {
+		return 0, 0, err
 	}
 
-	// get position from posmap
-	x, prs := c.pos[a]
+	// get position from posmap, a block never written is on no path and
+	// any leaf will do
+	x, prs := c.pos[name][a]
 	if prs == false {
-		return ret, errors.New("Tried to look up invalid block number in pos!")
+		x = gen_int(s.leaves)
+	}
+	if x >= s.leaves {
+		return 0, 0, range_err("leaf %d of block %d", x, a)
 	}
 
 	// map block a to new random leaf
-	num_leaves := 1 << uint(c.L)
-	new_leaf := gen_int(num_leaves)
-	c.pos[a] = new_leaf
+	return x, gen_int(s.leaves), nil
+}
 
-	// read path containing block a (i.e. the path to leaf x)
-	buckets, err := s.get_path_buckets(x)
+// reads and writes back a random path without touching any block
+func (c *Client) fake_access(name string) error {
+	s, prs := c.servers[name]
+	if prs == false {
+		return errors.New("Could not find server by that name!")
+	}
+
+	return c.access_path(name, gen_int(s.leaves), func(*stash) error { return nil })
+}
+
+// block ids go from 0 to N-1 on every server
+func (c *Client) check_addr(a int) error {
+	if a < 0 || a >= c.N {
+		return range_err("block %d", a)
+	}
+
+	return nil
+}
+
+// maps block a of a server to leaf x, remembering the change for the log
+func (c *Client) set_pos(name string, a int, x int) {
+	c.pos[name][a] = x
+	if len(c.wals) > 0 {
+		c.pos_delta[name][a] = x
+	}
+}
+
+/*
+ * Reads the path to leaf x into the stash, runs op on the stash, and writes
+ * the path back, pushing blocks as deep as they can go, or leaves it to the
+ * server's eviction policy (see evict.go)
+ *
+ * If reading the path or op fails, the stash is rolled back and nothing has
+ * changed. If the write back fails, every block stays in the stash and the
+ * path is written back again before the next access, since some of its
+ * buckets may hold stale copies of blocks.
+ */
+func (c *Client) access_path(name string, x int, op func(*stash) error) error {
+	if _, prs := c.wo[name]; prs == true {
+		return ErrWriteOnly
+	}
+	err := c.flush_dirty(name)
 	if err != nil {
-		return ret, err
+		return err
 	}
+	s := c.servers[name]
+	e := c.evict[name]
 
-	start := time.Now()
+	var m AccessMetrics
+	blks, err := c.read_path(name, x, 0, &m)
+	if err != nil {
+		return err
+	}
 
-	// write nondummy blocks into stash, record which indexes they're at
-	cur_stash := c.stash[name]
-	nondummy := find_nondummy(buckets, key)
-	path_start := len(cur_stash)
-	cur_stash = append(cur_stash, nondummy...)
-	path_end := len(cur_stash)
-	// fmt.Println("path_start:", path_start)
-	// fmt.Println("path_end:", path_end)
-
-	// fmt.Println("nondummy blocks:", nondummy)
-
-	// find index of block we're looking for
-	i := slice_find_block(cur_stash, a)
-
-	// modify contents of block in the stash for a write operation
-	if write {
-		// fmt.Println("if writing, found elem at idx", i)
-		new_blk := block_encode(a, data)
-		// if element not found, add it as a stash block
-		if i == -1 {
-			cur_stash = append(cur_stash, new_blk)
-		} else {
-			cur_stash[i] = new_blk
+	err = c.apply_path(name, blks, op, &m)
+	if err != nil {
+		return err
+	}
+	path, _ := s.get_path(x)
+	e.fetch(path)
+
+	if e.policy.writes_back() {
+		start := time.Now()
+		wb, err := c.evict_path(name, x, c.take_pos_delta(name))
+		if err != nil {
+			return err
+		}
+		io_start := s.io_stats()
+		err = c.finish_write_back(wb, wb.run())
+		if err != nil {
+			return err
 		}
+		m.Write = time.Since(start)
+		m.BytesWritten = s.io_stats().BytesWritten - io_start.BytesWritten
+		m.Evicted = wb.evicted
+	}
 
-		ret = data
-	} else {
-		if i == -1 {
-			ret = 0;
-		} else {
-			_, ret, _ = block_decode(cur_stash[i])
+	c.observe_access(name, m)
+	e.accesses += 1
+	return c.schedule_evictions(name)
+}
+
+// rewrites the path of a failed write back or sweep, if there is one
+func (c *Client) flush_dirty(name string) error {
+	_, prs := c.servers[name]
+	if prs == false {
+		return errors.New("Could not find server by that name!")
+	}
+	if c.master == nil {
+		return ErrNoKey
+	}
+	c.settle(name)
+
+	if c.keys[name].pending != nil {
+		err := c.sweep_write(name)
+		if err != nil {
+			return err
 		}
 	}
 
-	elapsed := time.Since(start)
-	fmt.Printf("Calculating writeback took %s\n", elapsed)
+	dirty, prs := c.dirty[name]
+	if prs == true {
+		return c.write_back(name, dirty)
+	}
 
+	return nil
+}
 
-	// fmt.Println("current stash after writing nondummy blocks:", cur_stash)
+/*
+ * Reads and decrypts the buckets of the path to leaf x from level from
+ * down, without touching the stash. Buckets whose blocks are already in the
+ * stash aren't read.
+ */
+func (c *Client) read_path(name string, x int, from int, m *AccessMetrics) ([]Block, error) {
+	s := c.servers[name]
 
-	// find intersections between old and new path
-	old_path, err := s.get_path(x)
+	path, err := s.get_path(x)
 	if err != nil {
-		return ret, err
+		return nil, err
 	}
-	// fmt.Println("old path:", old_path)
 
-	new_path, err := s.get_path(new_leaf)
+	// read path to leaf x
+	io_start := s.io_stats()
+	start := time.Now()
+	fetched := c.evict[name].fetched
+	nodes := make([]node, 0, len(path)-from)
+	for l := from; l < len(path); l++ {
+		if fetched[node{l, path[l]}] == false {
+			nodes = append(nodes, node{l, path[l]})
+		}
+	}
+	buckets, err := s.read_nodes(nodes)
 	if err != nil {
-		return ret, err
+		return nil, err
 	}
-	// fmt.Println("new path:", new_path)
+	m.Read = time.Since(start)
+	m.BytesRead = s.io_stats().BytesRead - io_start.BytesRead
+
+	// decrypt everything before touching the stash
+	start = time.Now()
+	blks := make([]Block, 0, len(buckets)*s.Z)
+	for i := range buckets {
+		bucket, err := c.open_bucket(name, nodes[i], buckets[i])
+		if err != nil {
+			return nil, err
+		}
+		blks = append(blks, bucket...)
+	}
+	m.Decrypt = time.Since(start)
 
-	num_inters := 0
-	for i := range old_path {
-		if old_path[i] == new_path[i] {
-			num_inters += 1
+	return blks, nil
+}
+
+/*
+ * Moves every real block of blks into the stash and runs op, rolling the
+ * stash back if either fails
+ */
+func (c *Client) apply_path(name string, blks []Block, op func(*stash) error, m *AccessMetrics) error {
+	st := c.stash[name]
+
+	start := time.Now()
+	saved := st.snapshot()
+	for _, blk := range blks {
+		err := st.add(blk, 1-ct_is_dummy(blk))
+		if err != nil {
+			st.restore(saved)
+			return err
 		}
 	}
+	m.Decrypt += time.Since(start)
 
-	// fill list of intersections greedily (starting from the leaf)
-	inters := make([]int, num_inters)
-	for i := 0; i < num_inters; i++ {
-		inters[i] = old_path[num_inters-1-i]
+	start = time.Now()
+	err := op(st)
+	if err != nil {
+		st.restore(saved)
+		return err
 	}
-	// fmt.Println("Found intersection:", inters)
+	m.Stash = time.Since(start)
 
-	// write back path
+	return nil
+}
 
-	// write back nondummy blocks first
-	blk_to_write := make([]Block, 0, len(inters))
-	num := cap(blk_to_write) - len(blk_to_write)
-	if path_end - path_start < num  {
-		num = path_end - path_start
+func (c *Client) observe_access(name string, m AccessMetrics) {
+	m.StashSize = c.stash[name].size()
+	if c.metrics != nil {
+		c.metrics.ObserveAccess(name, m)
 	}
+	c.log().Debug("oram access", "server", name, "read", m.Read, "decrypt", m.Decrypt,
+		"stash", m.Stash, "write", m.Write, "stash_size", m.StashSize, "evicted", m.Evicted)
+}
 
-	// fmt.Println("len of blk to write:", len(blk_to_write))
-	// fmt.Println("cap of blk to write:", cap(blk_to_write))
+// writes back a path whose earlier write back failed
+func (c *Client) write_back(name string, x int) error {
+	_, err := c.write_back_path(name, x)
+	if err != nil {
+		return err
+	}
 
-	blk_to_write = append(blk_to_write, cur_stash[path_start : path_start + num]...)
-	// fmt.Println("Writing back nondummy blocks:", blk_to_write)
+	c.log().Info("oram: rewrote path after a failed write back", "server", name)
+	return nil
+}
 
-	// if there aren't enough blocks to write back, then write stash blocks
-	if len(blk_to_write) < cap(blk_to_write) {
-		num = cap(blk_to_write) - len(blk_to_write)
-		if len(cur_stash) < num {
-			num = len(cur_stash)
-		}
+/*
+ * Evicts the stash onto the path to leaf x and writes it, returning how many
+ * real blocks were evicted. On failure the stash gets its blocks back and x
+ * is remembered as dirty.
+ */
+func (c *Client) write_back_path(name string, x int) (int, error) {
+	wb, err := c.evict_path(name, x, c.take_pos_delta(name))
+	if err != nil {
+		return 0, err
+	}
 
-		blk_to_write = append(blk_to_write, cur_stash[:num]...)
-		cur_stash = append(cur_stash[num:])
-		// fmt.Printf("Appended %d stash block...\n", num)
+	err = c.finish_write_back(wb, wb.run())
+	if err != nil {
+		return 0, err
 	}
 
-	// if out of stash blocks, write dummy blocks
-	if len(blk_to_write) < cap(blk_to_write) {
-		dummy := make([]Block, len(inters)-len(blk_to_write))
-		for i := range dummy {
-			dummy[i] = dummy_block()
+	return wb.evicted, nil
+}
+
+/*
+ * A path write back that has been evicted and encrypted but not written
+ *
+ * run only touches the log and the tree, so it can go on while the client
+ * works on something else, as long as finish_write_back is called after.
+ */
+type path_write struct {
+	name    string
+	x       int
+	s       *Server
+	nodes   []node
+	buckets []Bucket
+	plain   []Bucket // what was evicted to each level, unencrypted
+	w       *wal     // nil if the client isn't logging
+	rec     wal_record
+	pos     map[int]int // position map changes the record logs
+	saved   []Block     // the stash before eviction
+	evicted int
+}
+
+/*
+ * Evicts the stash onto the path to leaf x, whose blocks all have to be in
+ * the stash, and encrypts it. The log record takes pos, the position map
+ * changes not logged yet.
+ */
+func (c *Client) evict_path(name string, x int, pos map[int]int) (*path_write, error) {
+	s := c.servers[name]
+	st := c.stash[name]
+	k := c.keys[name]
+
+	path, err := s.get_path(x)
+	if err != nil {
+		return nil, err
+	}
+
+	wb := &path_write{name: name, x: x, s: s, saved: st.snapshot(), pos: pos}
+	wb.plain = st.evict(x, s.L, s.Z)
+	wb.buckets = make([]Bucket, len(wb.plain))
+	wb.nodes = make([]node, len(path))
+	for l := range wb.plain {
+		for _, blk := range wb.plain[l] {
+			wb.evicted += 1 - ct_is_dummy(blk)
 		}
+		wb.nodes[l] = node{l, path[l]}
+		wb.buckets[l] = c.seal_bucket(name, wb.nodes[l], wb.plain[l])
+	}
 
-		blk_to_write = append(blk_to_write, dummy...)
-		// fmt.Printf("Appending %d dummy blocks...\n", len(dummy))
+	// the log gets the whole write back before the tree is touched
+	w, logged := c.wals[name]
+	if logged {
+		wb.w = w
+		sealed, err := c.seal_state(name, k.epoch, wal_secrets{Pos: pos, Stash: st.snapshot()})
+		if err != nil {
+			st.restore(wb.saved)
+			return nil, c.settle_write(name, pos, nil, err)
+		}
+		wb.rec = wal_record{Leaf: x, Epoch: k.epoch, Buckets: make([][]byte, len(wb.buckets)), State: sealed}
+		for l := range wb.buckets {
+			wb.rec.Buckets[l] = bucket_join(wb.buckets[l], nil)
+		}
+		wb.rec.Fetched = c.evict[name].fetched_ids(path)
 	}
 
-	// write blocks
-	for i := range inters {
-		cur_l := len(inters) - 1 - i
-		bucket := make_bucket([]Block{blk_to_write[i]}, s.Z, key)
-		s.write_node(bucket, cur_l, inters[i])
+	return wb, nil
+}
+
+func (wb *path_write) run() error {
+	if wb.w != nil {
+		err := wb.w.append(wb.rec)
+		if err != nil {
+			return err
+		}
+	}
+
+	return wb.s.write_nodes(wb.nodes, wb.buckets)
+}
+
+// position map changes of a server not logged yet, which the caller now has to log
+func (c *Client) take_pos_delta(name string) map[int]int {
+	if len(c.wals) == 0 {
+		return nil
 	}
 
-	// TODO: calculate which blocks to write back into the original path?
+	pos := c.pos_delta[name]
+	c.pos_delta[name] = make(map[int]int)
+	return pos
+}
+
+/*
+ * Settles a write back once run has returned err. On failure the stash gets
+ * its blocks back, otherwise the path's buckets are fresh on the server
+ * again, under the current key.
+ */
+func (c *Client) finish_write_back(wb *path_write, err error) error {
+	if err != nil {
+		c.stash[wb.name].restore(wb.saved)
+	} else {
+		path, _ := wb.s.get_path(wb.x)
+		c.evict[wb.name].release(path)
+		c.keys[wb.name].written(wb.nodes)
+	}
 
-	// if can't write anymore blocks, copy to the stash
-	if len(inters) < len(blk_to_write) {
-		extra_blks := blk_to_write[len(inters):]
-		cur_stash = append(cur_stash, extra_blks...)
+	return c.settle_write(wb.name, wb.pos, wb, err)
+}
 
-		// fmt.Printf("Adding %d blocks to stash...\n", len(extra_blks))
+/*
+ * The part of settling a write back that touches state shared between
+ * servers. On failure the position map changes in pos go back to waiting
+ * for the log and the path of wb, if it got that far, is remembered as
+ * dirty.
+ */
+func (c *Client) settle_write(name string, pos map[int]int, wb *path_write, err error) error {
+	if err != nil {
+		for a, x := range pos {
+			if _, prs := c.pos_delta[name][a]; prs == false {
+				c.pos_delta[name][a] = x
+			}
+		}
+		if wb != nil {
+			c.dirty[name] = wb.x
+		}
+		c.log().Error("oram: write back failed", "server", name, "err", err)
+		return err
 	}
+	delete(c.dirty, name)
 
-	c.stash[name] = cur_stash
+	if w, prs := c.wals[name]; prs == true && w.size > wal_max_size {
+		err := c.Save(c.state)
+		if err != nil {
+			c.log().Error("oram: checkpoint failed", "err", err)
+		}
+	}
 
-	return ret, nil
+	return nil
 }
@@ -0,0 +1,421 @@
+/*
+ * oram-bench: sweeps ORAM parameters over generated or recorded workloads
+ *
+ * For every combination of scheme, backend, format, eviction policy, N, Z
+ * and block size it builds a fresh store, runs the workload through
+ * Client.Access and reports throughput, latency percentiles, I/O per access
+ * and a histogram of the stash size, as JSON and/or CSV. The schemes are
+ * path (Path ORAM) and write-only, which has no eviction policy and runs
+ * once whatever -eviction says. Blocks are always 32 bytes for now, so -B
+ * takes other sizes but fails before running anything.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	oram2pc "github.com/usipeus/oram-2pc"
+)
+
+// the block size of the library, Client.B
+const block_size = 32
+
+// one operation of a workload
+type op struct {
+	write bool
+	addr  int
+	value uint64
+}
+
+type result struct {
+	Scheme   string `json:"scheme"`
+	Backend  string `json:"backend"`
+	Format   string `json:"format"`
+	Eviction string `json:"eviction"`
+	N        int    `json:"n"`
+	Z        int    `json:"z"`
+	B        int    `json:"b"`
+	Workload string `json:"workload"`
+	Ops      int    `json:"ops"`
+
+	Seconds    float64 `json:"seconds"`
+	Throughput float64 `json:"ops_per_sec"`
+	P50        float64 `json:"lat_p50_us"`
+	P90        float64 `json:"lat_p90_us"`
+	P99        float64 `json:"lat_p99_us"`
+	P999       float64 `json:"lat_p999_us"`
+	Max        float64 `json:"lat_max_us"`
+
+	BytesRead    float64 `json:"bytes_read_per_access"`
+	BytesWritten float64 `json:"bytes_written_per_access"`
+	Fsyncs       float64 `json:"fsyncs_per_access"`
+	Seeks        float64 `json:"seeks_per_access"`
+
+	StashMax  int         `json:"stash_max"`
+	StashHist map[int]int `json:"stash_hist"`
+}
+
+func main() {
+	schemes := flag.String("scheme", "path", "comma-separated ORAM schemes: path, write-only")
+	backends := flag.String("backend", "files", "comma-separated storage backends: files, single")
+	direct := flag.Bool("direct", false, "open the single file backend with O_DIRECT")
+	subtree := flag.Int("subtree", 0, "levels per subtree in the single file backend (0 for heap order)")
+	formats := flag.String("format", "blocks", "comma-separated bucket formats: blocks, compact")
+	evictions := flag.String("eviction", "per-access", "comma-separated eviction policies: per-access, every:<k>, above:<stash blocks>")
+	ns := flag.String("N", "1024,4096", "comma-separated numbers of blocks")
+	zs := flag.String("Z", "4", "comma-separated bucket sizes")
+	bs := flag.String("B", "32", "comma-separated block sizes in bytes, only 32 is supported")
+	workloads := flag.String("workload", "uniform", "comma-separated workloads: uniform, zipf, sequential, trace")
+	ops := flag.Int("ops", 1000, "operations per run (ignored for trace)")
+	writes := flag.Float64("writes", 0.5, "fraction of generated operations that are writes")
+	zipf_s := flag.Float64("zipf-s", 1.2, "skew of the zipf workload, must be > 1")
+	trace := flag.String("trace", "", "trace file for the trace workload, lines of \"r addr\" or \"w addr value\"")
+	seed := flag.Int64("seed", 1, "seed for the workload generators")
+	fsize := flag.Int("fsize", 4096, "size of each file in the tree")
+	json_out := flag.String("json", "-", "write JSON results here (- for stdout, empty to skip)")
+	csv_out := flag.String("csv", "", "write CSV results here (- for stdout, empty to skip)")
+	flag.Parse()
+
+	n_list, err := int_list(*ns)
+	check(err)
+	z_list, err := int_list(*zs)
+	check(err)
+	b_list, err := int_list(*bs)
+	check(err)
+	for _, B := range b_list {
+		if B != block_size {
+			check(fmt.Errorf("block size %d isn't supported, blocks are %d bytes", B, block_size))
+		}
+	}
+
+	policies := []oram2pc.Eviction{}
+	for _, e := range split(*evictions) {
+		p, err := oram2pc.ParseEviction(e)
+		if err != nil {
+			check(fmt.Errorf("unknown eviction policy %q", e))
+		}
+		policies = append(policies, p)
+	}
+
+	format_list := []oram2pc.BucketFormat{}
+	for _, f := range split(*formats) {
+		bf, err := oram2pc.ParseBucketFormat(f)
+		if err != nil {
+			check(fmt.Errorf("unknown bucket format %q", f))
+		}
+		format_list = append(format_list, bf)
+	}
+
+	results := []result{}
+	for _, scheme := range split(*schemes) {
+		for _, backend := range split(*backends) {
+			for _, bf := range format_list {
+				for i, p := range policies {
+					if scheme == "write-only" && i > 0 {
+						continue
+					}
+					for _, N := range n_list {
+						for _, Z := range z_list {
+							for _, B := range b_list {
+								for _, wl := range split(*workloads) {
+									rng := rand.New(rand.NewSource(*seed))
+									w, err := make_workload(wl, N, *ops, *writes, *zipf_s, *trace, rng)
+									check(err)
+
+									opts := oram2pc.ServerOptions{Direct: *direct, Subtree: *subtree, Format: bf, Fsize: *fsize, Eviction: p}
+									r, err := run(scheme, backend, opts, N, Z, B, w)
+									check(err)
+									r.Workload = wl
+									results = append(results, r)
+								}
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+
+	if *json_out != "" {
+		check(write_out(*json_out, func(w io.Writer) error { return write_json(w, results) }))
+	}
+	if *csv_out != "" {
+		check(write_out(*csv_out, func(w io.Writer) error { return write_csv(w, results) }))
+	}
+}
+
+func check(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "oram-bench:", err)
+		os.Exit(1)
+	}
+}
+
+func split(s string) []string {
+	parts := strings.Split(s, ",")
+	out := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+
+	return out
+}
+
+func int_list(s string) ([]int, error) {
+	out := []int{}
+	for _, p := range split(s) {
+		v, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q", p)
+		}
+		out = append(out, v)
+	}
+
+	return out, nil
+}
+
+func make_workload(name string, N int, n int, writes float64, zipf_s float64, trace string, rng *rand.Rand) ([]op, error) {
+	var next func(i int) int
+	switch name {
+	case "uniform":
+		next = func(int) int { return rng.Intn(N) }
+	case "zipf":
+		if zipf_s <= 1 {
+			return nil, errors.New("zipf-s must be > 1")
+		}
+		z := rand.NewZipf(rng, zipf_s, 1, uint64(N-1))
+		next = func(int) int { return int(z.Uint64()) }
+	case "sequential":
+		next = func(i int) int { return i % N }
+	case "trace":
+		return read_trace(trace, N)
+	default:
+		return nil, fmt.Errorf("unknown workload %q", name)
+	}
+
+	w := make([]op, n)
+	for i := range w {
+		w[i] = op{write: rng.Float64() < writes, addr: next(i), value: rng.Uint64()}
+	}
+
+	return w, nil
+}
+
+// reads a trace of "r addr" and "w addr value" lines
+func read_trace(path string, N int) ([]op, error) {
+	if path == "" {
+		return nil, errors.New("the trace workload needs -trace")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	w := []op{}
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		var o op
+		switch {
+		case fields[0] == "r" && len(fields) == 2:
+		case fields[0] == "w" && len(fields) == 3:
+			o.write = true
+			o.value, err = strconv.ParseUint(fields[2], 0, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+			}
+		default:
+			return nil, fmt.Errorf("%s:%d: bad trace line", path, line)
+		}
+
+		o.addr, err = strconv.Atoi(fields[1])
+		if err != nil || o.addr < 0 || o.addr >= N {
+			return nil, fmt.Errorf("%s:%d: bad address %q", path, line, fields[1])
+		}
+		w = append(w, o)
+	}
+
+	return w, sc.Err()
+}
+
+// keeps the stash size after the latest access, for sampling between accesses
+type stash_metrics struct {
+	size atomic.Int64
+}
+
+func (sm *stash_metrics) ObserveAccess(server string, m oram2pc.AccessMetrics) {
+	sm.size.Store(int64(m.StashSize))
+}
+
+func (sm *stash_metrics) ObserveIO(string, string, int, time.Duration) {}
+
+// builds a fresh store for one configuration and runs the workload on it
+func run(scheme string, backend string, opts oram2pc.ServerOptions, N int, Z int, B int, w []op) (result, error) {
+	r := result{Scheme: scheme, Backend: backend, Format: opts.Format.String(), Eviction: opts.Eviction.String(), N: N, Z: Z, B: B, Ops: len(w)}
+	switch scheme {
+	case "path":
+	case "write-only":
+		opts.WriteOnly = true
+		opts.Eviction = nil
+		r.Eviction = "none"
+	default:
+		return r, fmt.Errorf("unknown scheme %q", scheme)
+	}
+	be, err := oram2pc.ParseBackend(backend)
+	if err != nil {
+		return r, fmt.Errorf("unknown backend %q", backend)
+	}
+	if be == oram2pc.BackendSingle && opts.Subtree > 1 {
+		r.Backend += fmt.Sprintf("+subtree%d", opts.Subtree)
+	}
+	if be == oram2pc.BackendSingle && opts.Direct {
+		r.Backend += "+direct"
+	}
+	opts.Backend = be
+
+	c := oram2pc.InitClient(N, Z)
+	err = c.AddServerWith("bench", N, Z, opts)
+	if err != nil {
+		return r, err
+	}
+	defer c.RemoveServer("bench")
+	sm := &stash_metrics{}
+	c.SetMetrics(sm)
+
+	io_start := c.ServerIO("bench")
+	lat := make([]time.Duration, len(w))
+	r.StashHist = make(map[int]int)
+
+	// only the accesses are timed, the stash is sampled in between
+	var elapsed time.Duration
+	for i, o := range w {
+		t := time.Now()
+		_, err := c.Access("bench", o.write, o.addr, o.value)
+		lat[i] = time.Since(t)
+		elapsed += lat[i]
+		if err != nil {
+			return r, err
+		}
+
+		st := int(sm.size.Load())
+		r.StashHist[st] += 1
+		if st > r.StashMax {
+			r.StashMax = st
+		}
+	}
+
+	io_end := c.ServerIO("bench")
+	n := float64(len(w))
+	r.Seconds = elapsed.Seconds()
+	if n > 0 {
+		r.Throughput = n / r.Seconds
+		r.BytesRead = float64(io_end.BytesRead-io_start.BytesRead) / n
+		r.BytesWritten = float64(io_end.BytesWritten-io_start.BytesWritten) / n
+		r.Fsyncs = float64(io_end.Fsyncs-io_start.Fsyncs) / n
+		r.Seeks = float64(io_end.Seeks-io_start.Seeks) / n
+	}
+
+	sort.Slice(lat, func(i, j int) bool { return lat[i] < lat[j] })
+	r.P50 = percentile(lat, 0.50)
+	r.P90 = percentile(lat, 0.90)
+	r.P99 = percentile(lat, 0.99)
+	r.P999 = percentile(lat, 0.999)
+	r.Max = percentile(lat, 1)
+
+	return r, nil
+}
+
+// p-th percentile of sorted latencies, in microseconds
+func percentile(lat []time.Duration, p float64) float64 {
+	if len(lat) == 0 {
+		return 0
+	}
+
+	i := int(p*float64(len(lat))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(lat) {
+		i = len(lat) - 1
+	}
+
+	return float64(lat[i].Nanoseconds()) / 1000
+}
+
+func write_out(path string, f func(io.Writer) error) error {
+	if path == "-" {
+		return f(os.Stdout)
+	}
+
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	err = f(out)
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+func write_json(w io.Writer, results []result) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(results)
+}
+
+// the stash histogram is flattened to "size:count;size:count..."
+func write_csv(w io.Writer, results []result) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"scheme", "backend", "format", "eviction", "n", "z", "b", "workload", "ops", "seconds",
+		"ops_per_sec", "lat_p50_us", "lat_p90_us", "lat_p99_us", "lat_p999_us", "lat_max_us",
+		"bytes_read_per_access", "bytes_written_per_access", "fsyncs_per_access",
+		"seeks_per_access", "stash_max", "stash_hist"})
+
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	for _, r := range results {
+		sizes := make([]int, 0, len(r.StashHist))
+		for s := range r.StashHist {
+			sizes = append(sizes, s)
+		}
+		sort.Ints(sizes)
+		hist := make([]string, len(sizes))
+		for i, s := range sizes {
+			hist[i] = fmt.Sprintf("%d:%d", s, r.StashHist[s])
+		}
+
+		cw.Write([]string{r.Scheme, r.Backend, r.Format, r.Eviction, strconv.Itoa(r.N), strconv.Itoa(r.Z),
+			strconv.Itoa(r.B), r.Workload, strconv.Itoa(r.Ops), f(r.Seconds),
+			f(r.Throughput), f(r.P50), f(r.P90), f(r.P99), f(r.P999), f(r.Max),
+			f(r.BytesRead), f(r.BytesWritten), f(r.Fsyncs), f(r.Seeks),
+			strconv.Itoa(r.StashMax), strings.Join(hist, ";")})
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,588 @@
+/*
+ * oramctl: create, inspect and operate ORAM stores from the command line
+ *
+ * A store is a client state file plus the directory holding the tree. Every
+ * command that accesses the store writes the state file back, since each
+ * access changes the position map and the stash.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	oram2pc "github.com/usipeus/oram-2pc"
+)
+
+const usage = `usage: oramctl <command> [flags] [args]
+
+commands:
+  init                  create a new store
+  get <addr>            read a block, or a record with -record
+  put <addr> <value>    write a block, or a record with -record
+  load <file>           write blocks from a CSV (addr,value) or JSONL file
+  dump                  decrypt and print every block in the store
+  info                  print the store's parameters and occupancy
+  destroy               delete the store and its state file
+  serve                 share the store with many clients through a proxy
+  key status            print the server's key epoch and rotation progress
+  key rotate            move the server to a new key and re-encrypt the tree
+  key export <file>     write the master key to a file
+
+run "oramctl <command> -h" for the flags of a command
+`
+
+// flags every command takes
+type common struct {
+	state  *string
+	server *string
+	key    *string
+}
+
+func new_flags(cmd string) (*flag.FlagSet, common) {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	var cf common
+	cf.state = fs.String("state", "oram.state", "client state file")
+	cf.server = fs.String("server", "main", "name of the server in the state file")
+	cf.key = fs.String("key-file", "", "master key file, for a state file that doesn't hold it")
+	return fs, cf
+}
+
+// loads the state file, and the master key if it's kept apart
+func load_client(cf common) (*oram2pc.Client, error) {
+	c, err := oram2pc.LoadClient(*cf.state)
+	if err != nil {
+		return nil, err
+	}
+	if *cf.key == "" {
+		return c, nil
+	}
+
+	data, err := os.ReadFile(*cf.key)
+	if err != nil {
+		return nil, err
+	}
+	master, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("bad key file %s", *cf.key)
+	}
+	err = c.ImportMasterKey(master)
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	cmds := map[string]func([]string) error{
+		"init":    cmd_init,
+		"get":     cmd_get,
+		"put":     cmd_put,
+		"load":    cmd_load,
+		"dump":    cmd_dump,
+		"info":    cmd_info,
+		"destroy": cmd_destroy,
+		"serve":   cmd_serve,
+		"key":     cmd_key,
+	}
+
+	f, ok := cmds[os.Args[1]]
+	if !ok {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	err := f(os.Args[2:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "oramctl:", err)
+		os.Exit(1)
+	}
+}
+
+// parses a block value, decimal or 0x-prefixed hex
+func parse_value(s string) (uint64, error) {
+	return strconv.ParseUint(strings.TrimSpace(s), 0, 64)
+}
+
+func parse_addr(s string) (int, error) {
+	a, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("bad address %q", s)
+	}
+
+	return a, nil
+}
+
+func cmd_init(args []string) error {
+	fs, cf := new_flags("init")
+	N := fs.Int("N", 1024, "number of blocks")
+	Z := fs.Int("Z", 4, "blocks per bucket")
+	B := fs.Int("B", 32, "block size in bytes (only 32 is supported)")
+	S := fs.Int("S", 0, "stash size in blocks (0 for the default)")
+	fsize := fs.Int("fsize", 4096, "size of each file in the tree (files backend)")
+	backend := fs.String("backend", "files", "storage backend: files or single")
+	direct := fs.Bool("direct", false, "open the single file backend with O_DIRECT")
+	subtree := fs.Int("subtree", 0, "levels per subtree in the single file backend (0 for heap order)")
+	leaves := fs.Int("leaves", 0, "leaves of the tree (0 for the power of two at or above N), Z is scaled up for fewer than N")
+	format := fs.String("format", "blocks", "bucket format: blocks (a nonce per block) or compact (one AES-GCM seal per bucket)")
+	eviction := fs.String("eviction", "per-access", "when paths are written back: per-access, every:<k> or above:<stash blocks>")
+	write_only := fs.Bool("write-only", false, "only hide writes, reads go straight to the block (no eviction policy)")
+	dir := fs.String("dir", "", "directory for the tree (default: <state>.d)")
+	fs.Parse(args)
+
+	if *B != 32 {
+		return errors.New("only 32-byte blocks are supported")
+	}
+	if _, err := os.Stat(*cf.state); err == nil {
+		return fmt.Errorf("%s already exists", *cf.state)
+	}
+	if *dir == "" {
+		*dir = *cf.state + ".d"
+	}
+	abs, err := filepath.Abs(*dir)
+	if err != nil {
+		return err
+	}
+
+	be, err := oram2pc.ParseBackend(*backend)
+	if err != nil {
+		return fmt.Errorf("unknown backend %q", *backend)
+	}
+	bf, err := oram2pc.ParseBucketFormat(*format)
+	if err != nil {
+		return fmt.Errorf("unknown bucket format %q", *format)
+	}
+	policy, err := oram2pc.ParseEviction(*eviction)
+	if err != nil {
+		return fmt.Errorf("unknown eviction policy %q", *eviction)
+	}
+	if *write_only {
+		policy = nil
+	}
+
+	*Z = oram2pc.SparseZ(*N, *leaves, *Z)
+	c := oram2pc.InitClient(*N, *Z)
+	if *S > 0 {
+		c.S = *S
+	}
+
+	err = c.AddServerWith(*cf.server, *N, *Z, oram2pc.ServerOptions{Backend: be, Direct: *direct, Subtree: *subtree, Leaves: *leaves, Format: bf, Fsize: *fsize, Dir: abs, Eviction: policy, WriteOnly: *write_only})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	return c.Save(*cf.state)
+}
+
+// runs f on the store and saves the state afterwards, even if f failed
+func with_client(cf common, f func(*oram2pc.Client) error) error {
+	c, err := load_client(cf)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	err = f(c)
+	if _, key_err := c.ExportMasterKey(); key_err != nil {
+		// still locked, so nothing changed and there's nothing to save
+		return err
+	}
+	save_err := c.Save(*cf.state)
+	if err != nil {
+		return err
+	}
+
+	return save_err
+}
+
+// -proxy flag of the commands that can go through a running proxy
+func proxy_flag(fs *flag.FlagSet) *string {
+	return fs.String("proxy", "", "go through the proxy serving the store on this unix socket")
+}
+
+// -record flag of get and put: the value is a string of up to n bytes in
+// the blocks from addr on
+func record_flag(fs *flag.FlagSet) *int {
+	return fs.Int("record", 0, "read or write a string of up to this many bytes instead of a block")
+}
+
+// one access through a proxy instead of opening the store
+func proxy_access(sock string, write bool, a int, v uint64) (uint64, error) {
+	pc, err := oram2pc.DialProxy("unix", sock)
+	if err != nil {
+		return 0, err
+	}
+	defer pc.Close()
+
+	return pc.Access(write, a, v)
+}
+
+func cmd_get(args []string) error {
+	fs, cf := new_flags("get")
+	proxy := proxy_flag(fs)
+	record := record_flag(fs)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: oramctl get <addr>")
+	}
+	a, err := parse_addr(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if *record > 0 {
+		if *proxy != "" {
+			return errors.New("records can't go through a proxy")
+		}
+		return with_client(cf, func(c *oram2pc.Client) error {
+			v, err := c.AccessRecord(*cf.server, false, a, *record, nil)
+			if err != nil {
+				return err
+			}
+
+			fmt.Println(string(v))
+			return nil
+		})
+	}
+
+	if *proxy != "" {
+		v, err := proxy_access(*proxy, false, a, 0)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(v)
+		return nil
+	}
+
+	return with_client(cf, func(c *oram2pc.Client) error {
+		v, err := c.Access(*cf.server, false, a, 0)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(v)
+		return nil
+	})
+}
+
+func cmd_put(args []string) error {
+	fs, cf := new_flags("put")
+	proxy := proxy_flag(fs)
+	record := record_flag(fs)
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return errors.New("usage: oramctl put <addr> <value>")
+	}
+	a, err := parse_addr(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if *record > 0 {
+		if *proxy != "" {
+			return errors.New("records can't go through a proxy")
+		}
+		return with_client(cf, func(c *oram2pc.Client) error {
+			_, err := c.AccessRecord(*cf.server, true, a, *record, []byte(fs.Arg(1)))
+			return err
+		})
+	}
+	v, err := parse_value(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	if *proxy != "" {
+		_, err := proxy_access(*proxy, true, a, v)
+		return err
+	}
+
+	return with_client(cf, func(c *oram2pc.Client) error {
+		_, err := c.Access(*cf.server, true, a, v)
+		return err
+	})
+}
+
+// serves the store to app clients until interrupted, then saves it
+func cmd_serve(args []string) error {
+	fs, cf := new_flags("serve")
+	network := fs.String("net", "unix", "network to listen on: unix or tcp")
+	listen := fs.String("listen", "oram.sock", "socket path, or host:port for tcp")
+	fs.Parse(args)
+
+	return with_client(cf, func(c *oram2pc.Client) error {
+		p, err := oram2pc.NewProxy(c, *cf.server)
+		if err != nil {
+			return err
+		}
+		defer p.Close()
+
+		l, err := net.Listen(*network, *listen)
+		if err != nil {
+			return err
+		}
+
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-sig
+			p.Close()
+		}()
+
+		fmt.Fprintln(os.Stderr, "oramctl: serving", *cf.server, "on", l.Addr())
+		return p.Serve(l)
+	})
+}
+
+type record struct {
+	Addr  int    `json:"addr"`
+	Value uint64 `json:"value"`
+}
+
+// reads addr,value lines, skipping a header line if there is one
+func read_csv(r io.Reader) ([]record, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	recs := make([]record, 0, len(rows))
+	for i, row := range rows {
+		if len(row) != 2 {
+			return nil, fmt.Errorf("line %d: want 2 fields, got %d", i+1, len(row))
+		}
+
+		a, err := parse_addr(row[0])
+		if err != nil && i == 0 {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		v, err := parse_value(row[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+
+		recs = append(recs, record{Addr: a, Value: v})
+	}
+
+	return recs, nil
+}
+
+// reads one {"addr": ..., "value": ...} object per line
+func read_jsonl(r io.Reader) ([]record, error) {
+	recs := []record{}
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		if strings.TrimSpace(sc.Text()) == "" {
+			continue
+		}
+
+		var rec record
+		err := json.Unmarshal(sc.Bytes(), &rec)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		recs = append(recs, rec)
+	}
+
+	return recs, sc.Err()
+}
+
+func cmd_load(args []string) error {
+	fs, cf := new_flags("load")
+	format := fs.String("format", "", "csv or jsonl (default: from the file extension)")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: oramctl load <file>")
+	}
+
+	path := fs.Arg(0)
+	if *format == "" {
+		*format = strings.TrimPrefix(filepath.Ext(path), ".")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var recs []record
+	switch *format {
+	case "csv":
+		recs, err = read_csv(f)
+	case "jsonl", "json":
+		recs, err = read_jsonl(f)
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	if err != nil {
+		return err
+	}
+
+	return with_client(cf, func(c *oram2pc.Client) error {
+		for _, rec := range recs {
+			_, err := c.Access(*cf.server, true, rec.Addr, rec.Value)
+			if err != nil {
+				return fmt.Errorf("addr %d: %v", rec.Addr, err)
+			}
+		}
+		return nil
+	})
+}
+
+func cmd_dump(args []string) error {
+	fs, cf := new_flags("dump")
+	fs.Parse(args)
+
+	c, err := load_client(cf)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	vals, err := c.Dump(*cf.server)
+	if err != nil {
+		return err
+	}
+
+	addrs := make([]int, 0, len(vals))
+	for a := range vals {
+		addrs = append(addrs, a)
+	}
+	sort.Ints(addrs)
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	for _, a := range addrs {
+		fmt.Fprintf(w, "%d,%d\n", a, vals[a])
+	}
+
+	return nil
+}
+
+func cmd_info(args []string) error {
+	fs, cf := new_flags("info")
+	fs.Parse(args)
+
+	c, err := load_client(cf)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	info := c.ServerInfo(*cf.server)
+	if info == "" {
+		return fmt.Errorf("no server %q in %s", *cf.server, *cf.state)
+	}
+
+	st, err := c.Stats(*cf.server)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(info)
+	fmt.Println("\tL:", st.L)
+	fmt.Println("\tleaves:", st.Leaves)
+	fmt.Println("\tbuckets:", st.Buckets, "of", st.BucketSize, "bytes")
+	fmt.Println("\tblocks in tree:", st.TreeBlocks)
+	fmt.Printf("\tstash: %d/%d blocks\n", st.StashBlocks, st.StashCapacity)
+
+	return nil
+}
+
+func cmd_destroy(args []string) error {
+	fs, cf := new_flags("destroy")
+	fs.Parse(args)
+
+	c, err := load_client(cf)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	err = c.RemoveServer(*cf.server)
+	if err != nil {
+		return err
+	}
+
+	// the other servers keep their state
+	if len(c.Servers()) > 0 {
+		return c.Save(*cf.state)
+	}
+
+	return os.Remove(*cf.state)
+}
+
+func cmd_key(args []string) error {
+	if len(args) < 1 {
+		return errors.New("usage: oramctl key status|rotate|export <file>")
+	}
+	fs, cf := new_flags("key " + args[0])
+	detach := fs.Bool("detach", false, "export: leave the key out of the state file from now on")
+	fs.Parse(args[1:])
+
+	return with_client(cf, func(c *oram2pc.Client) error {
+		switch args[0] {
+		case "status":
+			st, err := c.KeyStatus(*cf.server)
+			if err != nil {
+				return err
+			}
+			fmt.Println("epoch:", st.Epoch)
+			fmt.Println("buckets under the last key:", st.Pending)
+			return nil
+
+		case "rotate":
+			err := c.RotateKey(*cf.server)
+			if err != nil {
+				return err
+			}
+			return c.FinishRotation(*cf.server)
+
+		case "export":
+			if fs.NArg() != 1 {
+				return errors.New("usage: oramctl key export [-detach] <file>")
+			}
+			master, err := c.ExportMasterKey()
+			if err != nil {
+				return err
+			}
+			err = os.WriteFile(fs.Arg(0), []byte(hex.EncodeToString(master)+"\n"), 0600)
+			if err != nil {
+				return err
+			}
+			if *detach {
+				c.DetachMasterKey(true)
+			}
+			return nil
+		}
+
+		return fmt.Errorf("unknown key command %q", args[0])
+	})
+}
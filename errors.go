@@ -0,0 +1,51 @@
+/*
+ * Errors returned by the library
+ *
+ * Errors from the tree, the crypto and the stash wrap one of these so
+ * callers can tell them apart with errors.Is, while keeping the cause.
+ */
+
+package oram2pc
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// reading or writing a server's storage failed (disk full, I/O error...)
+	ErrStorage = errors.New("Storage error")
+
+	// a ciphertext, bucket or message is malformed or was tampered with
+	ErrIntegrity = errors.New("Integrity error")
+
+	// a block, leaf or node that doesn't exist was asked for
+	ErrOutOfRange = errors.New("Out of range")
+
+	// the stash has no room for the blocks of an access
+	ErrStashOverflow = errors.New("Stash overflow")
+
+	// the proxy was closed before it could serve a request
+	ErrProxyClosed = errors.New("Proxy closed")
+
+	// the client was loaded without its master key, see ImportMasterKey
+	ErrNoKey = errors.New("No master key")
+
+	// there's no object, file or key by that name
+	ErrNotFound = errors.New("Not found")
+
+	// a write-only server was asked for something only a full ORAM does
+	ErrWriteOnly = errors.New("Write-only server")
+)
+
+func storage_err(op string, err error) error {
+	return fmt.Errorf("%w: %s: %w", ErrStorage, op, err)
+}
+
+func integrity_err(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrIntegrity, fmt.Sprintf(format, args...))
+}
+
+func range_err(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrOutOfRange, fmt.Sprintf(format, args...))
+}
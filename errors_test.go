@@ -0,0 +1,198 @@
+package oram2pc
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+func Test_errors_out_of_range(t *testing.T) {
+	c := InitClient(16, 4)
+	err := c.AddServer("test", 16, 4, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.RemoveServer("test")
+	s := c.servers["test"]
+
+	_, err = c.Access("test", false, 16, 0)
+	if !errors.Is(err, ErrOutOfRange) {
+		t.Errorf("access to block 16: got %v", err)
+	}
+	_, err = s.read_node(s.L+1, 0)
+	if !errors.Is(err, ErrOutOfRange) {
+		t.Errorf("reading below the leaves: got %v", err)
+	}
+	err = s.write_node(make_bucket(nil, 4, c.keys["test"].cur), 1, 2)
+	if !errors.Is(err, ErrOutOfRange) {
+		t.Errorf("writing node 2 of level 1: got %v", err)
+	}
+
+	// ids and leaves are 32 bits, and an id of all ones is the dummy block
+	err = c.AddServer("big", max_blocks, 4, 4096)
+	if !errors.Is(err, ErrOutOfRange) {
+		t.Errorf("server of 2^32-1 blocks: got %v", err)
+	}
+	err = c.AddServerWith("wide", 16, 4, ServerOptions{Leaves: max_leaves + 1})
+	if !errors.Is(err, ErrOutOfRange) {
+		t.Errorf("server of 2^32+1 leaves: got %v", err)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("client of 2^32-1 blocks")
+			}
+		}()
+		InitClient(max_blocks, 4)
+	}()
+}
+
+// checks that a client's stash and position map are what they were
+func same_state(t *testing.T, c *Client, name string, blks []Block, pos map[int]int) {
+	t.Helper()
+	for i := range blks {
+		if !bytes.Equal(blks[i], c.stash[name].blks[i]) {
+			t.Fatal("stash changed by a failed access")
+		}
+	}
+	for a, x := range pos {
+		if c.pos[name][a] != x || len(c.pos[name]) != len(pos) {
+			t.Fatal("position map changed by a failed access")
+		}
+	}
+}
+
+func copy_pos(c *Client, name string) map[int]int {
+	pos := make(map[int]int)
+	for a, x := range c.pos[name] {
+		pos[a] = x
+	}
+
+	return pos
+}
+
+func Test_errors_read_failure(t *testing.T) {
+	c := InitClient(16, 4)
+	err := c.AddServer("test", 16, 4, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.RemoveServer("test")
+	s := c.servers["test"]
+
+	for a := 0; a < 16; a++ {
+		c.Access("test", true, a, uint64(a)+100)
+	}
+
+	blks, pos := c.stash["test"].snapshot(), copy_pos(c, "test")
+	dir := s.dir
+	s.dir = dir + ".missing"
+	_, err = c.Access("test", true, 3, 7)
+	if !errors.Is(err, ErrStorage) || !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("access with the tree gone: got %v", err)
+	}
+	same_state(t, c, "test", blks, pos)
+
+	s.dir = dir
+	for a := 0; a < 16; a++ {
+		v, err := c.Access("test", false, a, 0)
+		if err != nil || v != uint64(a)+100 {
+			t.Errorf("block %d: got %d, %v", a, v, err)
+		}
+	}
+}
+
+func Test_errors_write_failure(t *testing.T) {
+	c := InitClient(16, 4)
+	err := c.AddServer("test", 16, 4, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.RemoveServer("test")
+	s := c.servers["test"]
+
+	for a := 0; a < 16; a++ {
+		c.Access("test", true, a, uint64(a)+100)
+	}
+
+	// the tree goes away after the path is read, as if the disk failed
+	dir := s.dir
+	x := c.pos["test"][5]
+	err = c.access_path("test", x, func(st *stash) error {
+		s.dir = dir + ".missing"
+		leaf := gen_int(1 << uint(c.L))
+		_, err := st.access(5, true, 55, leaf)
+		c.pos["test"][5] = leaf
+		return err
+	})
+	if !errors.Is(err, ErrStorage) {
+		t.Fatalf("write back with the tree gone: got %v", err)
+	}
+	if _, prs := c.dirty["test"]; !prs {
+		t.Fatal("failed path was not marked dirty")
+	}
+
+	// the next access fails too until the disk is back
+	_, err = c.Access("test", false, 0, 0)
+	if !errors.Is(err, ErrStorage) {
+		t.Errorf("access with a dirty path and no disk: got %v", err)
+	}
+
+	s.dir = dir
+	for a := 0; a < 16; a++ {
+		want := uint64(a) + 100
+		if a == 5 {
+			want = 55
+		}
+		v, err := c.Access("test", false, a, 0)
+		if err != nil || v != want {
+			t.Errorf("block %d: got %d, want %d (%v)", a, v, want, err)
+		}
+	}
+	if _, prs := c.dirty["test"]; prs {
+		t.Error("path still dirty after a successful access")
+	}
+
+	st, err := c.Stats("test")
+	if err != nil || st.TreeBlocks+st.StashBlocks != 16 {
+		t.Errorf("blocks were lost or duplicated: %+v, %v", st, err)
+	}
+}
+
+func Test_errors_stash_overflow(t *testing.T) {
+	c := InitClient(64, 1)
+	c.S = 0
+	err := c.AddServer("test", 64, 1, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.RemoveServer("test")
+
+	for a := 0; a < 64; a++ {
+		blks, pos := c.stash["test"].snapshot(), copy_pos(c, "test")
+		_, err := c.Access("test", true, a, uint64(a))
+		if errors.Is(err, ErrStashOverflow) {
+			same_state(t, c, "test", blks, pos)
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Error("a stash with no room beyond one path never overflowed")
+}
+
+func Test_errors_integrity(t *testing.T) {
+	key := make([]byte, 16)
+	_, err := dec_block(Block(make([]byte, 31)), key)
+	if !errors.Is(err, ErrIntegrity) {
+		t.Errorf("decrypting 31 bytes: got %v", err)
+	}
+
+	_, err = xor_bytes(make([]byte, 2), make([]byte, 3))
+	if !errors.Is(err, ErrIntegrity) {
+		t.Errorf("xor of different lengths: got %v", err)
+	}
+}
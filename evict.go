@@ -0,0 +1,359 @@
+/*
+ * Eviction policies
+ *
+ * Path ORAM writes back the path of every access. A policy can instead
+ * leave the blocks of the paths it reads in the stash and evict later,
+ * along paths taken in reverse lexicographic order (as in Ring ORAM) so
+ * evictions spread evenly over the tree:
+ *
+ *   EvictPerAccess()  every access writes its path back (the default)
+ *   EvictEvery(k)     accesses only read, and every k-th is followed by an
+ *                     eviction
+ *   EvictAbove(t)     accesses only read, and once the stash holds more
+ *                     than t blocks, evictions run in the background until
+ *                     it's back under t
+ *
+ * An eviction reads the buckets of its path that aren't in the stash and
+ * writes the whole path back, just like an access that touches no block.
+ *
+ * Buckets whose blocks were read into the stash and haven't been written
+ * back since are stale on the server, so they're remembered and not read
+ * again. Which buckets those are follows from the leaves the server has
+ * already seen, it says nothing more about the blocks accessed.
+ *
+ * With a delayed policy an access isn't logged, so a write is only durable
+ * once an eviction or a Save after it.
+ */
+
+package oram2pc
+
+import (
+	"errors"
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how a server's paths are written back, see the top of this file
+type Eviction interface {
+	String() string
+
+	// whether an access writes its own path back
+	writes_back() bool
+
+	// whether an eviction is due after this many accesses since the last
+	// one, with this many real blocks in the stash
+	due(accesses int, stash int) bool
+
+	// whether evictions run in the background
+	background() bool
+
+	// blocks the stash needs on top of the client's S
+	stash_room(L int, Z int) int
+}
+
+type evict_per_access struct{}
+
+func EvictPerAccess() Eviction {
+	return evict_per_access{}
+}
+
+func (evict_per_access) String() string          { return "per-access" }
+func (evict_per_access) writes_back() bool       { return true }
+func (evict_per_access) due(int, int) bool       { return false }
+func (evict_per_access) background() bool        { return false }
+func (evict_per_access) stash_room(L, Z int) int { return (L + 1) * Z }
+
+type evict_every struct {
+	k int
+}
+
+// an eviction after every k accesses, k < 1 counts as 1
+func EvictEvery(k int) Eviction {
+	return evict_every{max(k, 1)}
+}
+
+func (e evict_every) String() string               { return "every:" + strconv.Itoa(e.k) }
+func (evict_every) writes_back() bool              { return false }
+func (e evict_every) due(accesses int, _ int) bool { return accesses >= e.k }
+func (evict_every) background() bool               { return false }
+func (e evict_every) stash_room(L int, Z int) int  { return (e.k + 1) * (L + 1) * Z }
+
+type evict_above struct {
+	threshold int
+}
+
+// background evictions whenever the stash holds more than threshold blocks
+func EvictAbove(threshold int) Eviction {
+	return evict_above{max(threshold, 0)}
+}
+
+func (e evict_above) String() string              { return "above:" + strconv.Itoa(e.threshold) }
+func (evict_above) writes_back() bool             { return false }
+func (e evict_above) due(_ int, stash int) bool   { return stash > e.threshold }
+func (evict_above) background() bool              { return true }
+func (e evict_above) stash_room(L int, Z int) int { return e.threshold + 2*(L+1)*Z }
+
+// parses what Eviction.String returns: per-access, every:<k> or above:<t>
+func ParseEviction(s string) (Eviction, error) {
+	kind, arg, _ := strings.Cut(s, ":")
+	if kind == "per-access" && arg == "" {
+		return EvictPerAccess(), nil
+	}
+
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 0 {
+		return nil, errors.New("Unknown eviction policy!")
+	}
+	switch kind {
+	case "every":
+		return EvictEvery(n), nil
+	case "above":
+		return EvictAbove(n), nil
+	}
+
+	return nil, errors.New("Unknown eviction policy!")
+}
+
+// evictions most a background run does, in case the stash can't get under
+// the threshold
+func max_passes(s *Server) int {
+	return 4 * (s.L + 1)
+}
+
+// eviction state of one server
+type evict_state struct {
+	policy   Eviction
+	accesses int           // since the last eviction
+	g        uint64        // evictions so far, picks the next path
+	fetched  map[node]bool // buckets whose blocks are in the stash
+
+	bg   chan bg_result // the running background work, nil if none
+	stop chan struct{}  // closed to stop it
+}
+
+// how a background run ended
+type bg_result struct {
+	pos map[int]int // position map changes that didn't make it to the log
+	wb  *path_write // the write back that failed
+	err error
+}
+
+func new_evict_state(p Eviction) *evict_state {
+	if p == nil {
+		p = EvictPerAccess()
+	}
+
+	return &evict_state{policy: p, fetched: make(map[node]bool)}
+}
+
+// the next eviction path: the counter with its L bits reversed, skipping
+// leaves past the tree's last
+func (e *evict_state) next_leaf(s *Server) int {
+	for {
+		x := int(bits.Reverse64(e.g) >> uint(64-s.L))
+		e.g += 1
+
+		if x < s.leaves {
+			return x
+		}
+	}
+}
+
+// the blocks of every bucket on path are in the stash
+func (e *evict_state) fetch(path []int) {
+	for l, n := range path {
+		e.fetched[node{l, n}] = true
+	}
+}
+
+// the buckets on path are up to date on the server
+func (e *evict_state) release(path []int) {
+	for l, n := range path {
+		delete(e.fetched, node{l, n})
+	}
+}
+
+// fetched buckets as they're saved, heap numbered, leaving out path
+func (e *evict_state) fetched_ids(path []int) []int {
+	ids := make([]int, 0, len(e.fetched))
+	for nd := range e.fetched {
+		if nd.l >= len(path) || path[nd.l] != nd.n {
+			ids = append(ids, heap_id(nd))
+		}
+	}
+
+	return ids
+}
+
+func (e *evict_state) set_fetched(ids []int) {
+	e.fetched = make(map[node]bool)
+	for _, id := range ids {
+		e.fetched[id_node(id)] = true
+	}
+}
+
+/*
+ * Sets the eviction policy of a server, growing its stash if the policy
+ * needs more room. Buckets already read stay in the stash until a path
+ * through them is written back.
+ */
+func (c *Client) SetEviction(name string, p Eviction) error {
+	s, prs := c.servers[name]
+	if prs == false {
+		return errors.New("No server exists by that name!")
+	}
+	if _, prs := c.wo[name]; prs == true {
+		return ErrWriteOnly
+	}
+	c.settle(name)
+
+	e := c.evict[name]
+	if p == nil {
+		p = EvictPerAccess()
+	}
+	e.policy = p
+	e.accesses = 0
+	c.stash[name].grow(c.S + p.stash_room(s.L, s.Z))
+
+	return nil
+}
+
+func (c *Client) GetEviction(name string) Eviction {
+	e, prs := c.evict[name]
+	if prs == false {
+		return nil
+	}
+
+	return e.policy
+}
+
+/*
+ * Runs the evictions the policy wants after an access, then lets a key
+ * rotation go on in the background
+ */
+func (c *Client) schedule_evictions(name string) error {
+	e := c.evict[name]
+	st := c.stash[name]
+	if e.policy.due(e.accesses, st.size()) {
+		e.accesses = 0
+		if e.policy.background() {
+			c.background(name, true)
+			return nil
+		}
+
+		pos := c.take_pos_delta(name)
+		wb, err := c.evict_pass(name, e.next_leaf(c.servers[name]), pos)
+		err = c.settle_write(name, pos, wb, err)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.background(name, false)
+	return nil
+}
+
+/*
+ * Reads the buckets of the path to leaf x that aren't in the stash and
+ * writes the whole path back
+ *
+ * Only touches state of this server, so it can run in the background. On
+ * failure the stash gets its blocks back, the rest is up to settle_write.
+ */
+func (c *Client) evict_pass(name string, x int, pos map[int]int) (*path_write, error) {
+	s := c.servers[name]
+	e := c.evict[name]
+
+	var m AccessMetrics
+	blks, err := c.read_path(name, x, 0, &m)
+	if err != nil {
+		return nil, err
+	}
+	err = c.apply_path(name, blks, func(*stash) error { return nil }, &m)
+	if err != nil {
+		return nil, err
+	}
+	path, _ := s.get_path(x)
+	e.fetch(path)
+
+	start := time.Now()
+	wb, err := c.evict_path(name, x, pos)
+	if err != nil {
+		return nil, err
+	}
+	io_start := s.io_stats()
+	err = wb.run()
+	if err != nil {
+		c.stash[name].restore(wb.saved)
+		return wb, err
+	}
+	e.release(path)
+	c.keys[name].written(wb.nodes)
+
+	m.Write = time.Since(start)
+	m.BytesWritten = s.io_stats().BytesWritten - io_start.BytesWritten
+	m.Evicted = wb.evicted
+	c.observe_access(name, m)
+
+	return wb, nil
+}
+
+/*
+ * Works on a server in a goroutine: if evict, evictions until the policy is
+ * satisfied, then the sweep of a key rotation (see keys.go) until it's done
+ * or stopped. The goroutine owns the server's stash, keys and eviction
+ * state until settle is called, which everything that touches them does
+ * first.
+ */
+func (c *Client) background(name string, evict bool) {
+	s := c.servers[name]
+	e := c.evict[name]
+	st := c.stash[name]
+	if e.bg != nil || c.master == nil || (evict == false && c.keys[name].fresh == nil) {
+		return
+	}
+	var pos map[int]int
+	if evict {
+		pos = c.take_pos_delta(name)
+	}
+
+	done := make(chan bg_result, 1)
+	stop := make(chan struct{})
+	e.bg, e.stop = done, stop
+	go func() {
+		r := bg_result{pos: pos}
+		for n := 0; evict && n < max_passes(s) && e.policy.due(0, st.size()); n++ {
+			r.wb, r.err = c.evict_pass(name, e.next_leaf(s), r.pos)
+			if r.err != nil {
+				break
+			}
+			r.pos = nil
+		}
+		if r.err == nil {
+			r.err = c.sweep(name, stop)
+		}
+
+		done <- r
+	}()
+}
+
+// stops the background work on a server and waits for it, if any is running
+func (c *Client) settle(name string) {
+	e, prs := c.evict[name]
+	if prs == false || e.bg == nil {
+		return
+	}
+
+	close(e.stop)
+	r := <-e.bg
+	e.bg, e.stop = nil, nil
+	c.settle_write(name, r.pos, r.wb, r.err)
+}
+
+func (c *Client) settle_all() {
+	for name := range c.evict {
+		c.settle(name)
+	}
+}
@@ -0,0 +1,270 @@
+package oram2pc
+
+import (
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+var test_policies = []Eviction{EvictPerAccess(), EvictEvery(1), EvictEvery(4), EvictAbove(24)}
+
+func Test_evict_policies(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, p := range test_policies {
+		N := 64
+		c := InitClient(N, 4)
+		err := c.AddServerWith("test", N, 4, ServerOptions{Dir: filepath.Join(t.TempDir(), "tree"), Eviction: p})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		model := make(map[int]uint64)
+		for i := 0; i < 400; i++ {
+			a := rng.Intn(N)
+			write := rng.Intn(2) == 0
+			v, err := c.Access("test", write, a, uint64(i))
+			if err != nil {
+				t.Fatalf("%v: access %d: %v", p, i, err)
+			}
+			if v != model[a] && !write {
+				t.Fatalf("%v: access %d to block %d: got %d, want %d", p, i, a, v, model[a])
+			}
+			if write {
+				model[a] = uint64(i)
+			}
+		}
+
+		dump, err := c.Dump("test")
+		if err != nil || len(dump) != len(model) {
+			t.Errorf("%v: dump of %d blocks for %d (%v)", p, len(dump), len(model), err)
+		}
+		for a, v := range model {
+			if dump[a] != v {
+				t.Errorf("%v: dump of block %d: got %d, want %d", p, a, dump[a], v)
+			}
+		}
+		st, err := c.Stats("test")
+		if err != nil || st.TreeBlocks+st.StashBlocks != len(model) {
+			t.Errorf("%v: stats %+v for %d blocks (%v)", p, st, len(model), err)
+		}
+		if q := c.GetEviction("test"); q != p {
+			t.Errorf("%v: policy came back as %v", p, q)
+		}
+		c.RemoveServer("test")
+	}
+}
+
+// with every:4 a path is written once per four accesses, and buckets
+// already in the stash aren't read again
+func Test_evict_io(t *testing.T) {
+	c := InitClient(256, 4)
+	err := c.AddServerWith("test", 256, 4, ServerOptions{Dir: filepath.Join(t.TempDir(), "tree"), Eviction: EvictEvery(4)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.RemoveServer("test")
+
+	start := c.ServerIO("test")
+	for i := 0; i < 100; i++ {
+		_, err := c.Access("test", true, i, uint64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	io := c.ServerIO("test")
+
+	path := int64((c.L + 1) * 4 * 32)
+	written := io.BytesWritten - start.BytesWritten
+	read := io.BytesRead - start.BytesRead
+	if written != 25*path {
+		t.Errorf("wrote %d bytes for 25 evictions of %d byte paths", written, path)
+	}
+	if read >= 125*path {
+		t.Errorf("read %d bytes, at least the root is shared by 125 paths of %d bytes", read, path)
+	}
+}
+
+func Test_evict_next_leaf(t *testing.T) {
+	c := InitClient(8, 4)
+	err := c.AddServerAt("test", 8, 4, 4096, filepath.Join(t.TempDir(), "tree"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.RemoveServer("test")
+
+	e := new_evict_state(nil)
+	s := c.servers["test"]
+	want := []int{0, 4, 2, 6, 1, 5, 3, 7, 0, 4}
+	for i, w := range want {
+		if x := e.next_leaf(s); x != w {
+			t.Errorf("eviction %d: leaf %d, want %d", i, x, w)
+		}
+	}
+
+	// a sparse tree skips leaves it doesn't have
+	s.set_leaves(5)
+	e = new_evict_state(nil)
+	want = []int{0, 4, 2, 1, 3, 0}
+	for i, w := range want {
+		if x := e.next_leaf(s); x != w {
+			t.Errorf("sparse eviction %d: leaf %d, want %d", i, x, w)
+		}
+	}
+}
+
+func Test_evict_parse(t *testing.T) {
+	for _, p := range test_policies {
+		q, err := ParseEviction(p.String())
+		if err != nil || q != p {
+			t.Errorf("%v parsed as %v (%v)", p, q, err)
+		}
+	}
+
+	for _, s := range []string{"", "every", "every:", "every:x", "above:-1", "per-access:1", "lazy:3"} {
+		_, err := ParseEviction(s)
+		if err == nil {
+			t.Errorf("parsed %q", s)
+		}
+	}
+}
+
+func Test_evict_set(t *testing.T) {
+	c := InitClient(32, 4)
+	err := c.AddServerAt("test", 32, 4, 4096, filepath.Join(t.TempDir(), "tree"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.RemoveServer("test")
+
+	// switching policies with blocks left in the stash loses nothing
+	for i, p := range []Eviction{EvictEvery(8), EvictAbove(10), EvictPerAccess(), EvictEvery(3)} {
+		err = c.SetEviction("test", p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for a := 0; a < 32; a++ {
+			c.Access("test", true, a, uint64(a+i*100))
+		}
+	}
+	for a := 0; a < 32; a++ {
+		v, err := c.Access("test", false, a, 0)
+		if err != nil || v != uint64(a+300) {
+			t.Errorf("block %d: got %d (%v)", a, v, err)
+		}
+	}
+
+	if c.SetEviction("nope", nil) == nil {
+		t.Error("set the policy of a missing server")
+	}
+}
+
+func Test_evict_persist(t *testing.T) {
+	for _, p := range test_policies[1:] {
+		dir := t.TempDir()
+		state := filepath.Join(dir, "state")
+
+		c := InitClient(32, 4)
+		err := c.AddServerWith("test", 32, 4, ServerOptions{Backend: BackendSingle, Dir: filepath.Join(dir, "tree"), Eviction: p})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for a := 0; a < 32; a++ {
+			c.Access("test", true, a, uint64(a*7))
+		}
+		err = c.Save(state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fetched := len(c.evict["test"].fetched)
+		c.Close()
+
+		c2, err := LoadClient(state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c2.GetEviction("test") != p || len(c2.evict["test"].fetched) != fetched {
+			t.Errorf("%v: loaded %v with %d fetched buckets, want %d", p, c2.GetEviction("test"), len(c2.evict["test"].fetched), fetched)
+		}
+		for a := 0; a < 32; a++ {
+			v, err := c2.Access("test", false, a, 0)
+			if err != nil || v != uint64(a*7) {
+				t.Errorf("%v: block %d after load: got %d (%v)", p, a, v, err)
+			}
+		}
+		c2.RemoveServer("test")
+	}
+}
+
+// only evictions are logged, so writes after the last one need a Save
+func Test_evict_wal(t *testing.T) {
+	dir := t.TempDir()
+	state := filepath.Join(dir, "state")
+
+	c := InitClient(32, 4)
+	err := c.AddServerWith("test", 32, 4, ServerOptions{Dir: filepath.Join(dir, "tree"), Eviction: EvictEvery(4)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Save(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for a := 0; a < 30; a++ {
+		_, err := c.Access("test", true, a, uint64(a+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.Close()
+
+	c2, err := LoadClient(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.RemoveServer("test")
+	for a := 0; a < 32; a++ {
+		want := uint64(a + 1)
+		if a >= 28 {
+			want = 0
+		}
+		v, err := c2.Access("test", false, a, 0)
+		if err != nil || v != want {
+			t.Errorf("block %d after replay: got %d, want %d (%v)", a, v, want, err)
+		}
+	}
+}
+
+// run with -race: the background evictions and the accesses between them
+func Test_evict_background(t *testing.T) {
+	c := InitClient(128, 4)
+	err := c.AddServerWith("test", 128, 4, ServerOptions{Dir: filepath.Join(t.TempDir(), "tree"), Eviction: EvictAbove(16)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.RemoveServer("test")
+	rec := &record_metrics{io: make(map[string]int)}
+	c.SetMetrics(rec)
+
+	for a := 0; a < 128; a++ {
+		_, err := c.Access("test", true, a, uint64(a))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// reading the I/O counters doesn't wait for the evictions
+		c.ServerIO("test")
+	}
+	if st := c.StashSize("test"); st > 16+(c.L+1)*4 {
+		t.Errorf("%d blocks left in the stash", st)
+	}
+	if len(rec.accesses) <= 128 {
+		t.Errorf("no evictions in %d observed accesses", len(rec.accesses))
+	}
+
+	for a := 0; a < 128; a++ {
+		v, err := c.Access("test", false, a, 0)
+		if err != nil || v != uint64(a) {
+			t.Errorf("block %d: got %d (%v)", a, v, err)
+		}
+	}
+}
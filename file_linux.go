@@ -0,0 +1,115 @@
+/*
+ * Linux specific file I/O for the single file backend
+ */
+
+package oram2pc
+
+import (
+	"io"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+const o_direct = syscall.O_DIRECT
+
+// the most iovecs one pwritev takes
+const iov_max = 1024
+
+// reserves size bytes for f so writes to the tree never hit a full disk
+func preallocate(f *os.File, size int64) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var ferr error
+	err = rc.Control(func(fd uintptr) {
+		ferr = syscall.Fallocate(int(fd), 0, 0, size)
+	})
+	if err != nil {
+		return err
+	}
+	if ferr == syscall.EOPNOTSUPP {
+		return f.Truncate(size)
+	}
+
+	return ferr
+}
+
+// the pwritev system call, a variable so tests can cut writes short
+var sys_pwritev = func(fd uintptr, iovs []syscall.Iovec, off int64) (int, syscall.Errno) {
+	n, _, errno := syscall.Syscall6(syscall.SYS_PWRITEV, fd,
+		uintptr(unsafe.Pointer(&iovs[0])), uintptr(len(iovs)),
+		uintptr(off), uintptr(off>>32), 0)
+	return int(n), errno
+}
+
+/*
+ * Writes bufs back to back at off, with as few syscalls as possible
+ *
+ * A short write goes on from where it stopped, which has to be a multiple
+ * of align for O_DIRECT (1 without it). One that stops anywhere else is an
+ * error, since going on from there would be an unaligned write.
+ */
+func pwritev(f *os.File, bufs [][]byte, off int64, align int) (int, error) {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	defer runtime.KeepAlive(bufs)
+
+	iovs := make([]syscall.Iovec, 0, len(bufs))
+	for _, b := range bufs {
+		if len(b) == 0 {
+			continue
+		}
+		iov := syscall.Iovec{Base: &b[0]}
+		iov.SetLen(len(b))
+		iovs = append(iovs, iov)
+	}
+
+	total := 0
+	for len(iovs) > 0 {
+		batch := iovs
+		if len(batch) > iov_max {
+			batch = batch[:iov_max]
+		}
+		want := 0
+		for _, iov := range batch {
+			want += int(iov.Len)
+		}
+
+		var n int
+		var errno syscall.Errno
+		err = rc.Control(func(fd uintptr) {
+			n, errno = sys_pwritev(fd, batch, off)
+		})
+		if err != nil {
+			return total, err
+		}
+		if errno != 0 {
+			return total, errno
+		}
+		if n == 0 || (n < want && n%align != 0) {
+			return total + n, io.ErrShortWrite
+		}
+		total += n
+		off += int64(n)
+
+		// drop what was written, cutting into the iovec it stopped in
+		for n > 0 {
+			l := int(iovs[0].Len)
+			if n < l {
+				iovs[0].Base = (*byte)(unsafe.Add(unsafe.Pointer(iovs[0].Base), n))
+				iovs[0].SetLen(l - n)
+				break
+			}
+			iovs = iovs[1:]
+			n -= l
+		}
+	}
+
+	return total, nil
+}
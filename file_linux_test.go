@@ -0,0 +1,90 @@
+package oram2pc
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// writes three pages as three iovecs, with every syscall cut to at most cut bytes
+func short_pwritev(t *testing.T, cut int, align int) ([]byte, []byte, int, error) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	bufs := make([][]byte, 3)
+	want := []byte{}
+	for i := range bufs {
+		bufs[i] = aligned_buf(page_size)
+		for j := range bufs[i] {
+			bufs[i][j] = byte(i*7 + j)
+		}
+		want = append(want, bufs[i]...)
+	}
+
+	real := sys_pwritev
+	defer func() { sys_pwritev = real }()
+	calls := 0
+	sys_pwritev = func(fd uintptr, iovs []syscall.Iovec, off int64) (int, syscall.Errno) {
+		calls++
+		cut_iovs := []syscall.Iovec{}
+		left := cut
+		for _, iov := range iovs {
+			if left == 0 {
+				break
+			}
+			if int(iov.Len) > left {
+				iov.SetLen(left)
+			}
+			left -= int(iov.Len)
+			cut_iovs = append(cut_iovs, iov)
+		}
+		return real(fd, cut_iovs, off)
+	}
+
+	n, err := pwritev(f, bufs, page_size, align)
+	got := make([]byte, len(want))
+	if _, err := f.ReadAt(got, page_size); err != nil && n == len(want) {
+		t.Fatal(err)
+	}
+
+	return want, got, calls, err
+}
+
+func Test_pwritev_short(t *testing.T) {
+	// cut on page boundaries, going on from the iovec it stopped at
+	want, got, calls, err := short_pwritev(t, page_size, page_size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(want, got) == false {
+		t.Fatal("Pages written in several syscalls don't read back!")
+	}
+	if calls != 3 {
+		t.Fatalf("%d syscalls for three single-page writes", calls)
+	}
+
+	// cut inside an iovec, which is fine without O_DIRECT
+	want, got, calls, err = short_pwritev(t, page_size+page_size/2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(want, got) == false {
+		t.Fatal("Pages written from the middle of an iovec don't read back!")
+	}
+	if calls != 2 {
+		t.Fatalf("%d syscalls for two page and a half writes", calls)
+	}
+
+	// but not with it
+	_, _, _, err = short_pwritev(t, page_size+page_size/2, page_size)
+	if errors.Is(err, io.ErrShortWrite) == false {
+		t.Fatalf("Unaligned short write gave %v", err)
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+
+/*
+ * Portable file I/O for the single file backend, without O_DIRECT
+ */
+
+package oram2pc
+
+import "os"
+
+const o_direct = 0
+
+func preallocate(f *os.File, size int64) error {
+	return f.Truncate(size)
+}
+
+// writes bufs back to back at off
+func pwritev(f *os.File, bufs [][]byte, off int64, align int) (int, error) {
+	buf := []byte{}
+	for _, b := range bufs {
+		buf = append(buf, b...)
+	}
+
+	return f.WriteAt(buf, off)
+}
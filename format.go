@@ -0,0 +1,182 @@
+/*
+ * Bucket formats
+ *
+ * FormatBlocks is the original format: every block is encrypted on its own
+ * with encrypt, which doubles it, and a bucket is Z of them back to back
+ *
+ * | r | block xor PRF(r) | ... Z times
+ * <- 128 bits -><- 128 bits ->
+ *
+ * FormatCompact seals the whole bucket at once with AES-GCM, one nonce and
+ * one tag per bucket
+ *
+ * | version | epoch | nonce | Z blocks, encrypted | tag |
+ * <- 8 bits -><- 32 bits -><- 96 bits -><- Z*128 bits -><- 128 bits ->
+ *
+ * which is 33 + 16Z bytes instead of 32Z, half the size for large Z. The
+ * header and the node the bucket belongs to are authenticated along with
+ * the blocks, so a bucket that was tampered with, or moved to another node,
+ * fails to open. The epoch says which key the bucket is under (see keys.go).
+ */
+
+package oram2pc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+)
+
+type BucketFormat int
+
+const (
+	FormatBlocks BucketFormat = iota
+	FormatCompact
+)
+
+var format_names = map[BucketFormat]string{
+	FormatBlocks:  "blocks",
+	FormatCompact: "compact",
+}
+
+func (f BucketFormat) String() string {
+	return format_names[f]
+}
+
+func ParseBucketFormat(name string) (BucketFormat, error) {
+	for f, n := range format_names {
+		if n == name {
+			return f, nil
+		}
+	}
+
+	return 0, errors.New("Unknown bucket format!")
+}
+
+const (
+	compact_version = 1
+	compact_header  = 1 + 4 + 12 // version, epoch and nonce
+	compact_tag     = 16
+)
+
+// bytes a bucket takes on the server
+func (s *Server) bucket_size() int {
+	if s.format == FormatCompact {
+		return compact_header + s.Z*16 + compact_tag
+	}
+
+	return s.Z * s.B
+}
+
+// cuts the bytes of a bucket as read from the server into a Bucket
+func (s *Server) bytes_bucket(b []byte) Bucket {
+	if s.format == FormatCompact {
+		return Bucket{b}
+	}
+
+	return bytes_bucket(b, s.B)
+}
+
+// what's authenticated with a compact bucket: its header and its node
+func compact_ad(header []byte, nd node) []byte {
+	ad := make([]byte, 5+8)
+	copy(ad, header[:5])
+	binary.LittleEndian.PutUint64(ad[5:], uint64(heap_id(nd)))
+
+	return ad
+}
+
+func compact_aead(key []byte) cipher.AEAD {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+
+	return aead
+}
+
+// seals blks, padded with dummy blocks to Z, into the compact bucket for nd
+func seal_compact(blks []Block, Z int, key []byte, epoch int, nd node) []byte {
+	plain := make([]byte, 0, Z*16)
+	for i := 0; i < Z; i++ {
+		if i < len(blks) {
+			plain = append(plain, blks[i]...)
+		} else {
+			plain = append(plain, dummy_block()...)
+		}
+	}
+
+	buf := make([]byte, compact_header, compact_header+len(plain)+compact_tag)
+	buf[0] = compact_version
+	binary.LittleEndian.PutUint32(buf[1:], uint32(epoch))
+	rand.Read(buf[5:compact_header])
+
+	return compact_aead(key).Seal(buf, buf[5:compact_header], plain, compact_ad(buf, nd))
+}
+
+// the key epoch a compact bucket says it's under
+func compact_epoch(buf []byte) (int, error) {
+	if len(buf) < compact_header+compact_tag {
+		return 0, integrity_err("compact bucket of %d bytes", len(buf))
+	}
+	if buf[0] != compact_version {
+		return 0, integrity_err("bucket format version %d", buf[0])
+	}
+
+	return int(binary.LittleEndian.Uint32(buf[1:])), nil
+}
+
+// opens the compact bucket of nd into its blocks
+func open_compact(buf []byte, key []byte, nd node) ([]Block, error) {
+	plain, err := compact_aead(key).Open(nil, buf[5:compact_header], buf[compact_header:], compact_ad(buf, nd))
+	if err != nil || len(plain)%16 != 0 {
+		return nil, integrity_err("bucket of node %d on level %d doesn't open", nd.n, nd.l)
+	}
+
+	blks := make([]Block, len(plain)/16)
+	for i := range blks {
+		blks[i] = Block(plain[i*16 : (i+1)*16])
+	}
+
+	return blks, nil
+}
+
+// encrypts blks, padded with dummy blocks, into the bucket for nd under the current key
+func (c *Client) seal_bucket(name string, nd node, blks []Block) Bucket {
+	s := c.servers[name]
+	k := c.keys[name]
+	if s.format == FormatCompact {
+		return Bucket{seal_compact(blks, s.Z, k.cur, k.epoch, nd)}
+	}
+
+	return make_bucket(blks, s.Z, k.cur)
+}
+
+// decrypts the bucket of nd into its blocks, dummy ones included
+func (c *Client) open_bucket(name string, nd node, b Bucket) ([]Block, error) {
+	s := c.servers[name]
+	k := c.keys[name]
+	if s.format != FormatCompact {
+		return split_bucket(b, k.node_key(nd))
+	}
+
+	buf := bucket_join(b, nil)
+	epoch, err := compact_epoch(buf)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case epoch == k.epoch:
+		return open_compact(buf, k.cur, nd)
+	case epoch == k.epoch-1 && k.fresh != nil:
+		return open_compact(buf, k.old, nd)
+	}
+
+	return nil, integrity_err("bucket under key epoch %d, the client is at %d", epoch, k.epoch)
+}
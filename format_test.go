@@ -0,0 +1,219 @@
+package oram2pc
+
+import (
+	"errors"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func Test_format_compact(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, opts := range []ServerOptions{{}, {Backend: BackendSingle}, {Backend: BackendSingle, Subtree: 3}, {Fsize: 1000}} {
+		N := 64
+		c := InitClient(N, 4)
+		opts.Format = FormatCompact
+		opts.Dir = filepath.Join(t.TempDir(), "tree")
+		err := c.AddServerWith("test", N, 4, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		model := make(map[int]uint64)
+		for i := 0; i < 200; i++ {
+			a := rng.Intn(N)
+			write := rng.Intn(2) == 0
+			if write {
+				model[a] = uint64(i)
+			}
+			v, err := c.Access("test", write, a, uint64(i))
+			if err != nil || v != model[a] {
+				t.Fatalf("%v: access %d to block %d: got %d, want %d (%v)", opts.Backend, i, a, v, model[a], err)
+			}
+		}
+
+		st, err := c.Stats("test")
+		if err != nil || st.BucketSize != 33+16*4 || st.TreeBlocks+st.StashBlocks != len(model) {
+			t.Errorf("%v: stats %+v (%v)", opts.Backend, st, err)
+		}
+		c.RemoveServer("test")
+	}
+}
+
+// a changed, moved or unknown bucket doesn't open
+func Test_format_tamper(t *testing.T) {
+	c := InitClient(16, 4)
+	err := c.AddServerWith("test", 16, 4, ServerOptions{Format: FormatCompact, Dir: filepath.Join(t.TempDir(), "tree")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.RemoveServer("test")
+	s := c.servers["test"]
+	for a := 0; a < 16; a++ {
+		c.Access("test", true, a, uint64(a))
+	}
+	root, _ := s.read_node(0, 0)
+
+	tamper := map[string]func([]byte){
+		"flipped bit": func(b []byte) { b[compact_header+3] ^= 1 },
+		"new version": func(b []byte) { b[0] = 2 },
+		"old epoch":   func(b []byte) { b[1] = 7 },
+		"short":       nil,
+	}
+	for what, f := range tamper {
+		b := bucket_join(root, nil)
+		if f != nil {
+			f(b)
+		} else {
+			b = b[:compact_header]
+		}
+		_, err := c.open_bucket("test", node{0, 0}, Bucket{b})
+		if !errors.Is(err, ErrIntegrity) {
+			t.Errorf("%s: %v", what, err)
+		}
+	}
+
+	// the bucket of another node, written where the root is
+	other, _ := s.read_node(1, 1)
+	err = s.write_node(other, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for a := 0; a < 16; a++ {
+		_, err = c.Access("test", false, a, 0)
+		if err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, ErrIntegrity) {
+		t.Errorf("moved bucket: %v", err)
+	}
+}
+
+// compact buckets say their epoch, so rotation and reloads work as before
+func Test_format_rotate(t *testing.T) {
+	dir := t.TempDir()
+	state := filepath.Join(dir, "state")
+
+	c := InitClient(32, 4)
+	err := c.AddServerWith("test", 32, 4, ServerOptions{Format: FormatCompact, Dir: filepath.Join(dir, "tree")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for a := 0; a < 32; a++ {
+		c.Access("test", true, a, uint64(a))
+	}
+	err = c.Save(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.RotateKey("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for a := 0; a < 32; a += 2 {
+		c.Access("test", true, a, uint64(a+100))
+	}
+	c.Close()
+
+	c2, err := LoadClient(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.RemoveServer("test")
+	if c2.servers["test"].format != FormatCompact {
+		t.Errorf("loaded %v buckets", c2.servers["test"].format)
+	}
+	err = c2.FinishRotation("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for a := 0; a < 32; a++ {
+		want := uint64(a)
+		if a%2 == 0 {
+			want += 100
+		}
+		v, err := c2.Access("test", false, a, 0)
+		if err != nil || v != want {
+			t.Errorf("block %d: got %d, want %d (%v)", a, v, want, err)
+		}
+	}
+}
+
+// the files backend reads and writes what the buckets take, nothing more
+func Test_format_io(t *testing.T) {
+	per_access := map[BucketFormat]int64{}
+	for _, f := range []BucketFormat{FormatBlocks, FormatCompact} {
+		c := InitClient(256, 4)
+		err := c.AddServerWith("test", 256, 4, ServerOptions{Format: f, Dir: filepath.Join(t.TempDir(), "tree")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := c.ServerIO("test")
+		for a := 0; a < 20; a++ {
+			c.Access("test", true, a, 1)
+		}
+		io := c.ServerIO("test")
+		per_access[f] = (io.BytesRead + io.BytesWritten - start.BytesRead - start.BytesWritten) / 20
+		c.RemoveServer("test")
+	}
+
+	path := int64(2 * (8 + 1))
+	if per_access[FormatBlocks] != path*4*32 || per_access[FormatCompact] != path*(33+4*16) {
+		t.Errorf("bytes per access: %v", per_access)
+	}
+}
+
+func bench_bucket(b *testing.B, f BucketFormat, Z int) {
+	c := InitClient(16, Z)
+	err := c.AddServerWith("test", 16, Z, ServerOptions{Format: f, Dir: filepath.Join(b.TempDir(), "tree")})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.RemoveServer("test")
+
+	blks := []Block{block_encode(1, 2), block_encode(3, 4)}
+	size := 0
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		bucket := c.seal_bucket("test", node{1, 0}, blks)
+		size = len(bucket_join(bucket, nil))
+		_, err := c.open_bucket("test", node{1, 0}, bucket)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(size), "bytes/bucket")
+}
+
+func Benchmark_bucket_blocks_Z4(b *testing.B)   { bench_bucket(b, FormatBlocks, 4) }
+func Benchmark_bucket_compact_Z4(b *testing.B)  { bench_bucket(b, FormatCompact, 4) }
+func Benchmark_bucket_blocks_Z16(b *testing.B)  { bench_bucket(b, FormatBlocks, 16) }
+func Benchmark_bucket_compact_Z16(b *testing.B) { bench_bucket(b, FormatCompact, 16) }
+
+// random writes on the files backend, with what goes over the wire per access
+func bench_access(b *testing.B, f BucketFormat) {
+	N := 4096
+	c := InitClient(N, 4)
+	err := c.AddServerWith("test", N, 4, ServerOptions{Format: f, Dir: filepath.Join(b.TempDir(), "tree")})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.RemoveServer("test")
+
+	start := c.ServerIO("test")
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		r := rand.Intn(N)
+		_, err := c.Access("test", true, r, uint64(r))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	io := c.ServerIO("test")
+	b.ReportMetric(float64(io.BytesRead-start.BytesRead)/float64(b.N), "read-bytes/op")
+	b.ReportMetric(float64(io.BytesWritten-start.BytesWritten)/float64(b.N), "written-bytes/op")
+}
+
+func Benchmark_access_blocks(b *testing.B)  { bench_access(b, FormatBlocks) }
+func Benchmark_access_compact(b *testing.B) { bench_access(b, FormatCompact) }
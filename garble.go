@@ -0,0 +1,380 @@
+/*
+ * Yao garbled circuits with free-XOR and half-gates (Zahur, Rosulek, Evans)
+ */
+
+package oram2pc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// wire labels are 128 bits, the last bit of a label is its permute bit
+type label [16]byte
+
+func (a label) xor(b label) label {
+	var r label
+	for i := range r {
+		r[i] = a[i] ^ b[i]
+	}
+
+	return r
+}
+
+func (a label) lsb() bool {
+	return a[0]&1 == 1
+}
+
+func random_label() label {
+	var l label
+	rand.Read(l[:])
+	return l
+}
+
+// H(l, tweak) used to garble and evaluate AND gates
+func label_hash(l label, tweak uint64) label {
+	buf := make([]byte, 24)
+	copy(buf, l[:])
+	binary.LittleEndian.PutUint64(buf[16:], tweak)
+
+	var h label
+	sum := sha256.Sum256(buf)
+	copy(h[:], sum[:16])
+
+	return h
+}
+
+/*
+ * 1-out-of-2 oblivious transfer as seen by the 2PC backends
+ *
+ * Send transfers one of msgs[i][0] or msgs[i][1] for every i, Receive gets
+ * msgs[i][choices[i]] without the sender learning the choices.
+ */
+type OT interface {
+	Send(rw io.ReadWriter, msgs [][2][]byte) error
+	Receive(rw io.ReadWriter, choices []bool) ([][]byte, error)
+}
+
+type garbled_circuit struct {
+	tables [][2]label // one pair per AND gate, in gate order
+	zero   label      // false label of wire_zero
+	decode []bool     // permute bits of the false labels of the outputs
+}
+
+// garbles c, returns the garbled circuit and the false label of every wire
+func garble(c *Circuit) (*garbled_circuit, []label, label) {
+	delta := random_label()
+	delta[0] |= 1
+
+	w0 := make([]label, c.NumWires)
+	w0[wire_zero] = random_label()
+	for _, i := range c.GarblerInputs {
+		w0[i] = random_label()
+	}
+	for _, i := range c.EvaluatorInputs {
+		w0[i] = random_label()
+	}
+
+	gc := &garbled_circuit{zero: w0[wire_zero]}
+	for j, g := range c.gates {
+		switch g.op {
+		case gate_xor:
+			w0[g.out] = w0[g.a].xor(w0[g.b])
+		case gate_inv:
+			w0[g.out] = w0[g.a].xor(delta)
+		case gate_and:
+			a0, b0 := w0[g.a], w0[g.b]
+			a1, b1 := a0.xor(delta), b0.xor(delta)
+			pa, pb := a0.lsb(), b0.lsb()
+			t1, t2 := uint64(2*j), uint64(2*j+1)
+
+			// garbler half gate
+			tg := label_hash(a0, t1).xor(label_hash(a1, t1))
+			if pb {
+				tg = tg.xor(delta)
+			}
+			wg := label_hash(a0, t1)
+			if pa {
+				wg = wg.xor(tg)
+			}
+
+			// evaluator half gate
+			te := label_hash(b0, t2).xor(label_hash(b1, t2)).xor(a0)
+			we := label_hash(b0, t2)
+			if pb {
+				we = we.xor(te).xor(a0)
+			}
+
+			w0[g.out] = wg.xor(we)
+			gc.tables = append(gc.tables, [2]label{tg, te})
+		}
+	}
+
+	gc.decode = make([]bool, len(c.Outputs))
+	for i, o := range c.Outputs {
+		gc.decode[i] = w0[o].lsb()
+	}
+
+	return gc, w0, delta
+}
+
+// evaluates a garbled circuit given one label per input wire
+func (gc *garbled_circuit) eval(c *Circuit, g_in []label, e_in []label) ([]bool, error) {
+	w := make([]label, c.NumWires)
+	w[wire_zero] = gc.zero
+	for i, wi := range c.GarblerInputs {
+		w[wi] = g_in[i]
+	}
+	for i, wi := range c.EvaluatorInputs {
+		w[wi] = e_in[i]
+	}
+
+	k := 0
+	for j, g := range c.gates {
+		switch g.op {
+		case gate_xor:
+			w[g.out] = w[g.a].xor(w[g.b])
+		case gate_inv:
+			w[g.out] = w[g.a]
+		case gate_and:
+			if k >= len(gc.tables) {
+				return nil, errors.New("Garbled circuit is missing tables!")
+			}
+			tg, te := gc.tables[k][0], gc.tables[k][1]
+			k += 1
+
+			a, b := w[g.a], w[g.b]
+			wg := label_hash(a, uint64(2*j))
+			if a.lsb() {
+				wg = wg.xor(tg)
+			}
+			we := label_hash(b, uint64(2*j+1))
+			if b.lsb() {
+				we = we.xor(te).xor(a)
+			}
+
+			w[g.out] = wg.xor(we)
+		}
+	}
+
+	out := make([]bool, len(c.Outputs))
+	for i, o := range c.Outputs {
+		out[i] = w[o].lsb() != gc.decode[i]
+	}
+
+	return out, nil
+}
+
+func (gc *garbled_circuit) marshal() []byte {
+	buf := make([]byte, 0, 32*len(gc.tables)+16+len(gc.decode))
+	for i := range gc.tables {
+		buf = append(buf, gc.tables[i][0][:]...)
+		buf = append(buf, gc.tables[i][1][:]...)
+	}
+	buf = append(buf, gc.zero[:]...)
+	for _, d := range gc.decode {
+		if d {
+			buf = append(buf, 1)
+		} else {
+			buf = append(buf, 0)
+		}
+	}
+
+	return buf
+}
+
+func unmarshal_garbled(buf []byte, c *Circuit) (*garbled_circuit, error) {
+	num_and := c.NumAND()
+	if len(buf) != 32*num_and+16+len(c.Outputs) {
+		return nil, errors.New("Garbled circuit has the wrong size!")
+	}
+
+	gc := &garbled_circuit{tables: make([][2]label, num_and)}
+	for i := range gc.tables {
+		copy(gc.tables[i][0][:], buf[32*i:])
+		copy(gc.tables[i][1][:], buf[32*i+16:])
+	}
+	buf = buf[32*num_and:]
+	copy(gc.zero[:], buf)
+
+	gc.decode = make([]bool, len(c.Outputs))
+	for i := range gc.decode {
+		gc.decode[i] = buf[16+i] == 1
+	}
+
+	return gc, nil
+}
+
+func labels_bytes(ls []label) []byte {
+	buf := make([]byte, 0, 16*len(ls))
+	for i := range ls {
+		buf = append(buf, ls[i][:]...)
+	}
+
+	return buf
+}
+
+func bytes_labels(buf []byte, n int) ([]label, error) {
+	if len(buf) != 16*n {
+		return nil, errors.New("Wrong number of labels!")
+	}
+
+	ls := make([]label, n)
+	for i := range ls {
+		copy(ls[i][:], buf[16*i:])
+	}
+
+	return ls, nil
+}
+
+/*
+ * One side of a garbled circuit computation
+ *
+ * Both parties hold the same Circuit. The garbler garbles it and sends the
+ * labels for its own inputs, the evaluator gets the labels for its inputs
+ * through OT, evaluates, and sends the output bits back so both learn them.
+ */
+type GCParty struct {
+	Garbler bool
+	Conn    io.ReadWriter
+	OT      OT
+}
+
+// run the circuit with this party's input bits, returns the output bits
+func (p *GCParty) Run(c *Circuit, input []bool) ([]bool, error) {
+	if p.Garbler {
+		return p.run_garbler(c, input)
+	}
+
+	return p.run_evaluator(c, input)
+}
+
+func (p *GCParty) run_garbler(c *Circuit, input []bool) ([]bool, error) {
+	if len(input) != len(c.GarblerInputs) {
+		return nil, errors.New("Wrong number of garbler inputs!")
+	}
+
+	gc, w0, delta := garble(c)
+
+	// send the tables and the labels of our own input
+	in_labels := make([]label, len(input))
+	for i, wi := range c.GarblerInputs {
+		in_labels[i] = w0[wi]
+		if input[i] {
+			in_labels[i] = in_labels[i].xor(delta)
+		}
+	}
+
+	err := send_msg(p.Conn, gc.marshal())
+	if err != nil {
+		return nil, err
+	}
+	err = send_msg(p.Conn, labels_bytes(in_labels))
+	if err != nil {
+		return nil, err
+	}
+
+	// hand over the evaluator's input labels
+	msgs := make([][2][]byte, len(c.EvaluatorInputs))
+	for i, wi := range c.EvaluatorInputs {
+		l0, l1 := w0[wi], w0[wi].xor(delta)
+		msgs[i] = [2][]byte{l0[:], l1[:]}
+	}
+	err = p.OT.Send(p.Conn, msgs)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := recv_msg(p.Conn)
+	if err != nil {
+		return nil, err
+	}
+	if len(out) != len(c.Outputs) {
+		return nil, errors.New("Evaluator sent the wrong number of outputs!")
+	}
+
+	return bytes_bools(out), nil
+}
+
+func (p *GCParty) run_evaluator(c *Circuit, input []bool) ([]bool, error) {
+	if len(input) != len(c.EvaluatorInputs) {
+		return nil, errors.New("Wrong number of evaluator inputs!")
+	}
+
+	buf, err := recv_msg(p.Conn)
+	if err != nil {
+		return nil, err
+	}
+	gc, err := unmarshal_garbled(buf, c)
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err = recv_msg(p.Conn)
+	if err != nil {
+		return nil, err
+	}
+	g_in, err := bytes_labels(buf, len(c.GarblerInputs))
+	if err != nil {
+		return nil, err
+	}
+
+	got, err := p.OT.Receive(p.Conn, input)
+	if err != nil {
+		return nil, err
+	}
+	e_in, err := bytes_labels(bytes_join(got), len(c.EvaluatorInputs))
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := gc.eval(c, g_in, e_in)
+	if err != nil {
+		return nil, err
+	}
+
+	err = send_msg(p.Conn, bools_bytes(out))
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// one byte per bool, used for short messages like output bits
+func bools_bytes(bs []bool) []byte {
+	buf := make([]byte, len(bs))
+	for i := range bs {
+		if bs[i] {
+			buf[i] = 1
+		}
+	}
+
+	return buf
+}
+
+func bytes_bools(buf []byte) []bool {
+	bs := make([]bool, len(buf))
+	for i := range buf {
+		bs[i] = buf[i] == 1
+	}
+
+	return bs
+}
+
+func bytes_join(bs [][]byte) []byte {
+	n := 0
+	for i := range bs {
+		n += len(bs[i])
+	}
+
+	buf := make([]byte, 0, n)
+	for i := range bs {
+		buf = append(buf, bs[i]...)
+	}
+
+	return buf
+}
@@ -0,0 +1,232 @@
+package oram2pc
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+// runs both parties of a garbled circuit computation over a pipe
+func run_gc(c *Circuit, g_in []bool, e_in []bool) ([]bool, []bool, error) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	garbler := &GCParty{Garbler: true, Conn: a, OT: &IKNP{}}
+	evaluator := &GCParty{Garbler: false, Conn: b, OT: &IKNP{}}
+
+	type result struct {
+		out []bool
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		out, err := garbler.Run(c, g_in)
+		done <- result{out, err}
+	}()
+
+	e_out, err := evaluator.Run(c, e_in)
+	g := <-done
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return g.out, e_out, g.err
+}
+
+func Test_garble_gates(t *testing.T) {
+	cb := NewCircuitBuilder()
+	x := cb.GarblerInput(1)[0]
+	y := cb.EvaluatorInput(1)[0]
+	cb.Output(cb.AND(x, y), cb.XOR(x, y), cb.OR(x, y), cb.NOT(x), cb.One())
+	c := cb.Build()
+
+	for i := 0; i < 4; i++ {
+		g_in := []bool{i&1 == 1}
+		e_in := []bool{i&2 == 2}
+		g_out, e_out, err := run_gc(c, g_in, e_in)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := c.Eval(g_in, e_in)
+		for j := range want {
+			if g_out[j] != want[j] || e_out[j] != want[j] {
+				t.Errorf("inputs %v %v: got %v, want %v", g_in, e_in, g_out, want)
+			}
+		}
+	}
+}
+
+func Test_garble_stash_scan(t *testing.T) {
+	cb := NewCircuitBuilder()
+	stash := make([][]int, 8)
+	for i := range stash {
+		stash[i] = cb.GarblerInput(128)
+	}
+	id := cb.EvaluatorInput(32)
+	val, found := cb.StashScan(stash, id)
+	cb.Output(append(val, found)...)
+	c := cb.Build()
+
+	blks := make([]Block, 8)
+	g_in := []bool{}
+	for i := range blks {
+		if i%3 == 0 {
+			blks[i] = dummy_block()
+		} else {
+			blks[i] = block_encode(i*10, uint64(i)*0x1111)
+		}
+		g_in = append(g_in, block_bits(blks[i])...)
+	}
+
+	for _, a := range []int{10, 20, 50, 70, 30, 0} {
+		_, out, err := run_gc(c, g_in, uint32_to_bits(uint32(a)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		i := slice_find_block(blks, a)
+		want := uint64(0)
+		if i != -1 {
+			_, want, _ = block_decode(blks[i])
+		}
+		if bits_to_uint64(out[:64]) != want || out[64] != (i != -1) {
+			t.Errorf("block %d: got %x %v, want %x", a, bits_to_uint64(out[:64]), out[64], want)
+		}
+	}
+}
+
+// the garbled eviction does what stash.evict does in the clear
+func Test_garble_evict(t *testing.T) {
+	n, L, Z := 8, 3, 2
+	cb := NewCircuitBuilder()
+	stash := make([][]int, n)
+	for i := range stash {
+		stash[i] = cb.GarblerInput(128)
+	}
+	x := cb.EvaluatorInput(32)
+	rest, bux := cb.Evict(stash, x, L, Z)
+	for l := range bux {
+		for z := range bux[l] {
+			cb.Output(bux[l][z]...)
+		}
+	}
+	for i := range rest {
+		cb.Output(rest[i]...)
+	}
+	c := cb.Build()
+
+	for _, leaf := range []int{5, 0, 7} {
+		st := new_stash(n)
+		for i := 0; i < n; i++ {
+			if i%4 != 3 {
+				blk := block_encode(i, uint64(i)*0x1111)
+				block_set_leaf(blk, rand.Intn(1<<uint(L)))
+				st.blks[i] = blk
+			}
+		}
+		g_in := []bool{}
+		for i := range st.blks {
+			g_in = append(g_in, block_bits(st.blks[i])...)
+		}
+
+		want := st.evict(leaf, L, Z)
+		_, out, err := run_gc(c, g_in, uint32_to_bits(uint32(leaf)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := func() Block {
+			blk := Block(bits_to_bytes(out[:128]))
+			out = out[128:]
+			return blk
+		}
+		for l := range want {
+			for z := range want[l] {
+				if blk := got(); !bytes.Equal(blk, want[l][z]) {
+					t.Errorf("leaf %d: level %d slot %d holds %x, want %x", leaf, l, z, blk, want[l][z])
+				}
+			}
+		}
+		for i := range st.blks {
+			if blk := got(); !bytes.Equal(blk, st.blks[i]) {
+				t.Errorf("leaf %d: stash slot %d holds %x, want %x", leaf, i, blk, st.blks[i])
+			}
+		}
+	}
+}
+
+func Test_garble_stash_access(t *testing.T) {
+	n := 6
+	blks := make([]Block, n)
+	for i := range blks {
+		blks[i] = dummy_block()
+	}
+	blks[1] = block_encode(7, 0x77)
+	blks[4] = block_encode(3, 0x33)
+
+	ops := []struct {
+		write bool
+		id    uint32
+		data  uint64
+		want  uint64
+	}{
+		{false, 3, 0, 0x33},
+		{true, 3, 0x34, 0x34},
+		{false, 3, 0, 0x34},
+		{true, 9, 0x99, 0x99},
+		{false, 9, 0, 0x99},
+		{false, 7, 0, 0x77},
+		{false, 5, 0, 0},
+	}
+
+	sa, sb := share_blocks(blks)
+	for _, op := range ops {
+		a, b := net.Pipe()
+		garbler := &GCParty{Garbler: true, Conn: a, OT: &IKNP{}}
+		evaluator := &GCParty{Garbler: false, Conn: b, OT: &IKNP{}}
+
+		id_a := rand.Uint32()
+		leaf_a := rand.Uint32()
+		data_a := rand.Uint64()
+		write_a := rand.Intn(2) == 1
+
+		done := make(chan error)
+		var new_a []Block
+		var val_a uint64
+		go func() {
+			var err error
+			new_a, val_a, err = garbler.StashAccess(sa, id_a, leaf_a, write_a, data_a)
+			done <- err
+		}()
+
+		new_b, val_b, err := evaluator.StashAccess(sb, op.id^id_a, 5^leaf_a, op.write != write_a, op.data^data_a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		a.Close()
+		b.Close()
+
+		if val_a^val_b != op.want {
+			t.Errorf("access %v: got %x, want %x", op, val_a^val_b, op.want)
+		}
+		sa, sb = new_a, new_b
+	}
+
+	stash, err := unshare_blocks(sa, sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := slice_find_block(stash, 9)
+	if i == -1 {
+		t.Fatal("block 9 was not inserted into the stash")
+	}
+	if block_leaf(stash[i]) != 5 || block_leaf(stash[slice_find_block(stash, 7)]) != 5 {
+		t.Error("accessed blocks were not remapped to the new leaf")
+	}
+}
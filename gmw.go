@@ -0,0 +1,387 @@
+/*
+ * Boolean GMW on XOR shares, with AND gates backed by Beaver triples
+ *
+ * Evaluates the same Circuit as the garbled circuit backend: the garbler
+ * inputs belong to party 0 and the evaluator inputs to party 1. XOR and INV
+ * gates are local, AND gates of the same depth are done in one round.
+ */
+
+package oram2pc
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+/*
+ * Source of Beaver triples: shares of random bits a, b and c = a & b
+ */
+type TripleSource interface {
+	Triples(n int) ([]bool, []bool, []bool, error)
+}
+
+/*
+ * A trusted dealer that hands out triples to both parties, for testing
+ *
+ * NewDealer returns one source per party. They share the dealer, so both
+ * parties have to ask for the same numbers of triples in the same order.
+ */
+type DealerTriples struct {
+	party  int
+	dealer *dealer
+}
+
+type dealer struct {
+	mu     sync.Mutex
+	queues [2][][3]bool
+}
+
+func NewDealer() (*DealerTriples, *DealerTriples) {
+	d := &dealer{}
+	return &DealerTriples{party: 0, dealer: d}, &DealerTriples{party: 1, dealer: d}
+}
+
+func (t *DealerTriples) Triples(n int) ([]bool, []bool, []bool, error) {
+	d := t.dealer
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// deal more triples to both parties if we ran out
+	if len(d.queues[t.party]) < n {
+		need := n - len(d.queues[t.party])
+		r := random_bits(5 * need)
+		for i := 0; i < need; i++ {
+			a0, a1, b0, b1, c0 := r[5*i], r[5*i+1], r[5*i+2], r[5*i+3], r[5*i+4]
+			c1 := ((a0 != a1) && (b0 != b1)) != c0
+			d.queues[0] = append(d.queues[0], [3]bool{a0, b0, c0})
+			d.queues[1] = append(d.queues[1], [3]bool{a1, b1, c1})
+		}
+	}
+
+	a := make([]bool, n)
+	b := make([]bool, n)
+	c := make([]bool, n)
+	for i := 0; i < n; i++ {
+		a[i], b[i], c[i] = d.queues[t.party][i][0], d.queues[t.party][i][1], d.queues[t.party][i][2]
+	}
+	d.queues[t.party] = d.queues[t.party][n:]
+
+	return a, b, c, nil
+}
+
+/*
+ * Generates triples with oblivious transfer
+ *
+ * c = a0&b0 ^ a0&b1 ^ a1&b0 ^ a1&b1, the cross terms are computed with one
+ * OT each way. SendOT and RecvOT must be separate instances since IKNP keeps
+ * state per role, and the other party's pair must be the matching ones.
+ */
+type OTTriples struct {
+	Party  int
+	Conn   io.ReadWriter
+	SendOT OT
+	RecvOT OT
+}
+
+// computes shares of x_mine & y_theirs for every i with one batch of OTs
+func (t *OTTriples) cross(x []bool, y []bool, sender bool) ([]bool, error) {
+	if sender {
+		n := len(y)
+		// send (r, r ^ y): the receiver gets r ^ (choice & y)
+		r := random_bits(n)
+		msgs := make([][2][]byte, n)
+		for i := range msgs {
+			m0, m1 := []byte{0}, []byte{0}
+			if r[i] {
+				m0[0] = 1
+			}
+			if r[i] != y[i] {
+				m1[0] = 1
+			}
+			msgs[i] = [2][]byte{m0, m1}
+		}
+		err := t.SendOT.Send(t.Conn, msgs)
+		return r, err
+	}
+
+	got, err := t.RecvOT.Receive(t.Conn, x)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]bool, len(x))
+	for i := range got {
+		if len(got[i]) != 1 {
+			return nil, errors.New("Triples: bad OT message!")
+		}
+		out[i] = got[i][0] == 1
+	}
+
+	return out, nil
+}
+
+func (t *OTTriples) Triples(n int) ([]bool, []bool, []bool, error) {
+	a := random_bits(n)
+	b := random_bits(n)
+
+	// party 0 receives first, party 1 sends first so the OTs line up
+	var s1, s2 []bool
+	var err error
+	if t.Party == 0 {
+		// a0 & b1, then a1 & b0
+		s1, err = t.cross(a, nil, false)
+		if err == nil {
+			s2, err = t.cross(nil, b, true)
+		}
+	} else {
+		s1, err = t.cross(nil, b, true)
+		if err == nil {
+			s2, err = t.cross(a, nil, false)
+		}
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	c := make([]bool, n)
+	for i := range c {
+		c[i] = (a[i] && b[i]) != s1[i] != s2[i]
+	}
+
+	return a, b, c, nil
+}
+
+/*
+ * One party of a GMW computation
+ */
+type GMWParty struct {
+	Party   int // 0 or 1
+	Conn    io.ReadWriter
+	Triples TripleSource
+}
+
+// swaps a message with the other party, party 0 always writes first
+func (p *GMWParty) exchange(msg []byte) ([]byte, error) {
+	if p.Party == 0 {
+		err := send_msg(p.Conn, msg)
+		if err != nil {
+			return nil, err
+		}
+		return recv_msg(p.Conn)
+	}
+
+	other, err := recv_msg(p.Conn)
+	if err != nil {
+		return nil, err
+	}
+
+	return other, send_msg(p.Conn, msg)
+}
+
+// opens shared bits to both parties
+func (p *GMWParty) open(shares []bool) ([]bool, error) {
+	mine := bits_to_bytes(shares)
+	other, err := p.exchange(mine)
+	if err != nil {
+		return nil, err
+	}
+	if len(other) != len(mine) {
+		return nil, errors.New("GMW: other party opened the wrong number of bits!")
+	}
+
+	opened, err := xor_bytes(mine, other)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes_to_bits(opened)[:len(shares)], nil
+}
+
+/*
+ * Run the circuit on private inputs and reveal the outputs to both parties
+ */
+func (p *GMWParty) Run(c *Circuit, input []bool) ([]bool, error) {
+	mine, theirs := c.GarblerInputs, c.EvaluatorInputs
+	if p.Party == 1 {
+		mine, theirs = theirs, mine
+	}
+	if len(input) != len(mine) {
+		return nil, errors.New("GMW: wrong number of inputs!")
+	}
+
+	// share our inputs: keep x ^ r and send r
+	r := random_bits(len(input))
+	own := make([]bool, len(input))
+	for i := range input {
+		own[i] = input[i] != r[i]
+	}
+
+	buf, err := p.exchange(bits_to_bytes(r))
+	if err != nil {
+		return nil, err
+	}
+	other := bytes_to_bits(buf)
+	if len(other) < len(theirs) {
+		return nil, errors.New("GMW: other party sent too few input shares!")
+	}
+
+	shares := make([]bool, c.NumWires)
+	for i, w := range mine {
+		shares[w] = own[i]
+	}
+	for i, w := range theirs {
+		shares[w] = other[i]
+	}
+
+	out, err := p.eval(c, shares)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.open(out)
+}
+
+/*
+ * Evaluate the circuit on inputs that are already XOR-shared
+ *
+ * shares holds this party's share of every garbler input followed by every
+ * evaluator input. Returns this party's shares of the outputs.
+ */
+func (p *GMWParty) EvalShared(c *Circuit, shares []bool) ([]bool, error) {
+	n_in := len(c.GarblerInputs) + len(c.EvaluatorInputs)
+	if len(shares) != n_in {
+		return nil, errors.New("GMW: wrong number of input shares!")
+	}
+
+	w := make([]bool, c.NumWires)
+	for i, wi := range c.GarblerInputs {
+		w[wi] = shares[i]
+	}
+	for i, wi := range c.EvaluatorInputs {
+		w[wi] = shares[len(c.GarblerInputs)+i]
+	}
+
+	return p.eval(c, w)
+}
+
+// AND depth of every gate, ANDs of the same depth are opened together
+func and_depths(c *Circuit) ([]int, int) {
+	wire_d := make([]int, c.NumWires)
+	gate_d := make([]int, len(c.gates))
+	max_d := 0
+	for j, g := range c.gates {
+		d := wire_d[g.a]
+		if g.op != gate_inv && wire_d[g.b] > d {
+			d = wire_d[g.b]
+		}
+		if g.op == gate_and {
+			d += 1
+		}
+
+		wire_d[g.out] = d
+		gate_d[j] = d
+		if d > max_d {
+			max_d = d
+		}
+	}
+
+	return gate_d, max_d
+}
+
+// evaluates the gates given shares of the input wires, returns output shares
+func (p *GMWParty) eval(c *Circuit, w []bool) ([]bool, error) {
+	gate_d, max_d := and_depths(c)
+
+	layers := make([][]int, max_d+1)
+	for j := range c.gates {
+		layers[gate_d[j]] = append(layers[gate_d[j]], j)
+	}
+
+	for _, layer := range layers {
+		// all ANDs of this layer only depend on earlier layers
+		ands := make([]int, 0)
+		for _, j := range layer {
+			if c.gates[j].op == gate_and {
+				ands = append(ands, j)
+			}
+		}
+
+		if len(ands) > 0 {
+			a, b, t, err := p.Triples.Triples(len(ands))
+			if err != nil {
+				return nil, err
+			}
+
+			// open d = x ^ a and e = y ^ b
+			de := make([]bool, 2*len(ands))
+			for k, j := range ands {
+				g := c.gates[j]
+				de[2*k] = w[g.a] != a[k]
+				de[2*k+1] = w[g.b] != b[k]
+			}
+			opened, err := p.open(de)
+			if err != nil {
+				return nil, err
+			}
+
+			// z = c ^ d&b ^ e&a ^ d&e (the last term only for party 0)
+			for k, j := range ands {
+				d, e := opened[2*k], opened[2*k+1]
+				z := t[k] != (d && b[k]) != (e && a[k])
+				if p.Party == 0 {
+					z = z != (d && e)
+				}
+				w[c.gates[j].out] = z
+			}
+		}
+
+		for _, j := range layer {
+			g := c.gates[j]
+			switch g.op {
+			case gate_xor:
+				w[g.out] = w[g.a] != w[g.b]
+			case gate_inv:
+				// only one party flips its share
+				w[g.out] = w[g.a] != (p.Party == 0)
+			}
+		}
+	}
+
+	out := make([]bool, len(c.Outputs))
+	for i, o := range c.Outputs {
+		out[i] = w[o]
+	}
+
+	return out, nil
+}
+
+/*
+ * The compare-and-select part of slice_find_block on a shared stash
+ *
+ * stash and id are this party's XOR shares. Returns this party's shares of
+ * the value of the matching block and of whether it was found.
+ */
+func (p *GMWParty) StashLookup(stash []Block, id uint32) (uint64, bool, error) {
+	cb := NewCircuitBuilder()
+	stash_w := make([][]int, len(stash))
+	for i := range stash_w {
+		stash_w[i] = cb.GarblerInput(128)
+	}
+	id_w := cb.GarblerInput(32)
+	val, found := cb.StashScan(stash_w, id_w)
+	cb.Output(append(val, found)...)
+	c := cb.Build()
+
+	shares := make([]bool, 0, len(c.GarblerInputs))
+	for i := range stash {
+		shares = append(shares, block_bits(stash[i])...)
+	}
+	shares = append(shares, uint32_to_bits(id)...)
+
+	out, err := p.EvalShared(c, shares)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return bits_to_uint64(out[:64]), out[64], nil
+}
@@ -0,0 +1,110 @@
+package oram2pc
+
+import (
+	"math/rand"
+	"net"
+	"testing"
+)
+
+// makes two connected GMW parties, with OT triples if ot is set
+func gmw_parties(ot bool) (*GMWParty, *GMWParty, func()) {
+	a, b := net.Pipe()
+	p0 := &GMWParty{Party: 0, Conn: a}
+	p1 := &GMWParty{Party: 1, Conn: b}
+
+	if ot {
+		p0.Triples = &OTTriples{Party: 0, Conn: a, SendOT: &IKNP{}, RecvOT: &IKNP{}}
+		p1.Triples = &OTTriples{Party: 1, Conn: b, SendOT: &IKNP{}, RecvOT: &IKNP{}}
+	} else {
+		p0.Triples, p1.Triples = NewDealer()
+	}
+
+	return p0, p1, func() { a.Close(); b.Close() }
+}
+
+func Test_gmw_adder(t *testing.T) {
+	// 8-bit ripple carry adder, party 0 has x and party 1 has y
+	cb := NewCircuitBuilder()
+	x := cb.GarblerInput(8)
+	y := cb.EvaluatorInput(8)
+	carry := cb.Zero()
+	for i := range x {
+		s := cb.XOR(x[i], y[i])
+		cb.Output(cb.XOR(s, carry))
+		carry = cb.OR(cb.AND(x[i], y[i]), cb.AND(s, carry))
+	}
+	c := cb.Build()
+
+	for _, ot := range []bool{false, true} {
+		p0, p1, done := gmw_parties(ot)
+		for k := 0; k < 5; k++ {
+			xv, yv := byte(rand.Intn(256)), byte(rand.Intn(256))
+
+			errc := make(chan error)
+			go func() {
+				_, err := p0.Run(c, bytes_to_bits([]byte{xv}))
+				errc <- err
+			}()
+			out, err := p1.Run(c, bytes_to_bits([]byte{yv}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+
+			if bits_to_bytes(out)[0] != xv+yv {
+				t.Errorf("%d + %d: got %d", xv, yv, bits_to_bytes(out)[0])
+			}
+		}
+		done()
+	}
+}
+
+func Test_gmw_stash_lookup(t *testing.T) {
+	blks := make([]Block, 10)
+	for i := range blks {
+		if i%4 == 0 {
+			blks[i] = dummy_block()
+		} else {
+			blks[i] = block_encode(i+100, uint64(i)<<40)
+		}
+	}
+
+	for _, ot := range []bool{false, true} {
+		p0, p1, done := gmw_parties(ot)
+		for _, a := range []int{101, 105, 104, 109, 3} {
+			s0, s1 := share_blocks(blks)
+			id0 := rand.Uint32()
+
+			type result struct {
+				val   uint64
+				found bool
+				err   error
+			}
+			res := make(chan result)
+			go func() {
+				v, f, err := p0.StashLookup(s0, id0)
+				res <- result{v, f, err}
+			}()
+			v1, f1, err := p1.StashLookup(s1, id0^uint32(a))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r0 := <-res
+			if r0.err != nil {
+				t.Fatal(r0.err)
+			}
+
+			i := slice_find_block(blks, a)
+			want := uint64(0)
+			if i != -1 {
+				_, want, _ = block_decode(blks[i])
+			}
+			if r0.val^v1 != want || (r0.found != f1) != (i != -1) {
+				t.Errorf("block %d: got %x, want %x", a, r0.val^v1, want)
+			}
+		}
+		done()
+	}
+}
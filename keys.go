@@ -0,0 +1,418 @@
+/*
+ * Key management
+ *
+ * Every key the client uses is derived from one 32-byte master key with
+ * HKDF-SHA256, labelled with the server, what the key is for and the
+ * server's key epoch:
+ *
+ *   oram2pc <purpose> <server> <epoch>
+ *
+ * so servers never share a key and a key can be replaced by moving to the
+ * next epoch without touching the master key. The state file keeps the
+ * master key unless it's detached, in which case LoadClient leaves the
+ * client locked until ImportMasterKey. The stash and position map in the
+ * state file and the log are sealed under a state key (AES-GCM), so a
+ * detached state file only gives away the shape of the trees and which
+ * buckets are stale.
+ *
+ * RotateKey moves a server to a new epoch online. From then on every path
+ * written back is encrypted under the new key, and a sweep re-encrypts the
+ * buckets nobody wrote in the background while the client is idle. Until
+ * the sweep is done the client remembers which buckets are under the new
+ * key, so each one is read with the right key.
+ */
+
+package oram2pc
+
+import (
+	"bytes"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"strconv"
+)
+
+const MasterKeySize = 32
+
+// what the derived keys of a server are for
+const (
+	purpose_bucket = "bucket"
+	purpose_check  = "check"
+	purpose_state  = "state"
+)
+
+// bytes of the nonce in front of sealed state
+const state_nonce = 12
+
+// buckets the sweep re-encrypts between checks for an access waiting
+const sweep_batch = 16
+
+// keys and rotation state of one server
+type server_keys struct {
+	epoch int
+	cur   []byte // bucket key of the current epoch
+	old   []byte // bucket key of the epoch before, while rotating
+
+	fresh   map[node]bool // buckets under cur, while rotating
+	cursor  int           // heap id the sweep goes on from
+	pending *sweep_write  // a sweep write that failed, redone before the next access
+}
+
+// buckets re-encrypted by the sweep, on their way to the tree
+type sweep_write struct {
+	nodes   []node
+	buckets []Bucket
+}
+
+// derives n bytes for purpose on a server in an epoch
+func derive_key(master []byte, server string, purpose string, epoch int, n int) []byte {
+	info := "oram2pc " + purpose + " " + server + " " + strconv.Itoa(epoch)
+	key, err := hkdf.Key(sha256.New, master, nil, info, n)
+	if err != nil {
+		panic(err)
+	}
+
+	return key
+}
+
+// what the state file keeps to tell the right master key from a wrong one
+func key_check(master []byte) []byte {
+	return derive_key(master, "", purpose_check, 0, 8)
+}
+
+func new_master_key() []byte {
+	master := make([]byte, MasterKeySize)
+	rand.Read(master)
+
+	return master
+}
+
+// the bucket key of epoch, nil without a master key
+func (c *Client) bucket_key(name string, epoch int) []byte {
+	if c.master == nil {
+		return nil
+	}
+
+	return derive_key(c.master, name, purpose_bucket, epoch, 16)
+}
+
+// seals v, gob encoded, under a server's state key of epoch
+func (c *Client) seal_state(name string, epoch int, v any) ([]byte, error) {
+	if c.master == nil {
+		return nil, ErrNoKey
+	}
+	var plain bytes.Buffer
+	err := gob.NewEncoder(&plain).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, state_nonce)
+	rand.Read(nonce)
+	key := derive_key(c.master, name, purpose_state, epoch, 16)
+
+	return compact_aead(key).Seal(nonce, nonce, plain.Bytes(), nil), nil
+}
+
+// opens what seal_state sealed into v
+func (c *Client) open_state(name string, epoch int, sealed []byte, v any) error {
+	if c.master == nil {
+		return ErrNoKey
+	}
+	if len(sealed) < state_nonce {
+		return integrity_err("sealed state of %d bytes", len(sealed))
+	}
+
+	key := derive_key(c.master, name, purpose_state, epoch, 16)
+	plain, err := compact_aead(key).Open(nil, sealed[:state_nonce], sealed[state_nonce:], nil)
+	if err != nil {
+		return integrity_err("sealed state of server %s doesn't open", name)
+	}
+	err = gob.NewDecoder(bytes.NewReader(plain)).Decode(v)
+	if err != nil {
+		return integrity_err("sealed state of server %s: %v", name, err)
+	}
+
+	return nil
+}
+
+// derives the keys of a server's current epoch, and the last one's while rotating
+func (c *Client) derive_keys(name string) {
+	k := c.keys[name]
+	k.cur = c.bucket_key(name, k.epoch)
+	if k.fresh != nil {
+		k.old = c.bucket_key(name, k.epoch-1)
+	}
+}
+
+// the key bucket nd is encrypted under
+func (k *server_keys) node_key(nd node) []byte {
+	if k.fresh == nil || k.fresh[nd] {
+		return k.cur
+	}
+
+	return k.old
+}
+
+// the buckets at nodes were written under the current key
+func (k *server_keys) written(nodes []node) {
+	if k.fresh == nil {
+		return
+	}
+	for _, nd := range nodes {
+		k.fresh[nd] = true
+	}
+}
+
+// the buckets still under the old key, less ones that are stale anyway
+func (c *Client) key_pending(name string) int {
+	s := c.servers[name]
+	k := c.keys[name]
+	if k.fresh == nil {
+		return 0
+	}
+
+	n := 0
+	for l := 0; l <= s.L; l++ {
+		for i := 0; i < s.width(l); i++ {
+			nd := node{l, i}
+			if k.fresh[nd] == false && c.evict[name].fetched[nd] == false {
+				n += 1
+			}
+		}
+	}
+
+	return n
+}
+
+/*
+ * Returns a copy of the master key, e.g. to keep it somewhere safer than
+ * the state file
+ */
+func (c *Client) ExportMasterKey() ([]byte, error) {
+	if c.master == nil {
+		return nil, ErrNoKey
+	}
+
+	return bytes.Clone(c.master), nil
+}
+
+/*
+ * Sets the master key. A client with servers only takes the key it was
+ * saved with, which unlocks a client loaded from a state file without one.
+ */
+func (c *Client) ImportMasterKey(master []byte) error {
+	if len(master) != MasterKeySize {
+		return errors.New("Master key must be 32 bytes!")
+	}
+	if len(c.servers) == 0 {
+		c.master = bytes.Clone(master)
+		c.check = key_check(master)
+		return nil
+	}
+	if bytes.Equal(key_check(master), c.check) == false {
+		return integrity_err("wrong master key")
+	}
+
+	c.master = bytes.Clone(master)
+	for name := range c.servers {
+		c.derive_keys(name)
+	}
+
+	// the servers loaded without the key can be read now
+	err := c.unlock()
+	if err != nil {
+		c.master = nil
+		for name := range c.servers {
+			c.derive_keys(name)
+		}
+		return err
+	}
+
+	return nil
+}
+
+/*
+ * Whether Save leaves the master key out of the state file, in which case
+ * it has to be imported again after LoadClient
+ */
+func (c *Client) DetachMasterKey(detach bool) {
+	c.detached = detach
+}
+
+/*
+ * Derives a key of n bytes for some purpose of the caller's own, tied to a
+ * server's current key epoch
+ */
+func (c *Client) DeriveKey(name string, purpose string, n int) ([]byte, error) {
+	k, prs := c.keys[name]
+	if prs == false {
+		return nil, errors.New("No server exists by that name!")
+	}
+	if c.master == nil {
+		return nil, ErrNoKey
+	}
+	if purpose == purpose_bucket || purpose == purpose_check || purpose == purpose_state {
+		return nil, errors.New("That purpose is reserved!")
+	}
+
+	return derive_key(c.master, name, purpose, k.epoch, n), nil
+}
+
+// where a server's key rotation is at
+type KeyStatus struct {
+	Epoch   int
+	Pending int // buckets still under the key of the epoch before
+}
+
+func (c *Client) KeyStatus(name string) (KeyStatus, error) {
+	k, prs := c.keys[name]
+	if prs == false {
+		return KeyStatus{}, errors.New("No server exists by that name!")
+	}
+	c.settle(name)
+	st := KeyStatus{Epoch: k.epoch, Pending: c.key_pending(name)}
+	c.background(name, false)
+
+	return st, nil
+}
+
+/*
+ * Moves a server to a new key epoch. A rotation still going is finished
+ * first. If the client has a state file it's saved right away, so that a
+ * crash never leaves buckets under a key the state file doesn't know.
+ */
+func (c *Client) RotateKey(name string) error {
+	err := c.FinishRotation(name)
+	if err != nil {
+		return err
+	}
+
+	k := c.keys[name]
+	k.epoch += 1
+	k.fresh = make(map[node]bool)
+	k.cursor = 0
+	c.derive_keys(name)
+
+	if c.state != "" {
+		err := c.Save(c.state)
+		if err != nil {
+			k.epoch -= 1
+			k.fresh = nil
+			k.old = nil
+			c.derive_keys(name)
+			return err
+		}
+	}
+	c.log().Info("oram: rotating key", "server", name, "epoch", k.epoch)
+	c.background(name, false)
+
+	return nil
+}
+
+// re-encrypts every bucket still under the old key before returning
+func (c *Client) FinishRotation(name string) error {
+	err := c.flush_dirty(name)
+	if err != nil {
+		return err
+	}
+
+	return c.sweep(name, nil)
+}
+
+/*
+ * Re-encrypts buckets under the current key a batch at a time until every
+ * bucket is, or stop is closed
+ */
+func (c *Client) sweep(name string, stop <-chan struct{}) error {
+	k := c.keys[name]
+	for k.fresh != nil {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+
+		err := c.sweep_next(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *Client) sweep_next(name string) error {
+	s := c.servers[name]
+	k := c.keys[name]
+	fetched := c.evict[name].fetched
+	if k.pending != nil {
+		return c.sweep_write(name)
+	}
+
+	// stale buckets are written under the new key before they're read
+	nodes := []node{}
+	for len(nodes) < sweep_batch && k.cursor < (2<<uint(s.L))-1 {
+		nd := id_node(k.cursor)
+		k.cursor += 1
+		if nd.n < s.width(nd.l) && k.fresh[nd] == false && fetched[nd] == false {
+			nodes = append(nodes, nd)
+		}
+	}
+	if len(nodes) == 0 {
+		k.fresh = nil
+		k.old = nil
+		c.log().Info("oram: key rotation done", "server", name, "epoch", k.epoch)
+		return nil
+	}
+
+	buckets, err := s.read_nodes(nodes)
+	if err != nil {
+		k.cursor = heap_id(nodes[0])
+		return err
+	}
+	for i := range buckets {
+		blks, err := c.open_bucket(name, nodes[i], buckets[i])
+		if err != nil {
+			k.cursor = heap_id(nodes[0])
+			return err
+		}
+		buckets[i] = c.seal_bucket(name, nodes[i], blks)
+	}
+	k.pending = &sweep_write{nodes: nodes, buckets: buckets}
+
+	return c.sweep_write(name)
+}
+
+/*
+ * Logs and writes the sweep's pending buckets. Until that works they may be
+ * under either key, so they're written again before anything reads them.
+ */
+func (c *Client) sweep_write(name string) error {
+	s := c.servers[name]
+	k := c.keys[name]
+	sw := k.pending
+
+	if w, prs := c.wals[name]; prs == true {
+		rec := wal_record{Leaf: -1, Epoch: k.epoch, Nodes: make([]int, len(sw.nodes)), Buckets: make([][]byte, len(sw.buckets))}
+		for i := range sw.nodes {
+			rec.Nodes[i] = heap_id(sw.nodes[i])
+			rec.Buckets[i] = bucket_join(sw.buckets[i], nil)
+		}
+		err := w.append(rec)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := s.write_nodes(sw.nodes, sw.buckets)
+	if err != nil {
+		return err
+	}
+	k.written(sw.nodes)
+	k.pending = nil
+
+	return nil
+}
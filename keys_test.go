@@ -0,0 +1,447 @@
+package oram2pc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_keys_derive(t *testing.T) {
+	master := bytes.Repeat([]byte{7}, MasterKeySize)
+	clients := make([]*Client, 2)
+	for i := range clients {
+		clients[i] = InitClient(16, 4)
+		err := clients[i].ImportMasterKey(master)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"a", "b"} {
+			err := clients[i].AddServerAt(name, 16, 4, 4096, filepath.Join(t.TempDir(), name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer clients[i].RemoveServer(name)
+		}
+	}
+
+	// the same master key gives the same keys, every server its own
+	c := clients[0]
+	if !bytes.Equal(c.keys["a"].cur, clients[1].keys["a"].cur) {
+		t.Error("one master key derived two keys for a server")
+	}
+	if bytes.Equal(c.keys["a"].cur, c.keys["b"].cur) {
+		t.Error("two servers share a key")
+	}
+
+	k1, err := c.DeriveKey("a", "app", 32)
+	if err != nil || len(k1) != 32 {
+		t.Fatalf("derived %x (%v)", k1, err)
+	}
+	k2, _ := c.DeriveKey("a", "other app", 32)
+	if bytes.Equal(k1, k2) {
+		t.Error("two purposes share a key")
+	}
+	_, err = c.DeriveKey("a", purpose_bucket, 16)
+	if err == nil {
+		t.Error("derived the bucket key")
+	}
+
+	exported, err := c.ExportMasterKey()
+	if err != nil || !bytes.Equal(exported, master) {
+		t.Errorf("exported %x (%v)", exported, err)
+	}
+	if c.ImportMasterKey(bytes.Repeat([]byte{8}, MasterKeySize)) == nil {
+		t.Error("replaced the master key of a client with servers")
+	}
+	if c.ImportMasterKey(master[1:]) == nil {
+		t.Error("imported a short master key")
+	}
+}
+
+// a block's ciphertexts under two epochs give away nothing about the keys
+func Test_keys_epoch_ciphertexts(t *testing.T) {
+	c := InitClient(16, 4)
+	err := c.AddServerAt("test", 16, 4, 4096, filepath.Join(t.TempDir(), "tree"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.RemoveServer("test")
+
+	m := block_encode(3, 12345)
+	k1, k2 := c.bucket_key("test", 0), c.bucket_key("test", 1)
+	c1, c2 := enc_block(m, k1), enc_block(m, k2)
+	pad1, _ := xor_bytes(c1[len(m):], m)
+	pad2, _ := xor_bytes(c2[len(m):], m)
+	if bytes.Equal(pad1, k1) || bytes.Equal(pad2, k2) {
+		t.Error("the keystream is the key")
+	}
+	diff, _ := xor_bytes(c1[len(m):], c2[len(m):])
+	keys, _ := xor_bytes(k1, k2)
+	if bytes.Equal(diff, keys) {
+		t.Error("two epochs' ciphertexts XOR to the XOR of their keys")
+	}
+
+	// the keystream depends on the randomness too
+	again := enc_block(m, k1)
+	pad, _ := xor_bytes(again[len(m):], m)
+	if bytes.Equal(pad, pad1) {
+		t.Error("two encryptions under one key share a keystream")
+	}
+	if got, err := dec_block(c2, k2); err != nil || !bytes.Equal(got, m) {
+		t.Errorf("decrypted %x (%v)", got, err)
+	}
+}
+
+// block a holds a*mul+add for every a < N
+func check_blocks(t *testing.T, c *Client, N int, mul int, add int, what string) {
+	for a := 0; a < N; a++ {
+		v, err := c.Access("test", false, a, 0)
+		if err != nil || v != uint64(a*mul+add) {
+			t.Errorf("%s: block %d: got %d, want %d (%v)", what, a, v, a*mul+add, err)
+		}
+	}
+}
+
+func Test_keys_rotate(t *testing.T) {
+	for _, opts := range []ServerOptions{{}, {Backend: BackendSingle}, {Eviction: EvictEvery(3)}} {
+		c := InitClient(64, 4)
+		opts.Dir = filepath.Join(t.TempDir(), "tree")
+		err := c.AddServerWith("test", 64, 4, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for a := 0; a < 64; a++ {
+			c.Access("test", true, a, uint64(a))
+		}
+		old := c.keys["test"].cur
+
+		err = c.RotateKey("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		st, _ := c.KeyStatus("test")
+		if st.Epoch != 1 {
+			t.Errorf("%v: epoch %d after a rotation", opts.Backend, st.Epoch)
+		}
+
+		// accesses in the middle of the rotation see both keys
+		for a := 0; a < 64; a += 2 {
+			c.Access("test", true, a, uint64(a*2))
+		}
+		err = c.FinishRotation("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		st, _ = c.KeyStatus("test")
+		if st.Pending != 0 || c.keys["test"].fresh != nil {
+			t.Errorf("%v: %d buckets left after finishing", opts.Backend, st.Pending)
+		}
+		if bytes.Equal(old, c.keys["test"].cur) {
+			t.Errorf("%v: the key didn't change", opts.Backend)
+		}
+
+		for a := 0; a < 64; a++ {
+			want := uint64(a)
+			if a%2 == 0 {
+				want = uint64(a * 2)
+			}
+			v, err := c.Access("test", false, a, 0)
+			if err != nil || v != want {
+				t.Errorf("%v: block %d: got %d, want %d (%v)", opts.Backend, a, v, want, err)
+			}
+		}
+		stats, err := c.Stats("test")
+		if err != nil || stats.TreeBlocks+stats.StashBlocks != 64 {
+			t.Errorf("%v: stats %+v (%v)", opts.Backend, stats, err)
+		}
+		c.RemoveServer("test")
+	}
+}
+
+// left alone, the sweep finishes the rotation in the background
+func Test_keys_sweep_background(t *testing.T) {
+	c := InitClient(64, 4)
+	err := c.AddServerAt("test", 64, 4, 4096, filepath.Join(t.TempDir(), "tree"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.RemoveServer("test")
+	for a := 0; a < 64; a++ {
+		c.Access("test", true, a, uint64(a+5))
+	}
+
+	err = c.RotateKey("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for a := 0; a < 64; a += 4 {
+		c.Access("test", false, a, 0)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		st, _ := c.KeyStatus("test")
+		if st.Pending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d buckets left after 10s", st.Pending)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	check_blocks(t, c, 64, 1, 5, "after the sweep")
+}
+
+func Test_keys_detached(t *testing.T) {
+	dir := t.TempDir()
+	state := filepath.Join(dir, "state")
+
+	c := InitClient(16, 4)
+	err := c.AddServerAt("test", 16, 4, 4096, filepath.Join(dir, "tree"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for a := 0; a < 16; a++ {
+		c.Access("test", true, a, uint64(a*3))
+	}
+	master, _ := c.ExportMasterKey()
+	c.DetachMasterKey(true)
+	err = c.Save(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	c2, err := LoadClient(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.RemoveServer("test")
+	_, err = c2.Access("test", false, 1, 0)
+	if !errors.Is(err, ErrNoKey) {
+		t.Errorf("access without the key: %v", err)
+	}
+	_, err = c2.Dump("test")
+	if !errors.Is(err, ErrNoKey) {
+		t.Errorf("dump without the key: %v", err)
+	}
+
+	wrong := bytes.Clone(master)
+	wrong[0] ^= 1
+	err = c2.ImportMasterKey(wrong)
+	if !errors.Is(err, ErrIntegrity) {
+		t.Errorf("imported the wrong key: %v", err)
+	}
+	err = c2.ImportMasterKey(master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check_blocks(t, c2, 16, 3, 0, "after import")
+
+	// still detached the next time it's saved
+	err = c2.Save(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c3, _ := LoadClient(state)
+	if _, err := c3.ExportMasterKey(); !errors.Is(err, ErrNoKey) {
+		t.Errorf("the key made it back into the state file: %v", err)
+	}
+}
+
+/*
+ * Without the master key a detached state file and its log don't give away
+ * the stash or the position map, and with it they come back, log and all
+ */
+func Test_keys_detached_sealed(t *testing.T) {
+	dir := t.TempDir()
+	state := filepath.Join(dir, "state")
+
+	c := InitClient(64, 2)
+	err := c.AddServerAt("test", 64, 2, 4096, filepath.Join(dir, "tree"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	master, _ := c.ExportMasterKey()
+	c.DetachMasterKey(true)
+
+	// values no encoding could produce by chance
+	val := func(a int) uint64 { return 0x5eed5eed00000000 | uint64(a) }
+	for a := 0; a < 32; a++ {
+		c.Access("test", true, a, val(a))
+	}
+	err = c.Save(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stashed := c.StashSize("test")
+	for a := 32; a < 64; a++ {
+		c.Access("test", true, a, val(a))
+		stashed += c.StashSize("test")
+	}
+	if stashed == 0 {
+		t.Fatal("nothing was ever in the stash")
+	}
+	c.Close()
+
+	for _, file := range []string{state, wal_path(state, "test")} {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for a := 0; a < 64; a++ {
+			b := make([]byte, 8)
+			binary.LittleEndian.PutUint64(b, val(a))
+			if bytes.Contains(data, b) {
+				t.Fatalf("%s holds the value of block %d in the clear", filepath.Base(file), a)
+			}
+		}
+	}
+
+	// the state can't be opened under another master key
+	c2, err := LoadClient(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.RemoveServer("test")
+	if err := c2.Save(state); !errors.Is(err, ErrNoKey) {
+		t.Errorf("saved a locked client: %v", err)
+	}
+	c2.master = bytes.Repeat([]byte{1}, MasterKeySize)
+	if err := c2.unlock(); !errors.Is(err, ErrIntegrity) {
+		t.Errorf("opened the state under the wrong key: %v", err)
+	}
+	c2.master = nil
+
+	err = c2.ImportMasterKey(master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for a := 0; a < 64; a++ {
+		v, err := c2.Access("test", false, a, 0)
+		if err != nil || v != val(a) {
+			t.Errorf("block %d: got %x, want %x (%v)", a, v, val(a), err)
+		}
+	}
+}
+
+// a rotation in progress survives a restart and a crash in the sweep
+func Test_keys_rotate_persist(t *testing.T) {
+	defer func() { crash_at = nil }()
+
+	for _, point := range []string{"wal torn", "wal synced", "apply 0"} {
+		dir := t.TempDir()
+		state := filepath.Join(dir, "state")
+
+		c := InitClient(32, 4)
+		err := c.AddServerWith("test", 32, 4, ServerOptions{Backend: BackendSingle, Dir: filepath.Join(dir, "tree")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for a := 0; a < 32; a++ {
+			c.Access("test", true, a, uint64(a))
+		}
+		err = c.Save(state)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = c.RotateKey("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// logged accesses under the new key, then a crash in the sweep
+		for a := 0; a < 32; a += 3 {
+			c.Access("test", true, a, uint64(a*10))
+		}
+		n := 0
+		crash_at = func(p string) bool {
+			if p == point {
+				n += 1
+				return n == 2
+			}
+			return false
+		}
+		err = c.FinishRotation("test")
+		crash_at = nil
+		if !errors.Is(err, err_crash) {
+			t.Fatalf("%s: expected a crash, got %v", point, err)
+		}
+
+		c2, err := LoadClient(state)
+		if err != nil {
+			t.Fatalf("%s: %v", point, err)
+		}
+		if k := c2.keys["test"]; k.epoch != 1 || k.fresh == nil {
+			t.Errorf("%s: loaded epoch %d, rotating %v", point, k.epoch, k.fresh != nil)
+		}
+		err = c2.FinishRotation("test")
+		if err != nil {
+			t.Fatalf("%s: %v", point, err)
+		}
+		for a := 0; a < 32; a++ {
+			want := uint64(a)
+			if a%3 == 0 {
+				want = uint64(a * 10)
+			}
+			v, err := c2.Access("test", false, a, 0)
+			if err != nil || v != want {
+				t.Errorf("%s: block %d: got %d, want %d (%v)", point, a, v, want, err)
+			}
+		}
+		c2.RemoveServer("test")
+	}
+}
+
+// a bucket that fails to decrypt stops the sweep where it was, so the
+// buckets of its batch aren't skipped
+func Test_keys_sweep_error(t *testing.T) {
+	c := InitClient(64, 4)
+	err := c.AddServerWith("test", 64, 4, ServerOptions{Format: FormatCompact, Dir: filepath.Join(t.TempDir(), "tree")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.RemoveServer("test")
+	for a := 0; a < 64; a++ {
+		c.Access("test", true, a, uint64(a))
+	}
+
+	s := c.servers["test"]
+	good, err := s.read_node(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := make(Bucket, len(good))
+	for i := range good {
+		bad[i] = append(Block(nil), good[i]...)
+	}
+	bad[0][len(bad[0])-1] ^= 1
+	s.write_node(bad, 0, 0)
+
+	err = c.RotateKey("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.FinishRotation("test") == nil {
+		t.Fatal("swept a corrupt bucket")
+	}
+	if c.keys["test"].cursor != 0 {
+		t.Errorf("cursor at %d after the first batch failed", c.keys["test"].cursor)
+	}
+
+	s.write_node(good, 0, 0)
+	err = c.FinishRotation("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for a := 0; a < 64; a++ {
+		v, err := c.Access("test", false, a, 0)
+		if err != nil || v != uint64(a) {
+			t.Errorf("block %d: got %d, want %d (%v)", a, v, a, err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+/*
+ * Bucket layouts for the single file backend
+ *
+ * The tree is cut into bands of k levels and each band into subtrees of
+ * height k, which are stored contiguously, each in heap order. Bands follow
+ * each other from the root down, and so do the subtrees of a band from left
+ * to right. A path then crosses about (L+1)/k subtrees, so reading it touches
+ * that many regions of the file instead of L+1 (Ren et al., "Design space
+ * exploration and optimization of path oblivious RAM in secure processors").
+ *
+ * With k = 1 every subtree is a single bucket and the layout is plain heap
+ * order, which is also what k = L+1 gives.
+ */
+
+package oram2pc
+
+type layout struct {
+	L     int
+	k     int     // levels per subtree
+	bands []int64 // first slot of each band
+}
+
+func new_layout(L int, k int) layout {
+	if k <= 0 || k > L+1 {
+		k = 1
+	}
+
+	lo := layout{L: L, k: k}
+	var slot int64
+	for top := 0; top <= L; top += k {
+		lo.bands = append(lo.bands, slot)
+		slot += int64(1<<uint(top)) * int64(lo.subtree_size(top))
+	}
+
+	return lo
+}
+
+// buckets in each subtree of the band starting at level top
+func (lo layout) subtree_size(top int) int {
+	h := lo.k
+	if top+h > lo.L+1 {
+		h = lo.L + 1 - top
+	}
+
+	return (1 << uint(h)) - 1
+}
+
+// the first slot of the subtree holding node n of level l
+func (lo layout) region(l int, n int) int64 {
+	top := l - l%lo.k
+	root := n >> uint(l-top)
+
+	return lo.bands[l/lo.k] + int64(root)*int64(lo.subtree_size(top))
+}
+
+// the slot of node n of level l
+func (lo layout) slot(l int, n int) int64 {
+	d := l % lo.k
+	local := (1 << uint(d)) - 1 + n&((1<<uint(d))-1)
+
+	return lo.region(l, n) + int64(local)
+}
@@ -0,0 +1,146 @@
+package oram2pc
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func Test_layout(t *testing.T) {
+	for L := 0; L <= 10; L++ {
+		for k := 0; k <= L+2; k++ {
+			lo := new_layout(L, k)
+
+			// every bucket gets its own slot
+			seen := make(map[int64]bool)
+			for l := 0; l <= L; l++ {
+				for n := 0; n < 1<<uint(l); n++ {
+					i := lo.slot(l, n)
+					if i < 0 || i >= int64(1<<uint(L+1))-1 || seen[i] {
+						t.Fatalf("L=%d k=%d: node %d of level %d in slot %d", L, k, n, l, i)
+					}
+					seen[i] = true
+
+					// and it's inside its subtree
+					r := lo.region(l, n)
+					if i < r || i >= r+int64(lo.subtree_size(l-l%lo.k)) {
+						t.Fatalf("L=%d k=%d: node %d of level %d outside its subtree", L, k, n, l)
+					}
+				}
+			}
+
+			// a path crosses one subtree per band
+			regions := make(map[int64]bool)
+			for l := 0; l <= L; l++ {
+				regions[lo.region(l, (1<<uint(L)-1)>>uint(L-l))] = true
+			}
+			if len(regions) != len(lo.bands) || len(lo.bands) != (L+lo.k)/lo.k {
+				t.Errorf("L=%d k=%d: path crosses %d subtrees in %d bands", L, k, len(regions), len(lo.bands))
+			}
+		}
+	}
+
+	// k = 1 is heap order
+	lo := new_layout(5, 1)
+	for l := 0; l <= 5; l++ {
+		for n := 0; n < 1<<uint(l); n++ {
+			if lo.slot(l, n) != int64(1<<uint(l))-1+int64(n) {
+				t.Fatalf("node %d of level %d not in heap order", n, l)
+			}
+		}
+	}
+}
+
+func Test_subtree_backend(t *testing.T) {
+	single_file_roundtrip(t, ServerOptions{Backend: BackendSingle, Subtree: 3})
+
+	// reading a path touches one region per band of 3 levels
+	c := backend_client(t, 1024, ServerOptions{Backend: BackendSingle, Subtree: 3, Dir: filepath.Join(t.TempDir(), "tree")})
+	defer c.RemoveServer("test")
+	s := c.servers["test"]
+
+	before := s.io.Seeks
+	_, err := s.get_path_buckets(517)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seeks := s.io.Seeks - before; seeks != int64((s.L+3)/3) {
+		t.Errorf("path read of L=%d took %d seeks", s.L, seeks)
+	}
+}
+
+// writes take a seek per run of adjacent slots
+func Test_single_write_seeks(t *testing.T) {
+	c := backend_client(t, 64, ServerOptions{Backend: BackendSingle, Dir: filepath.Join(t.TempDir(), "tree")})
+	defer c.RemoveServer("test")
+	s := c.servers["test"]
+
+	// in heap order the path to leaf 0 is in slots 0, 1, 3, 7...
+	path, _ := s.get_path(0)
+	nodes := make([]node, len(path))
+	for l := range path {
+		nodes[l] = node{l, path[l]}
+	}
+	bux, err := s.read_nodes(nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := s.io.Seeks
+	err = s.write_nodes(nodes, bux)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seeks := s.io.Seeks - before; seeks != int64(s.L) {
+		t.Errorf("path write of L=%d took %d seeks", s.L, seeks)
+	}
+}
+
+// path reads and accesses on each layout, reporting seeks
+func bench_layout(b *testing.B, opts ServerOptions, write bool) {
+	N := 1 << 14
+	c := backend_client(b, N, opts)
+	defer c.RemoveServer("test")
+	s := c.servers["test"]
+
+	before := s.io.Seeks
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		var err error
+		if write {
+			_, err = c.Access("test", true, gen_int(N), uint64(n))
+		} else {
+			_, err = s.get_path_buckets(gen_int(N))
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(s.io.Seeks-before)/float64(b.N), "seeks/op")
+}
+
+func Benchmark_layout_read_files(b *testing.B) {
+	bench_layout(b, ServerOptions{Backend: BackendFiles}, false)
+}
+
+func Benchmark_layout_read_heap(b *testing.B) {
+	bench_layout(b, ServerOptions{Backend: BackendSingle}, false)
+}
+
+func Benchmark_layout_read_subtree3(b *testing.B) {
+	bench_layout(b, ServerOptions{Backend: BackendSingle, Subtree: 3}, false)
+}
+
+func Benchmark_layout_read_subtree5(b *testing.B) {
+	bench_layout(b, ServerOptions{Backend: BackendSingle, Subtree: 5}, false)
+}
+
+func Benchmark_layout_access_files(b *testing.B) {
+	bench_layout(b, ServerOptions{Backend: BackendFiles}, true)
+}
+
+func Benchmark_layout_access_heap(b *testing.B) {
+	bench_layout(b, ServerOptions{Backend: BackendSingle}, true)
+}
+
+func Benchmark_layout_access_subtree3(b *testing.B) {
+	bench_layout(b, ServerOptions{Backend: BackendSingle, Subtree: 3}, true)
+}
@@ -0,0 +1,168 @@
+package oram2pc
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// writes every block of a fresh tree and reads it all back
+func leaves_roundtrip(t *testing.T, N int, Z int, opts ServerOptions) *Client {
+	c := InitClient(N, Z)
+	opts.Dir = filepath.Join(t.TempDir(), "tree")
+	err := c.AddServerWith("test", N, Z, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.RemoveServer("test") })
+
+	for a := 0; a < N; a++ {
+		_, err := c.Access("test", true, a, uint64(a*N+1))
+		if err != nil {
+			t.Fatalf("N=%d leaves=%d: write %d: %v", N, opts.Leaves, a, err)
+		}
+	}
+	for a := 0; a < N; a++ {
+		v, err := c.Access("test", false, a, 0)
+		if err != nil || v != uint64(a*N+1) {
+			t.Fatalf("N=%d leaves=%d: block %d: got %d, want %d (%v)", N, opts.Leaves, a, v, a*N+1, err)
+		}
+	}
+
+	return c
+}
+
+func Test_leaves_any_N(t *testing.T) {
+	for _, N := range []int{1, 2, 3, 5, 6, 7, 9, 15, 17, 31, 33, 63, 65, 100} {
+		c := leaves_roundtrip(t, N, 4, ServerOptions{})
+		s := c.servers["test"]
+		if s.leaves != 1<<uint(ceil_log2(N)) || s.leaves < N {
+			t.Errorf("N=%d: %d leaves", N, s.leaves)
+		}
+	}
+}
+
+func Test_leaves_sparse(t *testing.T) {
+	backends := []ServerOptions{{}, {Backend: BackendSingle}, {Backend: BackendSingle, Subtree: 2}}
+	for _, opts := range backends {
+		for _, N := range []int{10, 33} {
+			for _, leaves := range []int{1, 3, 5, 8, N / 2} {
+				opts.Leaves = leaves
+				c := leaves_roundtrip(t, N, SparseZ(N, leaves, 2), opts)
+
+				st, err := c.Stats("test")
+				if err != nil || st.TreeBlocks+st.StashBlocks != N || st.Leaves != leaves {
+					t.Errorf("%v N=%d leaves=%d: stats %+v, %v", opts.Backend, N, leaves, st, err)
+				}
+				s := c.servers["test"]
+				if st.Buckets != s.buckets() || st.L != ceil_log2(leaves) {
+					t.Errorf("%v N=%d leaves=%d: %d buckets, L=%d", opts.Backend, N, leaves, st.Buckets, st.L)
+				}
+			}
+		}
+	}
+}
+
+func Test_leaves_paths(t *testing.T) {
+	s := init_server(100, 4, 4096)
+	s.set_leaves(11)
+
+	if s.L != 4 || s.buckets() != 11+6+3+2+1 {
+		t.Fatalf("L=%d, %d buckets", s.L, s.buckets())
+	}
+	for x := 0; x < 11; x++ {
+		path, err := s.get_path(x)
+		if err != nil || path[s.L] != x || path[0] != 0 {
+			t.Errorf("leaf %d: %v %v", x, path, err)
+		}
+		for l, n := range path {
+			if s.check_node(l, n) != nil {
+				t.Errorf("leaf %d: node %d on level %d doesn't exist", x, n, l)
+			}
+		}
+	}
+	for _, x := range []int{-1, 11, 16, 100} {
+		_, err := s.get_path(x)
+		if !errors.Is(err, ErrOutOfRange) {
+			t.Errorf("leaf %d: expected ErrOutOfRange, got %v", x, err)
+		}
+	}
+}
+
+func Test_leaves_persist(t *testing.T) {
+	N, leaves := 40, 6
+	c := leaves_roundtrip(t, N, SparseZ(N, leaves, 2), ServerOptions{Leaves: leaves})
+
+	state := filepath.Join(t.TempDir(), "state")
+	err := c.Save(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	c2, err := LoadClient(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	if c2.servers["test"].leaves != leaves {
+		t.Fatalf("%d leaves after load", c2.servers["test"].leaves)
+	}
+	for a := 0; a < N; a++ {
+		v, err := c2.Access("test", false, a, 0)
+		if err != nil || v != uint64(a*N+1) {
+			t.Errorf("block %d after load: got %d (%v)", a, v, err)
+		}
+	}
+}
+
+// servers with different leaves keep their own positions for the same ids
+func Test_leaves_two_servers(t *testing.T) {
+	dir := t.TempDir()
+	state := filepath.Join(dir, "state")
+	c := InitClient(64, 4)
+	for name, leaves := range map[string]int{"a": 0, "b": 16} {
+		err := c.AddServerWith(name, 64, SparseZ(64, leaves, 4), ServerOptions{Leaves: leaves, Dir: filepath.Join(dir, name)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.RemoveServer(name)
+	}
+
+	for _, name := range []string{"a", "b"} {
+		for a := 0; a < 64; a++ {
+			_, err := c.Access(name, true, a, uint64(a)+uint64(name[0])<<32)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	check := func(c *Client) {
+		for _, name := range []string{"a", "b"} {
+			for a := 0; a < 64; a++ {
+				v, err := c.Access(name, false, a, 0)
+				if err != nil || v != uint64(a)+uint64(name[0])<<32 {
+					t.Fatalf("%s: block %d: got %x (%v)", name, a, v, err)
+				}
+			}
+		}
+	}
+	check(c)
+
+	err := c.Save(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := LoadClient(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(c2)
+
+	// a leaf past the last of the tree is an error, not a fresh start
+	c2.pos["b"][3] = 16
+	if _, err := c2.Access("b", false, 3, 0); !errors.Is(err, ErrOutOfRange) {
+		t.Errorf("block on leaf 16 of 16: %v", err)
+	}
+}
@@ -0,0 +1,270 @@
+/*
+ * Metrics hooks, a Prometheus exporter and logging
+ *
+ * Nothing is printed or recorded unless a Metrics or a logger is set.
+ */
+
+package oram2pc
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+ * What one access to a server's tree did, split into its phases
+ */
+type AccessMetrics struct {
+	Read         time.Duration // reading the path from the server
+	Decrypt      time.Duration // decrypting the path into the stash
+	Stash        time.Duration // the operation on the stash
+	Write        time.Duration // eviction, encryption and write back
+	BytesRead    int64
+	BytesWritten int64
+	StashSize    int // real blocks left in the stash afterwards
+	Evicted      int // real blocks written back to the path
+}
+
+func (m AccessMetrics) Total() time.Duration {
+	return m.Read + m.Decrypt + m.Stash + m.Write
+}
+
+// kinds of I/O reported by a server
+const (
+	IORead  = "read"
+	IOWrite = "write"
+	IOSync  = "fsync"
+)
+
+/*
+ * Receives metrics from a Client and its servers
+ *
+ * ObserveAccess is called once per path access by the client, and once
+ * per read or write of a write-only server (see writeonly.go), ObserveIO by
+ * a server for every bucket it reads or writes and every fsync. Both may be
+ * called from several goroutines.
+ */
+type Metrics interface {
+	ObserveAccess(server string, m AccessMetrics)
+	ObserveIO(server string, op string, bytes int, d time.Duration)
+}
+
+type nop_metrics struct{}
+
+func (nop_metrics) ObserveAccess(string, AccessMetrics)          {}
+func (nop_metrics) ObserveIO(string, string, int, time.Duration) {}
+
+// sets the metrics hook of the client and every server it has
+func (c *Client) SetMetrics(m Metrics) {
+	if m == nil {
+		m = nop_metrics{}
+	}
+	c.settle_all()
+
+	c.metrics = m
+	for name, s := range c.servers {
+		s.name = name
+		s.metrics = m
+	}
+}
+
+// package-wide logger for code that has no client, discards by default
+var logger = slog.New(slog.DiscardHandler)
+
+func SetLogger(l *slog.Logger) {
+	if l == nil {
+		l = slog.New(slog.DiscardHandler)
+	}
+
+	logger = l
+}
+
+// the client's logger, or the package one if it has none
+func (c *Client) log() *slog.Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+
+	return logger
+}
+
+// upper bounds of the latency histogram buckets, in seconds
+var prom_buckets = []float64{0.0001, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+type prom_server struct {
+	accesses      int64
+	phases        map[string]float64 // seconds spent in each phase
+	hist          []int64            // access latency histogram, one per bucket
+	latency_sum   float64
+	bytes_read    int64
+	bytes_written int64
+	evicted       int64
+	stash         int
+	io_ops        map[string]int64
+	io_seconds    map[string]float64
+	io_bytes      map[string]int64
+}
+
+/*
+ * Metrics that aggregates everything in memory and exposes it in the
+ * Prometheus text format, either with WriteTo or as an http.Handler
+ */
+type PromMetrics struct {
+	mu      sync.Mutex
+	servers map[string]*prom_server
+}
+
+func NewPromMetrics() *PromMetrics {
+	return &PromMetrics{servers: make(map[string]*prom_server)}
+}
+
+func (p *PromMetrics) server(name string) *prom_server {
+	ps, prs := p.servers[name]
+	if prs == false {
+		ps = &prom_server{phases: make(map[string]float64), hist: make([]int64, len(prom_buckets)),
+			io_ops: make(map[string]int64), io_seconds: make(map[string]float64), io_bytes: make(map[string]int64)}
+		p.servers[name] = ps
+	}
+
+	return ps
+}
+
+func (p *PromMetrics) ObserveAccess(server string, m AccessMetrics) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ps := p.server(server)
+	ps.accesses += 1
+	ps.phases["read"] += m.Read.Seconds()
+	ps.phases["decrypt"] += m.Decrypt.Seconds()
+	ps.phases["stash"] += m.Stash.Seconds()
+	ps.phases["write"] += m.Write.Seconds()
+	ps.bytes_read += m.BytesRead
+	ps.bytes_written += m.BytesWritten
+	ps.evicted += int64(m.Evicted)
+	ps.stash = m.StashSize
+
+	total := m.Total().Seconds()
+	ps.latency_sum += total
+	for i, le := range prom_buckets {
+		if total <= le {
+			ps.hist[i] += 1
+		}
+	}
+}
+
+func (p *PromMetrics) ObserveIO(server string, op string, bytes int, d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ps := p.server(server)
+	ps.io_ops[op] += 1
+	ps.io_seconds[op] += d.Seconds()
+	ps.io_bytes[op] += int64(bytes)
+}
+
+func sorted_keys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// writes all metrics in the Prometheus text exposition format
+func (p *PromMetrics) WriteTo(w io.Writer) (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var n int64
+	var err error
+	out := func(format string, args ...any) {
+		if err != nil {
+			return
+		}
+		var k int
+		k, err = fmt.Fprintf(w, format, args...)
+		n += int64(k)
+	}
+
+	names := sorted_keys(p.servers)
+
+	out("# HELP oram_accesses_total Path accesses done by the client.\n# TYPE oram_accesses_total counter\n")
+	for _, s := range names {
+		out("oram_accesses_total{server=%q} %d\n", s, p.servers[s].accesses)
+	}
+
+	out("# HELP oram_access_duration_seconds Latency of a path access.\n# TYPE oram_access_duration_seconds histogram\n")
+	for _, s := range names {
+		ps := p.servers[s]
+		for i, le := range prom_buckets {
+			out("oram_access_duration_seconds_bucket{server=%q,le=\"%g\"} %d\n", s, le, ps.hist[i])
+		}
+		out("oram_access_duration_seconds_bucket{server=%q,le=\"+Inf\"} %d\n", s, ps.accesses)
+		out("oram_access_duration_seconds_sum{server=%q} %g\n", s, ps.latency_sum)
+		out("oram_access_duration_seconds_count{server=%q} %d\n", s, ps.accesses)
+	}
+
+	out("# HELP oram_access_phase_seconds_total Time spent in each phase of an access.\n# TYPE oram_access_phase_seconds_total counter\n")
+	for _, s := range names {
+		for _, ph := range sorted_keys(p.servers[s].phases) {
+			out("oram_access_phase_seconds_total{server=%q,phase=%q} %g\n", s, ph, p.servers[s].phases[ph])
+		}
+	}
+
+	out("# HELP oram_bytes_read_total Bytes of buckets read by accesses.\n# TYPE oram_bytes_read_total counter\n")
+	for _, s := range names {
+		out("oram_bytes_read_total{server=%q} %d\n", s, p.servers[s].bytes_read)
+	}
+
+	out("# HELP oram_bytes_written_total Bytes of buckets written by accesses.\n# TYPE oram_bytes_written_total counter\n")
+	for _, s := range names {
+		out("oram_bytes_written_total{server=%q} %d\n", s, p.servers[s].bytes_written)
+	}
+
+	out("# HELP oram_evicted_blocks_total Real blocks evicted from the stash.\n# TYPE oram_evicted_blocks_total counter\n")
+	for _, s := range names {
+		out("oram_evicted_blocks_total{server=%q} %d\n", s, p.servers[s].evicted)
+	}
+
+	out("# HELP oram_stash_blocks Real blocks in the stash after the last access.\n# TYPE oram_stash_blocks gauge\n")
+	for _, s := range names {
+		out("oram_stash_blocks{server=%q} %d\n", s, p.servers[s].stash)
+	}
+
+	out("# HELP oram_io_ops_total Storage operations done by the server.\n# TYPE oram_io_ops_total counter\n")
+	for _, s := range names {
+		for _, op := range sorted_keys(p.servers[s].io_ops) {
+			out("oram_io_ops_total{server=%q,op=%q} %d\n", s, op, p.servers[s].io_ops[op])
+		}
+	}
+
+	out("# HELP oram_io_seconds_total Time spent in storage operations.\n# TYPE oram_io_seconds_total counter\n")
+	for _, s := range names {
+		for _, op := range sorted_keys(p.servers[s].io_seconds) {
+			out("oram_io_seconds_total{server=%q,op=%q} %g\n", s, op, p.servers[s].io_seconds[op])
+		}
+	}
+
+	out("# HELP oram_io_bytes_total Bytes moved by storage operations.\n# TYPE oram_io_bytes_total counter\n")
+	for _, s := range names {
+		for _, op := range sorted_keys(p.servers[s].io_bytes) {
+			out("oram_io_bytes_total{server=%q,op=%q} %d\n", s, op, p.servers[s].io_bytes[op])
+		}
+	}
+
+	return n, err
+}
+
+// serves the metrics, e.g. on /metrics
+func (p *PromMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	p.WriteTo(w)
+}
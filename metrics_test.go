@@ -0,0 +1,114 @@
+package oram2pc
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type record_metrics struct {
+	mu       sync.Mutex
+	accesses []AccessMetrics
+	io       map[string]int
+}
+
+func (r *record_metrics) ObserveAccess(server string, m AccessMetrics) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.accesses = append(r.accesses, m)
+}
+
+func (r *record_metrics) ObserveIO(server string, op string, bytes int, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.io[op] += 1
+}
+
+func Test_metrics(t *testing.T) {
+	c := InitClient(16, 4)
+	err := c.AddServer("test", 16, 4, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.RemoveServer("test")
+
+	rec := &record_metrics{io: make(map[string]int)}
+	c.SetMetrics(rec)
+
+	var logs bytes.Buffer
+	c.Logger = slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	for a := 0; a < 16; a++ {
+		c.Access("test", true, a, uint64(a))
+	}
+
+	if len(rec.accesses) != 16 {
+		t.Fatalf("got %d access observations, want 16", len(rec.accesses))
+	}
+
+	path_bytes := int64((c.L + 1) * 4 * 32)
+	for _, m := range rec.accesses {
+		if m.BytesRead != path_bytes || m.BytesWritten != path_bytes {
+			t.Errorf("access moved %d/%d bytes, want %d", m.BytesRead, m.BytesWritten, path_bytes)
+		}
+		if m.Total() <= 0 {
+			t.Error("access took no time")
+		}
+	}
+	last := rec.accesses[15]
+	if last.StashSize != c.StashSize("test") {
+		t.Errorf("stash size %d, want %d", last.StashSize, c.StashSize("test"))
+	}
+
+	levels := 16 * (c.L + 1)
+	if rec.io[IORead] != levels || rec.io[IOWrite] != levels || rec.io[IOSync] != levels {
+		t.Errorf("io ops: got %v, want %d each", rec.io, levels)
+	}
+
+	// every block written is either evicted to the tree or left in the stash
+	st, _ := c.Stats("test")
+	if st.TreeBlocks+st.StashBlocks != 16 || last.Evicted > st.TreeBlocks {
+		t.Errorf("evicted %d, tree holds %d", last.Evicted, st.TreeBlocks)
+	}
+
+	if strings.Count(logs.String(), "oram access") != 16 {
+		t.Errorf("expected 16 debug log lines, got:\n%s", logs.String())
+	}
+}
+
+func Test_prom_metrics(t *testing.T) {
+	c := InitClient(16, 4)
+	err := c.AddServer("test", 16, 4, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.RemoveServer("test")
+
+	p := NewPromMetrics()
+	c.SetMetrics(p)
+	for a := 0; a < 8; a++ {
+		c.Access("test", false, a, 0)
+	}
+
+	var buf bytes.Buffer
+	_, err = p.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	for _, want := range []string{
+		`oram_accesses_total{server="test"} 8`,
+		`oram_access_duration_seconds_count{server="test"} 8`,
+		`oram_access_phase_seconds_total{server="test",phase="decrypt"}`,
+		`oram_io_ops_total{server="test",op="fsync"}`,
+		"# TYPE oram_stash_blocks gauge",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+/*
+ * Object store: named byte strings chunked across many blocks
+ *
+ * An object is cut into chunks of one block value each, in blocks taken
+ * from a region of a server. The free blocks of the region are kept in an
+ * oblivious Stack (see ods.go) in a tree of its own, named after the server
+ * with ".free" appended, so allocating and freeing doesn't show which
+ * blocks are in use.
+ *
+ * Every access to an object, put, get or delete, does the same thing
+ * whatever the object and its size:
+ *
+ *   MaxChunks free list operations, allocating its new blocks
+ *   MaxChunks accesses to data blocks
+ *   MaxChunks free list operations, freeing its old ones
+ *
+ * padding with dummy stack operations and reads of random blocks of the
+ * region. Blocks are only freed once nothing needs them, and blocks that
+ * couldn't be pushed on the free list wait for the next access's free list
+ * operations, so a failed access doesn't lose any.
+ *
+ * The directory of names, sizes and chunks stays in the client's memory,
+ * like the entry points of the structures in ods.go, so an object store
+ * doesn't survive Save and LoadClient: its blocks and free list do, but
+ * there's no way back to them. Use a VFS (see vfs.go) for data that has
+ * to outlive the client.
+ */
+
+package oram2pc
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+type ObjectOptions struct {
+	Base      int // first block of the region on the server
+	Blocks    int // blocks in the region, one chunk each
+	MaxChunks int // chunks of the largest object, every access is padded to it
+}
+
+type ObjectStore struct {
+	c      *Client
+	server string
+	opts   ObjectOptions
+
+	free    *Stack
+	unfreed []int // blocks to push on the free list, oldest first
+	objects map[string]*object
+}
+
+// where an object is
+type object struct {
+	size   int
+	chunks []int
+}
+
+func NewObjectStore(c *Client, server string, opts ObjectOptions) (*ObjectStore, error) {
+	_, prs := c.servers[server]
+	if prs == false {
+		return nil, errors.New("No server exists by that name!")
+	}
+	if opts.Blocks < 1 || opts.MaxChunks < 1 {
+		return nil, errors.New("Object store needs at least one block and one chunk per object!")
+	}
+	if opts.Base < 0 || opts.Base+opts.Blocks > c.N {
+		return nil, errors.New("Object store doesn't fit in the client's blocks!")
+	}
+
+	free, err := NewStack(c, server+".free", opts.Blocks)
+	if err != nil {
+		return nil, err
+	}
+	for i := opts.Blocks - 1; i >= 0; i-- {
+		err := free.Push(uint64(opts.Base + i))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &ObjectStore{c: c, server: server, opts: opts, free: free, objects: make(map[string]*object)}, nil
+}
+
+// size in bytes of the largest object
+func (st *ObjectStore) MaxSize() int {
+	return st.opts.MaxChunks * block_payload
+}
+
+// chunks not used by any object
+func (st *ObjectStore) FreeChunks() int {
+	return st.free.Len() + len(st.unfreed)
+}
+
+// names of the objects, sorted
+func (st *ObjectStore) Names() []string {
+	names := make([]string, 0, len(st.objects))
+	for name := range st.objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// size in bytes of an object
+func (st *ObjectStore) Size(name string) (int, error) {
+	obj, prs := st.objects[name]
+	if prs == false {
+		return 0, ErrNotFound
+	}
+
+	return obj.size, nil
+}
+
+// a stack operation that does nothing, two accesses like Push and Pop
+func (st *ObjectStore) dummy_op() error {
+	return st.free.o.dummies(2)
+}
+
+/*
+ * Pushes chunks back on the free list after any left from before, padded
+ * to MaxChunks operations. Those that don't make it are left for the next
+ * release.
+ */
+func (st *ObjectStore) release(chunks []int) error {
+	st.unfreed = append(st.unfreed, chunks...)
+	for i := 0; i < st.opts.MaxChunks; i++ {
+		var err error
+		if len(st.unfreed) > 0 {
+			err = st.free.Push(uint64(st.unfreed[0]))
+			if err == nil {
+				st.unfreed = st.unfreed[1:]
+			}
+		} else {
+			err = st.dummy_op()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+ * Pops n chunks off the free list, padded to MaxChunks operations. On
+ * failure the chunks popped so far are left for the next release.
+ */
+func (st *ObjectStore) allocate(n int) ([]int, error) {
+	chunks := make([]int, 0, n)
+	for i := 0; i < st.opts.MaxChunks; i++ {
+		if i < n {
+			v, err := st.free.Pop()
+			if err != nil {
+				st.unfreed = append(st.unfreed, chunks...)
+				return nil, err
+			}
+			chunks = append(chunks, int(v))
+		} else {
+			err := st.dummy_op()
+			if err != nil {
+				st.unfreed = append(st.unfreed, chunks...)
+				return nil, err
+			}
+		}
+	}
+
+	return chunks, nil
+}
+
+/*
+ * Reads, or writes data to, the chunks of an object, then reads random
+ * blocks of the region up to MaxChunks accesses
+ */
+func (st *ObjectStore) access_chunks(chunks []int, write bool, data []byte) ([]byte, error) {
+	buf := make([]byte, len(chunks)*block_payload)
+	copy(buf, data)
+	for i := 0; i < st.opts.MaxChunks; i++ {
+		if i >= len(chunks) {
+			a := st.opts.Base + gen_int(st.opts.Blocks)
+			_, err := st.c.Access(st.server, false, a, 0)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		chunk := buf[i*block_payload : (i+1)*block_payload]
+		v, err := st.c.Access(st.server, write, chunks[i], binary.LittleEndian.Uint64(chunk))
+		if err != nil {
+			return nil, err
+		}
+		binary.LittleEndian.PutUint64(chunk, v)
+	}
+
+	return buf, nil
+}
+
+/*
+ * Stores data under name, replacing the object there was. Fails before
+ * touching anything if data is larger than MaxSize or doesn't fit in the
+ * free chunks.
+ *
+ * The new object goes in free chunks, so the old one is still there if
+ * this fails. Only when there aren't enough does it reuse the old
+ * object's chunks, so an object can be replaced by one of about the same
+ * size in a full store, and then a failed write loses the old object.
+ */
+func (st *ObjectStore) PutObject(name string, data []byte) error {
+	if len(data) > st.MaxSize() {
+		return errors.New("Object is larger than the maximum size!")
+	}
+	n := (len(data) + block_payload - 1) / block_payload
+	old, prs := st.objects[name]
+	if prs == false {
+		old = &object{}
+	}
+	if n > st.free.Len()+len(old.chunks) {
+		return errors.New("Object store is full!")
+	}
+
+	chunks, err := st.allocate(min(n, st.free.Len()))
+	if err != nil {
+		return err
+	}
+	reused := n - len(chunks)
+	chunks = append(chunks, old.chunks[:reused]...)
+	_, err = st.access_chunks(chunks, true, data)
+	if err != nil {
+		if reused > 0 {
+			delete(st.objects, name)
+			st.unfreed = append(st.unfreed, old.chunks...)
+		}
+		st.unfreed = append(st.unfreed, chunks[:n-reused]...)
+		return err
+	}
+	st.objects[name] = &object{size: len(data), chunks: chunks}
+
+	return st.release(old.chunks[reused:])
+}
+
+func (st *ObjectStore) GetObject(name string) ([]byte, error) {
+	obj, prs := st.objects[name]
+	if prs == false {
+		obj = &object{}
+	}
+
+	_, err := st.allocate(0)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := st.access_chunks(obj.chunks, false, nil)
+	if err == nil {
+		err = st.release(nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// a missing object costs as much as any other
+	if prs == false {
+		return nil, ErrNotFound
+	}
+
+	return buf[:obj.size], nil
+}
+
+func (st *ObjectStore) DeleteObject(name string) error {
+	obj, prs := st.objects[name]
+	if prs == false {
+		obj = &object{}
+	}
+
+	_, err := st.allocate(0)
+	if err == nil {
+		_, err = st.access_chunks(nil, false, nil)
+	}
+	if err != nil {
+		return err
+	}
+	delete(st.objects, name)
+	err = st.release(obj.chunks)
+	if err != nil {
+		return err
+	}
+
+	if prs == false {
+		return ErrNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,208 @@
+package oram2pc
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func Test_object(t *testing.T) {
+	c := InitClient(256, 4)
+	c.AddServer("test", 256, 4, 4096)
+	defer c.RemoveServer("test")
+	defer c.RemoveServer("test.free")
+
+	st, err := NewObjectStore(c, "test", ObjectOptions{Base: 16, Blocks: 40, MaxChunks: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	model := make(map[string][]byte)
+	names := []string{"a", "b", "c", "d", "e"}
+	for i := 0; i < 60; i++ {
+		name := names[rng.Intn(len(names))]
+		switch rng.Intn(3) {
+		case 0:
+			data := make([]byte, rng.Intn(st.MaxSize()+1))
+			rng.Read(data)
+			err := st.PutObject(name, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			model[name] = data
+		case 1:
+			data, err := st.GetObject(name)
+			want, prs := model[name]
+			if prs == false && !errors.Is(err, ErrNotFound) || prs == true && (err != nil || !bytes.Equal(data, want)) {
+				t.Fatalf("get %s: got %d bytes (%v), want %d", name, len(data), err, len(want))
+			}
+		case 2:
+			err := st.DeleteObject(name)
+			_, prs := model[name]
+			if prs == false && !errors.Is(err, ErrNotFound) || prs == true && err != nil {
+				t.Fatalf("delete %s: %v", name, err)
+			}
+			delete(model, name)
+		}
+	}
+
+	// every chunk is either free or in exactly one object
+	used := 0
+	for _, name := range st.Names() {
+		size, _ := st.Size(name)
+		used += (size + 7) / 8
+	}
+	if len(st.Names()) != len(model) || used+st.FreeChunks() != 40 {
+		t.Errorf("%d objects using %d chunks, %d free", len(st.Names()), used, st.FreeChunks())
+	}
+
+	if st.PutObject("big", make([]byte, st.MaxSize()+1)) == nil {
+		t.Error("put an object larger than the maximum")
+	}
+}
+
+func Test_object_full(t *testing.T) {
+	c := InitClient(64, 4)
+	c.AddServer("test", 64, 4, 4096)
+	defer c.RemoveServer("test")
+	defer c.RemoveServer("test.free")
+
+	st, err := NewObjectStore(c, "test", ObjectOptions{Blocks: 8, MaxChunks: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.PutObject("a", make([]byte, 40))
+	if err := st.PutObject("b", make([]byte, 40)); err == nil {
+		t.Error("put 10 chunks in a store of 8")
+	}
+	// replacing an object can reuse its own chunks
+	if err := st.PutObject("a", bytes.Repeat([]byte{1}, 37)); err != nil {
+		t.Error(err)
+	}
+	if data, _ := st.GetObject("a"); !bytes.Equal(data, bytes.Repeat([]byte{1}, 37)) {
+		t.Errorf("replaced object: got %v", data)
+	}
+	if _, err := NewObjectStore(c, "test", ObjectOptions{Base: 60, Blocks: 8, MaxChunks: 1}); err == nil {
+		t.Error("made a store past the client's blocks")
+	}
+}
+
+// puts, gets and deletes of any size read and write the same
+func Test_object_padding(t *testing.T) {
+	c := InitClient(128, 4)
+	c.AddServer("test", 128, 4, 4096)
+	defer c.RemoveServer("test")
+	defer c.RemoveServer("test.free")
+
+	st, err := NewObjectStore(c, "test", ObjectOptions{Blocks: 64, MaxChunks: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ops := map[string]func() error{
+		"put empty": func() error { return st.PutObject("a", nil) },
+		"put small": func() error { return st.PutObject("b", []byte("hi")) },
+		"put full":  func() error { return st.PutObject("c", make([]byte, 64)) },
+		"replace":   func() error { return st.PutObject("c", make([]byte, 20)) },
+		"get":       func() error { _, err := st.GetObject("c"); return err },
+		"get empty": func() error { _, err := st.GetObject("a"); return err },
+		"delete":    func() error { return st.DeleteObject("b") },
+		"missing":   func() error { st.GetObject("nope"); return nil },
+	}
+	var want IOStats
+	for _, op := range []string{"put empty", "put small", "put full", "replace", "get", "get empty", "delete", "missing"} {
+		data, free := c.ServerIO("test"), c.ServerIO("test.free")
+		err := ops[op]()
+		if err != nil {
+			t.Fatal(op, err)
+		}
+		io := IOStats{
+			BytesRead:    c.ServerIO("test").BytesRead - data.BytesRead + c.ServerIO("test.free").BytesRead - free.BytesRead,
+			BytesWritten: c.ServerIO("test").BytesWritten - data.BytesWritten + c.ServerIO("test.free").BytesWritten - free.BytesWritten,
+		}
+		if want.BytesRead == 0 {
+			want = io
+		}
+		if io.BytesRead != want.BytesRead || io.BytesWritten != want.BytesWritten {
+			t.Errorf("%s: %+v, want %+v", op, io, want)
+		}
+	}
+}
+
+// a put that fails keeps the old object and loses no chunks
+func Test_object_put_failure(t *testing.T) {
+	c := InitClient(64, 4)
+	c.AddServer("test", 64, 4, 4096)
+	defer c.RemoveServer("test")
+	defer c.RemoveServer("test.free")
+
+	st, err := NewObjectStore(c, "test", ObjectOptions{Blocks: 16, MaxChunks: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = st.PutObject("a", []byte("old object"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := c.servers["test"]
+	dir := s.dir
+	s.dir = dir + ".missing"
+	if err := st.PutObject("a", []byte("a new object")); !errors.Is(err, ErrStorage) {
+		t.Errorf("put with the tree gone: %v", err)
+	}
+	s.dir = dir
+
+	if st.FreeChunks() != 14 {
+		t.Errorf("%d free chunks after a failed put, want 14", st.FreeChunks())
+	}
+	if data, err := st.GetObject("a"); err != nil || string(data) != "old object" {
+		t.Errorf("old object after a failed put: %q (%v)", data, err)
+	}
+	if err := st.PutObject("b", make([]byte, 32)); err != nil {
+		t.Fatal(err)
+	}
+	if st.FreeChunks() != 10 {
+		t.Errorf("%d free chunks, want 10", st.FreeChunks())
+	}
+}
+
+// the free list's tree gets a log next to the state file like any other
+func Test_object_save(t *testing.T) {
+	dir := t.TempDir()
+	c := InitClient(64, 4)
+	err := c.AddServerAt("test", 64, 4, 4096, filepath.Join(dir, "tree"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.RemoveServer("test")
+	defer c.RemoveServer("test.free")
+
+	st, err := NewObjectStore(c, "test", ObjectOptions{Blocks: 16, MaxChunks: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := filepath.Join(dir, "state")
+	err = c.Save(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = st.PutObject("a", []byte("after the save"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := st.GetObject("a"); err != nil || string(data) != "after the save" {
+		t.Errorf("got %q (%v)", data, err)
+	}
+
+	c2, err := LoadClient(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := c2.Servers(); len(names) != 2 || names[0] != "test" || names[1] != "test.free" {
+		t.Errorf("servers after load: %v", names)
+	}
+}
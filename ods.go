@@ -0,0 +1,497 @@
+/*
+ * Oblivious data structures on top of Path ORAM, after Wang et al. (CCS '14)
+ *
+ * Each structure owns its own ORAM tree. A node is a few blocks mapped to
+ * the same leaf, so one path read fetches the whole node. Instead of keeping
+ * a position map, every node stores the leaves of the nodes it points to and
+ * the client only remembers the leaf of the entry point (top, head, root).
+ *
+ * Every operation of a given kind does the same number of ORAM accesses no
+ * matter the data, padding with accesses to random paths where needed. The
+ * number of elements is not hidden.
+ */
+
+package oram2pc
+
+import (
+	"errors"
+	"math/bits"
+	"sort"
+)
+
+// size of the files backing an ODS tree
+const ods_fsize = 4096
+
+type ods struct {
+	c        *Client
+	name     string
+	k        int // blocks per node
+	leaves   int // number of leaves of the tree
+	accesses int // ORAM accesses done so far
+}
+
+// makes a new ORAM tree with room for capacity nodes of k blocks each
+func new_ods(c *Client, name string, capacity int, k int) (*ods, error) {
+	if capacity < 1 {
+		return nil, errors.New("Capacity must be at least 1!")
+	}
+
+	// a leaf per node, a power of two so every leaf is a valid path, and
+	// buckets with room for Z nodes
+	N := next_pow2(2 * capacity * k)
+	leaves := next_pow2(2 * capacity)
+	err := c.AddServerWith(name, N, SparseZ(N, leaves, c.Z), ServerOptions{Fsize: ods_fsize, Leaves: leaves})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ods{c: c, name: name, k: k, leaves: leaves}, nil
+}
+
+func (o *ods) random_leaf() int {
+	return gen_int(o.leaves)
+}
+
+func (o *ods) node_id(n int, j int) int {
+	return n*o.k + j
+}
+
+// reads node n from the path to leaf and takes it out of the tree
+func (o *ods) read(n int, leaf int) ([]uint64, error) {
+	vals := make([]uint64, o.k)
+	found := 1
+	o.accesses += 1
+
+	err := o.c.access_path(o.name, leaf, func(st *stash) error {
+		for j := range vals {
+			var f int
+			vals[j], f = st.take(o.node_id(n, j))
+			found &= f
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if found == 0 {
+		return nil, errors.New("ODS node not found on its path!")
+	}
+
+	return vals, nil
+}
+
+// writes node n mapped to leaf, along a random path
+func (o *ods) write(n int, vals []uint64, leaf int) error {
+	o.accesses += 1
+
+	return o.c.access_path(o.name, o.random_leaf(), func(st *stash) error {
+		for j := range vals {
+			blk := block_encode(o.node_id(n, j), vals[j])
+			block_set_leaf(blk, leaf)
+			err := st.add(blk, 1)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// an access to a random path that doesn't change anything
+func (o *ods) dummy() error {
+	o.accesses += 1
+
+	return o.c.access_path(o.name, o.random_leaf(), func(st *stash) error {
+		return nil
+	})
+}
+
+func (o *ods) dummies(n int) error {
+	for i := 0; i < n; i++ {
+		err := o.dummy()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+ * An oblivious LIFO stack of uint64 values
+ *
+ * Node i holds the i-th element from the bottom and the leaf of node i-1.
+ * Push, Pop and Peek each do two ORAM accesses.
+ */
+type Stack struct {
+	o        *ods
+	capacity int
+	size     int
+	top_leaf int
+}
+
+func NewStack(c *Client, name string, capacity int) (*Stack, error) {
+	o, err := new_ods(c, name, capacity, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Stack{o: o, capacity: capacity}, nil
+}
+
+func (s *Stack) Len() int {
+	return s.size
+}
+
+func (s *Stack) Push(v uint64) error {
+	if s.size == s.capacity {
+		return errors.New("Stack is full!")
+	}
+
+	err := s.o.dummy()
+	if err != nil {
+		return err
+	}
+
+	leaf := s.o.random_leaf()
+	err = s.o.write(s.size, []uint64{v, uint64(s.top_leaf)}, leaf)
+	if err != nil {
+		return err
+	}
+
+	s.top_leaf = leaf
+	s.size += 1
+
+	return nil
+}
+
+func (s *Stack) Pop() (uint64, error) {
+	if s.size == 0 {
+		return 0, errors.New("Stack is empty!")
+	}
+
+	vals, err := s.o.read(s.size-1, s.top_leaf)
+	if err != nil {
+		return 0, err
+	}
+
+	s.top_leaf = int(vals[1])
+	s.size -= 1
+
+	return vals[0], s.o.dummy()
+}
+
+func (s *Stack) Peek() (uint64, error) {
+	if s.size == 0 {
+		return 0, errors.New("Stack is empty!")
+	}
+
+	vals, err := s.o.read(s.size-1, s.top_leaf)
+	if err != nil {
+		return 0, err
+	}
+
+	// put it back somewhere else
+	leaf := s.o.random_leaf()
+	err = s.o.write(s.size-1, vals, leaf)
+	if err != nil {
+		return 0, err
+	}
+	s.top_leaf = leaf
+
+	return vals[0], nil
+}
+
+/*
+ * An oblivious FIFO queue of uint64 values
+ *
+ * Nodes form a list from head to tail, each holding the leaf of the next
+ * one. The leaf of the node after the tail is picked ahead of time, so an
+ * enqueue never has to touch the old tail. Enqueue and Dequeue each do two
+ * ORAM accesses.
+ */
+type Queue struct {
+	o         *ods
+	capacity  int
+	size      int
+	head      int // node of the first element
+	head_leaf int
+	tail_leaf int // leaf the next enqueued node goes to
+}
+
+func NewQueue(c *Client, name string, capacity int) (*Queue, error) {
+	o, err := new_ods(c, name, capacity, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &Queue{o: o, capacity: capacity}
+	q.tail_leaf = o.random_leaf()
+	q.head_leaf = q.tail_leaf
+
+	return q, nil
+}
+
+func (q *Queue) Len() int {
+	return q.size
+}
+
+func (q *Queue) Enqueue(v uint64) error {
+	if q.size == q.capacity {
+		return errors.New("Queue is full!")
+	}
+
+	err := q.o.dummy()
+	if err != nil {
+		return err
+	}
+
+	next := q.o.random_leaf()
+	n := (q.head + q.size) % q.capacity
+	err = q.o.write(n, []uint64{v, uint64(next)}, q.tail_leaf)
+	if err != nil {
+		return err
+	}
+
+	q.tail_leaf = next
+	q.size += 1
+
+	return nil
+}
+
+func (q *Queue) Dequeue() (uint64, error) {
+	if q.size == 0 {
+		return 0, errors.New("Queue is empty!")
+	}
+
+	vals, err := q.o.read(q.head, q.head_leaf)
+	if err != nil {
+		return 0, err
+	}
+
+	q.head_leaf = int(vals[1])
+	q.head = (q.head + 1) % q.capacity
+	q.size -= 1
+
+	return vals[0], q.o.dummy()
+}
+
+/*
+ * An oblivious min-priority queue of (priority, value) pairs
+ *
+ * A binary heap where node i holds an element and the leaves of nodes 2i+1
+ * and 2i+2. Insert walks down from the root to the new node, ExtractMin
+ * reads the last node and then both children at every level of the sift
+ * down, so the path taken isn't revealed. With D levels, Insert does 2D
+ * accesses and ExtractMin does 6D - 4.
+ */
+type PriorityQueue struct {
+	o         *ods
+	capacity  int
+	size      int
+	depth     int // number of levels of a full heap
+	root_leaf int
+}
+
+// a heap node read into the client
+type heap_node struct {
+	prio  uint64
+	val   uint64
+	left  int // leaf of node 2i+1
+	right int // leaf of node 2i+2
+}
+
+func NewPriorityQueue(c *Client, name string, capacity int) (*PriorityQueue, error) {
+	o, err := new_ods(c, name, capacity, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	pq := &PriorityQueue{o: o, capacity: capacity}
+	pq.depth = bits.Len(uint(capacity))
+
+	return pq, nil
+}
+
+func (pq *PriorityQueue) Len() int {
+	return pq.size
+}
+
+func (pq *PriorityQueue) read_node(i int, leaf int) (*heap_node, error) {
+	vals, err := pq.o.read(i, leaf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &heap_node{prio: vals[0], val: vals[1], left: int(uint32(vals[2])), right: int(vals[2] >> 32)}, nil
+}
+
+// leaf of child c of node p, which must be in the cache
+func child_leaf(cache map[int]*heap_node, p int, c int) int {
+	if c == 2*p+1 {
+		return cache[p].left
+	}
+
+	return cache[p].right
+}
+
+// nodes from the root down to node i
+func heap_path(i int) []int {
+	path := []int{i}
+	for i > 0 {
+		i = (i - 1) / 2
+		path = append([]int{i}, path...)
+	}
+
+	return path
+}
+
+// writes back every cached node with fresh leaves, children before parents
+func (pq *PriorityQueue) write_back(cache map[int]*heap_node) (int, error) {
+	nodes := make([]int, 0, len(cache))
+	for i := range cache {
+		nodes = append(nodes, i)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(nodes)))
+
+	for _, i := range nodes {
+		n := cache[i]
+		leaf := pq.o.random_leaf()
+		err := pq.o.write(i, []uint64{n.prio, n.val, uint64(n.left) | uint64(n.right)<<32}, leaf)
+		if err != nil {
+			return 0, err
+		}
+
+		if i == 0 {
+			pq.root_leaf = leaf
+		} else if p, ok := cache[(i-1)/2]; ok {
+			if i%2 == 1 {
+				p.left = leaf
+			} else {
+				p.right = leaf
+			}
+		}
+	}
+
+	return len(nodes), nil
+}
+
+func (pq *PriorityQueue) Insert(prio uint64, val uint64) error {
+	if pq.size == pq.capacity {
+		return errors.New("Priority queue is full!")
+	}
+
+	// read the existing nodes on the way to the new one
+	path := heap_path(pq.size)
+	cache := make(map[int]*heap_node)
+	leaf := pq.root_leaf
+	for k, i := range path[:len(path)-1] {
+		n, err := pq.read_node(i, leaf)
+		if err != nil {
+			return err
+		}
+		cache[i] = n
+		leaf = child_leaf(cache, i, path[k+1])
+	}
+	err := pq.o.dummies(pq.depth - (len(path) - 1))
+	if err != nil {
+		return err
+	}
+
+	// top-down insertion: keep the smaller element, carry the other down
+	carry := &heap_node{prio: prio, val: val}
+	for _, i := range path[:len(path)-1] {
+		n := cache[i]
+		if carry.prio < n.prio {
+			n.prio, carry.prio = carry.prio, n.prio
+			n.val, carry.val = carry.val, n.val
+		}
+	}
+	cache[pq.size] = carry
+	pq.size += 1
+
+	written, err := pq.write_back(cache)
+	if err != nil {
+		return err
+	}
+
+	return pq.o.dummies(pq.depth - written)
+}
+
+func (pq *PriorityQueue) ExtractMin() (uint64, uint64, error) {
+	if pq.size == 0 {
+		return 0, 0, errors.New("Priority queue is empty!")
+	}
+
+	// read the path to the last node
+	last := pq.size - 1
+	path := heap_path(last)
+	cache := make(map[int]*heap_node)
+	leaf := pq.root_leaf
+	for k, i := range path {
+		n, err := pq.read_node(i, leaf)
+		if err != nil {
+			return 0, 0, err
+		}
+		cache[i] = n
+		if k+1 < len(path) {
+			leaf = child_leaf(cache, i, path[k+1])
+		}
+	}
+	err := pq.o.dummies(pq.depth - len(path))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// move the last element to the root
+	root := cache[0]
+	prio, val := root.prio, root.val
+	root.prio, root.val = cache[last].prio, cache[last].val
+	delete(cache, last)
+	pq.size -= 1
+
+	// sift down, always touching both children
+	cur := 0
+	sifting := true
+	for lvl := 0; lvl < pq.depth-1; lvl++ {
+		kids := []int{2*cur + 1, 2*cur + 2}
+		for _, c := range kids {
+			_, cached := cache[c]
+			if !sifting || c >= pq.size || cached {
+				err = pq.o.dummy()
+			} else {
+				cache[c], err = pq.read_node(c, child_leaf(cache, cur, c))
+			}
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+
+		if !sifting || kids[0] >= pq.size {
+			sifting = false
+			continue
+		}
+
+		m := kids[0]
+		if kids[1] < pq.size && cache[kids[1]].prio < cache[m].prio {
+			m = kids[1]
+		}
+		if cache[m].prio >= cache[cur].prio {
+			sifting = false
+			continue
+		}
+
+		a, b := cache[cur], cache[m]
+		a.prio, b.prio = b.prio, a.prio
+		a.val, b.val = b.val, a.val
+		cur = m
+	}
+
+	written, err := pq.write_back(cache)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return prio, val, pq.o.dummies(3*pq.depth - 2 - written)
+}
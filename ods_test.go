@@ -0,0 +1,128 @@
+package oram2pc
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// checks that every call of op does the same number of ORAM accesses
+type access_counter struct {
+	o    *ods
+	want map[string]int
+}
+
+func (ac *access_counter) check(t *testing.T, op string, f func() error) {
+	before := ac.o.accesses
+	err := f()
+	if err != nil {
+		t.Fatal(op, err)
+	}
+
+	n := ac.o.accesses - before
+	if want, ok := ac.want[op]; ok && n != want {
+		t.Fatalf("%s did %d accesses, want %d", op, n, want)
+	}
+	ac.want[op] = n
+}
+
+func Test_ods_stack(t *testing.T) {
+	c := InitClient(16, 4)
+	s, err := NewStack(c, "stack", 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.RemoveServer("stack")
+
+	ac := &access_counter{o: s.o, want: map[string]int{"push": 2, "pop": 2, "peek": 2}}
+	model := []uint64{}
+	for i := 0; i < 100; i++ {
+		r := rand.Intn(3)
+		switch {
+		case r == 0 && len(model) < 20, len(model) == 0:
+			v := rand.Uint64()
+			ac.check(t, "push", func() error { return s.Push(v) })
+			model = append(model, v)
+		case r == 1:
+			var v uint64
+			ac.check(t, "pop", func() (err error) { v, err = s.Pop(); return })
+			if v != model[len(model)-1] {
+				t.Fatalf("pop: got %x, want %x", v, model[len(model)-1])
+			}
+			model = model[:len(model)-1]
+		default:
+			var v uint64
+			ac.check(t, "peek", func() (err error) { v, err = s.Peek(); return })
+			if v != model[len(model)-1] {
+				t.Fatalf("peek: got %x, want %x", v, model[len(model)-1])
+			}
+		}
+
+		if s.Len() != len(model) {
+			t.Fatalf("stack has %d elements, want %d", s.Len(), len(model))
+		}
+	}
+}
+
+func Test_ods_queue(t *testing.T) {
+	c := InitClient(16, 4)
+	q, err := NewQueue(c, "queue", 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.RemoveServer("queue")
+
+	ac := &access_counter{o: q.o, want: map[string]int{"enqueue": 2, "dequeue": 2}}
+	model := []uint64{}
+	for i := 0; i < 100; i++ {
+		if (rand.Intn(2) == 0 && len(model) < 8) || len(model) == 0 {
+			v := rand.Uint64()
+			ac.check(t, "enqueue", func() error { return q.Enqueue(v) })
+			model = append(model, v)
+			continue
+		}
+
+		var v uint64
+		ac.check(t, "dequeue", func() (err error) { v, err = q.Dequeue(); return })
+		if v != model[0] {
+			t.Fatalf("dequeue: got %x, want %x", v, model[0])
+		}
+		model = model[1:]
+	}
+
+	for q.Len() < 8 {
+		q.Enqueue(1)
+	}
+	if q.Enqueue(1) == nil {
+		t.Error("enqueue on a full queue should fail")
+	}
+}
+
+func Test_ods_priority_queue(t *testing.T) {
+	c := InitClient(16, 4)
+	pq, err := NewPriorityQueue(c, "pq", 15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.RemoveServer("pq")
+
+	D := pq.depth
+	ac := &access_counter{o: pq.o, want: map[string]int{"insert": 2 * D, "extract": 6*D - 4}}
+	model := []uint64{}
+	for i := 0; i < 80; i++ {
+		if (rand.Intn(2) == 0 && len(model) < 15) || len(model) == 0 {
+			p := uint64(rand.Intn(50))
+			ac.check(t, "insert", func() error { return pq.Insert(p, p*10) })
+			model = append(model, p)
+			sort.Slice(model, func(i, j int) bool { return model[i] < model[j] })
+			continue
+		}
+
+		var p, v uint64
+		ac.check(t, "extract", func() (err error) { p, v, err = pq.ExtractMin(); return })
+		if p != model[0] || v != p*10 {
+			t.Fatalf("extract: got (%d, %d), want priority %d", p, v, model[0])
+		}
+		model = model[1:]
+	}
+}
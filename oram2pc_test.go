@@ -21,7 +21,7 @@ func Benchmark_encryption(b *testing.B) {
 	c := InitClient(N, Z)
 	c.AddServer(server, N, Z, fsize)
 
-	key, _ := c.keys[server]
+	key := c.keys[server].cur
 
 	b.ResetTimer()
 
@@ -32,7 +32,7 @@ func Benchmark_encryption(b *testing.B) {
 			id := int(r)
 			blk := block_encode(id, val)
 			enc := enc_block(blk, key)
-			_ = dec_block(enc, key)
+			_, _ = dec_block(enc, key)
 		}
 	}
 }
@@ -71,7 +71,7 @@ func Benchmark_readwritepath(b *testing.B) {
 	c.AddServer(server, N, Z, fsize)
 
 	s, _ := c.servers[server]
-	key, _ := c.keys[server]
+	key := c.keys[server].cur
 
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
@@ -142,12 +142,20 @@ func Test_blocks(t *testing.T) {
 	b := enc_block(block_encode(0x1234, 0x1122334455667788), key)
 	fmt.Println(block_encode(0x1234, 0x1122334455667788))
 	fmt.Println(b)
-	id, d, dummy := block_decode(dec_block(b, key))
+	pt, err := dec_block(b, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, d, dummy := block_decode(pt)
 	if dummy == false {
 		fmt.Printf("%x: %x\n", id, d)
 	}
 
-	_, e, dummy := block_decode(dec_block(aoeu, key))
+	pt, err = dec_block(aoeu, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, e, dummy := block_decode(pt)
 	if dummy == true {
 		fmt.Println("found dummy block!", e)
 	}
@@ -170,7 +178,10 @@ func Test_blocks(t *testing.T) {
 	bux := []Bucket{dummy_bucket, dummy_bucket, dummy_bucket, bucket}
 	fmt.Println(find_nondummy(bux, key))
 
-	idx, val := bucket_find_block(bux, 0x1234, key)
+	idx, val, err := bucket_find_block(bux, 0x1234, key)
+	if err != nil {
+		t.Fatal(err)
+	}
 	fmt.Println("Finding nondummy in buckets: index", idx, "val", val)
 
 	bucket2 := make_bucket([]Block{aoeu}, 4, key)
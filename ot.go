@@ -0,0 +1,400 @@
+/*
+ * Oblivious transfer: Chou-Orlandi base OT and IKNP OT extension
+ *
+ * Both are secure against semi-honest adversaries, like the rest of the
+ * 2PC code. They only need an io.ReadWriter between the two parties.
+ */
+
+package oram2pc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+)
+
+// security parameter, also the number of base OTs IKNP needs
+const ot_kappa = 128
+
+// expands a key into n pseudorandom bytes, tweaked by idx
+func ot_kdf(key []byte, idx uint64, n int) []byte {
+	out := make([]byte, 0, n+sha256.Size)
+	buf := make([]byte, len(key)+16)
+	copy(buf, key)
+	binary.LittleEndian.PutUint64(buf[len(key):], idx)
+
+	var ctr uint64
+	for len(out) < n {
+		binary.LittleEndian.PutUint64(buf[len(key)+8:], ctr)
+		sum := sha256.Sum256(buf)
+		out = append(out, sum[:]...)
+		ctr += 1
+	}
+
+	return out[:n]
+}
+
+/*
+ * Chou-Orlandi "simplest OT" over P-256
+ *
+ * The sender sends A = aG once, the receiver answers with B = bG or A + bG
+ * for every choice, and both sides hash the shared points into the keys
+ * that encrypt the messages.
+ */
+type BaseOT struct{}
+
+func (BaseOT) Send(rw io.ReadWriter, msgs [][2][]byte) error {
+	curve := elliptic.P256()
+
+	a, ax, ay, err := elliptic.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return err
+	}
+	a_pt := elliptic.Marshal(curve, ax, ay)
+	err = send_msg(rw, a_pt)
+	if err != nil {
+		return err
+	}
+
+	buf, err := recv_msg(rw)
+	if err != nil {
+		return err
+	}
+	pt_len := len(a_pt)
+	if len(buf) != pt_len*len(msgs) {
+		return errors.New("Base OT: wrong number of receiver points!")
+	}
+
+	// -A, to compute B - A
+	neg_ay := new(big.Int).Sub(curve.Params().P, ay)
+
+	out := make([]byte, 0)
+	for i := range msgs {
+		b_pt := buf[i*pt_len : (i+1)*pt_len]
+		bx, by := elliptic.Unmarshal(curve, b_pt)
+		if bx == nil {
+			return errors.New("Base OT: invalid receiver point!")
+		}
+
+		k0x, k0y := curve.ScalarMult(bx, by, a)
+		dx, dy := curve.Add(bx, by, ax, neg_ay)
+		k1x, k1y := curve.ScalarMult(dx, dy, a)
+
+		seed := append(append([]byte{}, a_pt...), b_pt...)
+		k0 := append(append([]byte{}, seed...), elliptic.Marshal(curve, k0x, k0y)...)
+		k1 := append(append([]byte{}, seed...), elliptic.Marshal(curve, k1x, k1y)...)
+
+		c0, err := xor_bytes(msgs[i][0], ot_kdf(k0, uint64(i), len(msgs[i][0])))
+		if err != nil {
+			return err
+		}
+		c1, err := xor_bytes(msgs[i][1], ot_kdf(k1, uint64(i), len(msgs[i][1])))
+		if err != nil {
+			return err
+		}
+		out = append(out, ot_pack(c0, c1)...)
+	}
+
+	return send_msg(rw, out)
+}
+
+func (BaseOT) Receive(rw io.ReadWriter, choices []bool) ([][]byte, error) {
+	curve := elliptic.P256()
+
+	a_pt, err := recv_msg(rw)
+	if err != nil {
+		return nil, err
+	}
+	ax, ay := elliptic.Unmarshal(curve, a_pt)
+	if ax == nil {
+		return nil, errors.New("Base OT: invalid sender point!")
+	}
+
+	keys := make([][]byte, len(choices))
+	pts := make([]byte, 0, len(a_pt)*len(choices))
+	for i := range choices {
+		b, bx, by, err := elliptic.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		if choices[i] {
+			bx, by = curve.Add(bx, by, ax, ay)
+		}
+		b_pt := elliptic.Marshal(curve, bx, by)
+		pts = append(pts, b_pt...)
+
+		kx, ky := curve.ScalarMult(ax, ay, b)
+		seed := append(append([]byte{}, a_pt...), b_pt...)
+		keys[i] = append(seed, elliptic.Marshal(curve, kx, ky)...)
+	}
+
+	err = send_msg(rw, pts)
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := recv_msg(rw)
+	if err != nil {
+		return nil, err
+	}
+
+	cips, err := ot_unpack(buf, len(choices))
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([][]byte, len(choices))
+	for i := range choices {
+		c := cips[i][0]
+		if choices[i] {
+			c = cips[i][1]
+		}
+		out[i], err = xor_bytes(c, ot_kdf(keys[i], uint64(i), len(c)))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+// serializes a pair of (possibly different length) ciphertexts
+func ot_pack(c0 []byte, c1 []byte) []byte {
+	hdr := make([]byte, 8)
+	binary.LittleEndian.PutUint32(hdr, uint32(len(c0)))
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(len(c1)))
+
+	return append(append(hdr, c0...), c1...)
+}
+
+// do the opposite of ot_pack for n pairs
+func ot_unpack(buf []byte, n int) ([][2][]byte, error) {
+	out := make([][2][]byte, n)
+	for i := range out {
+		if len(buf) < 8 {
+			return nil, errors.New("OT: message too short!")
+		}
+		l0 := int(binary.LittleEndian.Uint32(buf))
+		l1 := int(binary.LittleEndian.Uint32(buf[4:]))
+		buf = buf[8:]
+		if len(buf) < l0+l1 {
+			return nil, errors.New("OT: message too short!")
+		}
+		out[i] = [2][]byte{buf[:l0], buf[l0 : l0+l1]}
+		buf = buf[l0+l1:]
+	}
+
+	if len(buf) != 0 {
+		return nil, errors.New("OT: trailing bytes in message!")
+	}
+
+	return out, nil
+}
+
+// pseudorandom generator, expands a 16-byte seed with AES-CTR
+func ot_prg(seed []byte, n int) ([]byte, error) {
+	block, err := aes.NewCipher(seed)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, n)
+	cipher.NewCTR(block, make([]byte, aes.BlockSize)).XORKeyStream(out, out)
+
+	return out, nil
+}
+
+/*
+ * IKNP OT extension
+ *
+ * The first transfer runs ot_kappa base OTs with the roles reversed, every
+ * transfer after that only costs symmetric crypto. An IKNP value keeps the
+ * base OT state, so each party should use its own value and always in the
+ * same role (the garbler only sends, the evaluator only receives).
+ */
+type IKNP struct {
+	Base OT // used for setup, BaseOT if nil
+
+	// sender state: choice bits s and the seeds k_j^{s_j}
+	s     []bool
+	seeds [][]byte
+
+	// receiver state: both seeds of every base OT
+	seed_pairs [][2][]byte
+
+	// number of extensions done so far, keeps the PRG outputs fresh
+	calls uint64
+}
+
+func (e *IKNP) base() OT {
+	if e.Base == nil {
+		return BaseOT{}
+	}
+
+	return e.Base
+}
+
+// the seed for the current extension, derived from a base OT seed
+func (e *IKNP) call_seed(seed []byte) []byte {
+	return ot_kdf(seed, e.calls, 16)
+}
+
+func (e *IKNP) Send(rw io.ReadWriter, msgs [][2][]byte) error {
+	m := len(msgs)
+
+	// setup: we receive one seed of each pair the receiver generates
+	if e.seeds == nil {
+		e.s = random_bits(ot_kappa)
+		seeds, err := e.base().Receive(rw, e.s)
+		if err != nil {
+			return err
+		}
+		e.seeds = seeds
+	}
+
+	buf, err := recv_msg(rw)
+	if err != nil {
+		return err
+	}
+	col_len := (m + 7) / 8
+	if len(buf) != ot_kappa*col_len {
+		return errors.New("IKNP: wrong matrix size!")
+	}
+
+	// q_j = G(k_j^{s_j}) ^ s_j * u_j
+	cols := make([][]byte, ot_kappa)
+	for j := range cols {
+		cols[j], err = ot_prg(e.call_seed(e.seeds[j]), col_len)
+		if err != nil {
+			return err
+		}
+		if e.s[j] {
+			cols[j], err = xor_bytes(cols[j], buf[j*col_len:(j+1)*col_len])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	e.calls += 1
+
+	rows := transpose_bits(cols, m)
+	s := bits_to_bytes(e.s)
+
+	out := make([]byte, 0)
+	for i := range msgs {
+		c0, err := xor_bytes(msgs[i][0], ot_kdf(rows[i], uint64(i), len(msgs[i][0])))
+		if err != nil {
+			return err
+		}
+		k1, err := xor_bytes(rows[i], s)
+		if err != nil {
+			return err
+		}
+		c1, err := xor_bytes(msgs[i][1], ot_kdf(k1, uint64(i), len(msgs[i][1])))
+		if err != nil {
+			return err
+		}
+		out = append(out, ot_pack(c0, c1)...)
+	}
+
+	return send_msg(rw, out)
+}
+
+func (e *IKNP) Receive(rw io.ReadWriter, choices []bool) ([][]byte, error) {
+	m := len(choices)
+
+	// setup: generate seed pairs and send them with base OTs
+	if e.seed_pairs == nil {
+		pairs := make([][2][]byte, ot_kappa)
+		for j := range pairs {
+			pairs[j] = [2][]byte{make([]byte, 16), make([]byte, 16)}
+			rand.Read(pairs[j][0])
+			rand.Read(pairs[j][1])
+		}
+		err := e.base().Send(rw, pairs)
+		if err != nil {
+			return nil, err
+		}
+		e.seed_pairs = pairs
+	}
+
+	// t_j = G(k_j^0), u_j = t_j ^ G(k_j^1) ^ r
+	col_len := (m + 7) / 8
+	r := bits_to_bytes(choices)
+	cols := make([][]byte, ot_kappa)
+	u := make([]byte, 0, ot_kappa*col_len)
+	for j := range cols {
+		var err error
+		cols[j], err = ot_prg(e.call_seed(e.seed_pairs[j][0]), col_len)
+		if err != nil {
+			return nil, err
+		}
+		t1, err := ot_prg(e.call_seed(e.seed_pairs[j][1]), col_len)
+		if err != nil {
+			return nil, err
+		}
+		uj, err := xor_bytes(cols[j], t1)
+		if err != nil {
+			return nil, err
+		}
+		uj, err = xor_bytes(uj, r)
+		if err != nil {
+			return nil, err
+		}
+		u = append(u, uj...)
+	}
+	e.calls += 1
+
+	err := send_msg(rw, u)
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := recv_msg(rw)
+	if err != nil {
+		return nil, err
+	}
+	cips, err := ot_unpack(buf, m)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := transpose_bits(cols, m)
+	out := make([][]byte, m)
+	for i := range choices {
+		c := cips[i][0]
+		if choices[i] {
+			c = cips[i][1]
+		}
+		out[i], err = xor_bytes(c, ot_kdf(rows[i], uint64(i), len(c)))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+// turns len(cols) columns of m bits into m rows of len(cols) bits
+func transpose_bits(cols [][]byte, m int) [][]byte {
+	rows := make([][]byte, m)
+	for i := range rows {
+		rows[i] = make([]byte, (len(cols)+7)/8)
+	}
+
+	for j := range cols {
+		for i := 0; i < m; i++ {
+			if (cols[j][i/8]>>uint(i%8))&1 == 1 {
+				rows[i][j/8] |= 1 << uint(j%8)
+			}
+		}
+	}
+
+	return rows
+}
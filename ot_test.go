@@ -0,0 +1,60 @@
+package oram2pc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net"
+	"testing"
+)
+
+// runs a sender and a receiver over a pipe and checks what was received
+func check_ot(t *testing.T, sender OT, receiver OT, n int, msg_len int) {
+	msgs := make([][2][]byte, n)
+	for i := range msgs {
+		msgs[i] = [2][]byte{make([]byte, msg_len), make([]byte, msg_len+i%3)}
+		rand.Read(msgs[i][0])
+		rand.Read(msgs[i][1])
+	}
+	choices := random_bits(n)
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	done := make(chan error)
+	go func() {
+		done <- sender.Send(a, msgs)
+	}()
+
+	got, err := receiver.Receive(b, choices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range choices {
+		want := msgs[i][0]
+		if choices[i] {
+			want = msgs[i][1]
+		}
+		if !bytes.Equal(got[i], want) {
+			t.Fatalf("OT %d: got %x, want %x", i, got[i], want)
+		}
+	}
+}
+
+func Test_base_ot(t *testing.T) {
+	check_ot(t, BaseOT{}, BaseOT{}, 20, 16)
+}
+
+func Test_iknp(t *testing.T) {
+	sender := &IKNP{}
+	receiver := &IKNP{}
+
+	// the first call does the base OTs, the others reuse them
+	check_ot(t, sender, receiver, 1000, 16)
+	check_ot(t, sender, receiver, 7, 32)
+	check_ot(t, sender, receiver, 3000, 8)
+}
@@ -0,0 +1,416 @@
+/*
+ * Saving and restoring the client state, and inspecting a server's contents
+ */
+
+package oram2pc
+
+import (
+	"encoding/gob"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// what gets written to the state file for each server
+type server_state struct {
+	N     int
+	Z     int
+	Fsize int
+	Dir   string
+	State []byte // the server's server_secrets, sealed (see keys.go)
+	Dirty *int   // leaf to write back before the next access, if any
+	Seq   uint64 // last log record this state includes
+
+	Backend Backend
+	Format  BucketFormat
+	Direct  bool
+	Subtree int
+	Leaves  int
+
+	Eviction  string // the policy's String
+	Fetched   []int  // buckets left stale on the server
+	Evictions uint64 // picks the next eviction path
+	Accesses  int    // since the last eviction
+
+	Epoch    int
+	Rotating bool
+	Fresh    []int // buckets under the current key, while rotating
+
+	WriteOnly bool
+}
+
+// what the state file keeps from anyone without the master key
+type server_secrets struct {
+	Stash []Block
+	Pos   map[int]int // leaf of every block written
+	Slots map[int]int // write-only: the slot of every block not in the stash
+}
+
+// bumped whenever the state file changes in a way older code can't read
+const state_version = 2
+
+type client_state struct {
+	Version int
+	N       int
+	L       int
+	B       int
+	Z       int
+	S       int
+	Servers map[string]server_state
+
+	Master []byte // nil if detached
+	Check  []byte // tells the master key from a wrong one
+}
+
+/*
+ * Writes the client state (position map, stashes, master key and where
+ * each tree lives) to path. The file holds the master key unless it's
+ * detached, so it's only readable by us. The position map and stashes are
+ * sealed under the master key either way, so a client still waiting for
+ * ImportMasterKey can't be saved.
+ */
+func (c *Client) Save(path string) error {
+	if c.master == nil {
+		return ErrNoKey
+	}
+	c.settle_all()
+	cs := client_state{Version: state_version, N: c.N, L: c.L, B: c.B, Z: c.Z, S: c.S, Check: c.check}
+	if c.detached == false {
+		cs.Master = c.master
+	}
+	cs.Servers = make(map[string]server_state)
+	for name, s := range c.servers {
+		k := c.keys[name]
+		ss := server_state{N: s.N, Z: s.Z, Fsize: s.fsize, Dir: s.dir,
+			Backend: s.backend, Format: s.format, Direct: s.direct, Subtree: s.subtree, Leaves: s.leaves}
+		if x, prs := c.dirty[name]; prs == true {
+			ss.Dirty = &x
+		}
+		if w, prs := c.wals[name]; prs == true {
+			ss.Seq = w.seq
+		}
+		e := c.evict[name]
+		ss.Eviction = e.policy.String()
+		ss.Fetched = e.fetched_ids(nil)
+		ss.Evictions = e.g
+		ss.Accesses = e.accesses
+		ss.Epoch = k.epoch
+		if k.fresh != nil {
+			ss.Rotating = true
+			ss.Fresh = make([]int, 0, len(k.fresh))
+			for nd := range k.fresh {
+				ss.Fresh = append(ss.Fresh, heap_id(nd))
+			}
+		}
+		sec := server_secrets{Stash: c.stash[name].blks, Pos: c.pos[name]}
+		if w, prs := c.wo[name]; prs == true {
+			ss.WriteOnly = true
+			sec.Slots = w.pos
+		}
+		sealed, err := c.seal_state(name, k.epoch, sec)
+		if err != nil {
+			return err
+		}
+		ss.State = sealed
+		cs.Servers[name] = ss
+	}
+
+	// write to a temp file and rename so a crash never leaves half a file
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".oram-state-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	err = gob.NewEncoder(tmp).Encode(cs)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return err
+	}
+	for _, w := range c.wo {
+		w.checkpoint()
+	}
+	if crash("checkpoint") {
+		return err_crash
+	}
+
+	// everything logged is in the state file now, start the logs afresh
+	return c.open_wals(path)
+}
+
+// empties the logs and keeps logging next to the state file at path
+func (c *Client) open_wals(path string) error {
+	for name := range c.servers {
+		w, prs := c.wals[name]
+		if prs == false {
+			w = &wal{}
+			c.wals[name] = w
+		}
+
+		// the state file may have moved, clear the old log too
+		err := w.reset()
+		if err != nil {
+			return err
+		}
+		w.path = wal_path(path, name)
+		err = w.reset()
+		if err != nil {
+			return err
+		}
+	}
+	c.state = path
+	for name := range c.servers {
+		c.pos_delta[name] = make(map[int]int)
+	}
+
+	return nil
+}
+
+/*
+ * Reads a client saved with Save, the trees have to still be on disk. If
+ * the master key was detached, the client needs ImportMasterKey before it
+ * can access anything, and its stashes, position map and logs are only read
+ * then.
+ */
+func LoadClient(path string) (*Client, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cs client_state
+	err = gob.NewDecoder(f).Decode(&cs)
+	if err != nil {
+		return nil, err
+	}
+	if cs.Version != state_version {
+		return nil, integrity_err("state file version %d, want %d", cs.Version, state_version)
+	}
+	if cs.N >= max_blocks {
+		return nil, range_err("%d blocks in the state file, ids are 32 bits", cs.N)
+	}
+
+	c := &Client{N: cs.N, L: cs.L, B: cs.B, Z: cs.Z, S: cs.S, metrics: nop_metrics{}}
+	c.pos = make(map[string]map[int]int)
+	c.stash = make(map[string]*stash)
+	c.servers = make(map[string]*Server)
+	c.keys = make(map[string]*server_keys)
+	c.dirty = make(map[string]int)
+	c.evict = make(map[string]*evict_state)
+	c.wo = make(map[string]*wo_state)
+	c.wals = make(map[string]*wal)
+	c.pos_delta = make(map[string]map[int]int)
+	c.locked = make(map[string][]byte)
+	c.state = path
+
+	c.master, c.check = cs.Master, cs.Check
+	c.detached = c.master == nil
+
+	for name, ss := range cs.Servers {
+		s := init_server(ss.N, ss.Z, ss.Fsize)
+		s.dir = ss.Dir
+		s.name = name
+		s.backend = ss.Backend
+		s.format = ss.Format
+		s.direct = ss.Direct
+		s.subtree = ss.Subtree
+		if ss.Leaves > 0 {
+			s.set_leaves(ss.Leaves)
+		}
+		err := s.open_storage()
+		if err != nil {
+			return nil, err
+		}
+		_, err = os.Stat(s.dir)
+		if err != nil {
+			return nil, err
+		}
+
+		c.servers[name] = s
+		k := &server_keys{epoch: ss.Epoch}
+		if ss.Rotating {
+			k.fresh = make(map[node]bool)
+			for _, id := range ss.Fresh {
+				k.fresh[id_node(id)] = true
+			}
+		}
+		c.keys[name] = k
+		c.derive_keys(name)
+		c.stash[name] = new_stash(c.S)
+		c.pos[name] = make(map[int]int)
+		c.locked[name] = ss.State
+		c.pos_delta[name] = make(map[int]int)
+		if ss.Dirty != nil {
+			c.dirty[name] = *ss.Dirty
+		}
+
+		p, err := ParseEviction(ss.Eviction)
+		if err != nil {
+			return nil, err
+		}
+		e := new_evict_state(p)
+		e.set_fetched(ss.Fetched)
+		e.g = ss.Evictions
+		e.accesses = ss.Accesses
+		c.evict[name] = e
+		if ss.WriteOnly {
+			c.wo[name] = new_wo_state(nil)
+		}
+		c.wals[name] = &wal{path: wal_path(path, name), seq: ss.Seq}
+	}
+
+	if c.master != nil {
+		err := c.unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+/*
+ * Opens the sealed state of every server loaded without the master key and
+ * brings the client up to date with what was logged after the save
+ */
+func (c *Client) unlock() error {
+	for name, sealed := range c.locked {
+		var sec server_secrets
+		err := c.open_state(name, c.keys[name].epoch, sealed, &sec)
+		if err != nil {
+			return err
+		}
+		c.stash[name] = &stash{blks: sec.Stash}
+		if sec.Pos != nil {
+			c.pos[name] = sec.Pos
+		}
+		if _, prs := c.wo[name]; prs == true {
+			c.wo[name] = new_wo_state(sec.Slots)
+		}
+
+		err = c.replay(name, c.wals[name])
+		if err != nil {
+			return err
+		}
+		delete(c.locked, name)
+	}
+
+	return nil
+}
+
+// calls f on every plaintext block stored in a server's tree
+func (c *Client) scan_tree(name string, f func(Block)) error {
+	s, prs := c.servers[name]
+	if prs == false {
+		return errors.New("No server exists by that name!")
+	}
+	if c.master == nil {
+		return ErrNoKey
+	}
+	c.settle(name)
+
+	// stale buckets have their blocks in the stash, and so do old copies
+	// on a write-only server
+	fetched := c.evict[name].fetched
+	w := c.wo[name]
+	for l := 0; l <= s.L; l++ {
+		for n := 0; n < s.width(l); n++ {
+			if fetched[node{l, n}] {
+				continue
+			}
+			bucket, err := s.read_node(l, n)
+			if err != nil {
+				return err
+			}
+
+			blks, err := c.open_bucket(name, node{l, n}, bucket)
+			if err != nil {
+				return err
+			}
+			for z, blk := range blks {
+				if w != nil && w.stale(blk, wo_slot(node{l, n}, z, s.Z)) {
+					blk = dummy_block()
+				}
+				f(blk)
+			}
+		}
+	}
+
+	return nil
+}
+
+/*
+ * Decrypts every block a server holds, in the tree and in the stash
+ *
+ * This reads the whole tree in order, so it is not oblivious: it is meant
+ * for the data owner to inspect or export a store.
+ */
+func (c *Client) Dump(name string) (map[int]uint64, error) {
+	vals := make(map[int]uint64)
+	add := func(blk Block) {
+		id, val, dummy := block_decode(blk)
+		if !dummy {
+			vals[id] = val
+		}
+	}
+
+	err := c.scan_tree(name, add)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, blk := range c.stash[name].blks {
+		add(blk)
+	}
+
+	return vals, nil
+}
+
+/*
+ * Occupancy of a server's tree and stash
+ */
+type ServerStats struct {
+	L             int // height of the tree
+	Leaves        int
+	Buckets       int
+	BucketSize    int // bytes each bucket takes on the server
+	TreeBlocks    int // real blocks in the tree
+	StashBlocks   int // real blocks in the stash
+	StashCapacity int
+}
+
+func (c *Client) Stats(name string) (ServerStats, error) {
+	s, prs := c.servers[name]
+	if prs == false {
+		return ServerStats{}, errors.New("No server exists by that name!")
+	}
+
+	st := ServerStats{L: s.L, Leaves: s.leaves, Buckets: s.buckets(), BucketSize: s.bucket_size()}
+	err := c.scan_tree(name, func(blk Block) {
+		if !is_dummy(blk) {
+			st.TreeBlocks += 1
+		}
+	})
+	if err != nil {
+		return st, err
+	}
+
+	st.StashBlocks = c.stash[name].size()
+	st.StashCapacity = len(c.stash[name].blks)
+
+	return st, nil
+}
@@ -0,0 +1,76 @@
+package oram2pc
+
+import (
+	"encoding/gob"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_save_load(t *testing.T) {
+	dir := t.TempDir()
+	state := filepath.Join(dir, "state")
+
+	c := InitClient(32, 4)
+	err := c.AddServerAt("test", 32, 4, 4096, filepath.Join(dir, "tree"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for a := 0; a < 32; a++ {
+		c.Access("test", true, a, uint64(a*a))
+	}
+
+	err = c.Save(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c2, err := LoadClient(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for a := 0; a < 32; a++ {
+		v, err := c2.Access("test", false, a, 0)
+		if err != nil || v != uint64(a*a) {
+			t.Errorf("block %d after load: got %d, want %d (%v)", a, v, a*a, err)
+		}
+	}
+
+	vals, err := c2.Dump("test")
+	if err != nil || len(vals) != 32 || vals[5] != 25 {
+		t.Errorf("dump: got %d blocks, %v", len(vals), err)
+	}
+
+	st, err := c2.Stats("test")
+	if err != nil || st.TreeBlocks+st.StashBlocks != 32 || st.Buckets != 63 {
+		t.Errorf("stats: got %+v, %v", st, err)
+	}
+
+	c2.RemoveServer("test")
+	if _, err := os.Stat(filepath.Join(dir, "tree")); !os.IsNotExist(err) {
+		t.Error("tree still exists after RemoveServer")
+	}
+	if _, err := LoadClient(state); err == nil {
+		t.Error("loading a client whose tree is gone should fail")
+	}
+}
+
+// a state file of another version isn't read
+func Test_save_version(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "state")
+	f, err := os.Create(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = gob.NewEncoder(f).Encode(client_state{Version: state_version - 1, N: 16, Z: 4})
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadClient(state); !errors.Is(err, ErrIntegrity) {
+		t.Errorf("loading a version %d state: %v", state_version-1, err)
+	}
+}
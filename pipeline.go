@@ -0,0 +1,192 @@
+/*
+ * Pipelined accesses
+ *
+ * Access reads a path, works on the stash and writes the path back one step
+ * after another, so the disk sits idle while the client works and the
+ * client waits on every write. AccessPipelined overlaps the two: while the
+ * path of one request is being written back, the next request's path is
+ * read, its operation done and its path evicted. Its write back waits for
+ * the one before it.
+ *
+ * Consecutive paths always share their top levels. Those nodes aren't
+ * read again, their blocks are taken straight from what the write back in
+ * flight is putting there, so the read never races the write. The rest of the two
+ * paths are disjoint. How many levels are skipped depends only on the two
+ * random leaves, so it says nothing about the blocks accessed.
+ *
+ * Every path is written back whatever the server's eviction policy.
+ */
+
+package oram2pc
+
+import (
+	"math/bits"
+	"time"
+)
+
+// one read or write of a batch
+type Request struct {
+	Write bool
+	Addr  int
+	Data  uint64
+}
+
+/*
+ * Runs reqs in order, each like Access, returning what each one returned
+ *
+ * It stops at the first request that fails and returns the values of the
+ * ones before it with the error. Everything up to that request is done and
+ * nothing after it, as with separate calls to Access.
+ */
+func (c *Client) AccessPipelined(name string, reqs []Request) ([]uint64, error) {
+	steps := make([]pipe_step, len(reqs))
+	for i, r := range reqs {
+		steps[i] = pipe_step{a: r.Addr, op: func(st *stash, new_leaf int) (uint64, error) {
+			return st.access(r.Addr, r.Write, r.Data, new_leaf)
+		}}
+	}
+
+	return c.access_pipelined(name, steps)
+}
+
+// one path access of a pipelined batch
+type pipe_step struct {
+	a  int // the block op works on, -1 for a random path that touches none
+	op func(st *stash, new_leaf int) (uint64, error)
+}
+
+// runs steps in order like AccessPipelined, returning what each op returned
+func (c *Client) access_pipelined(name string, steps []pipe_step) ([]uint64, error) {
+	vals := make([]uint64, 0, len(steps))
+	if _, prs := c.wo[name]; prs == true {
+		return vals, ErrWriteOnly
+	}
+	err := c.flush_dirty(name)
+	if err != nil {
+		return vals, err
+	}
+	s := c.servers[name]
+
+	// the write back in flight, for request len(vals)-1
+	var prev *path_write
+	var prev_m AccessMetrics
+	var prev_start time.Time
+	var prev_io IOStats
+	var done chan error
+
+	// waits for the write back in flight, dropping its value if it failed,
+	// after undo takes back whatever was done since it started
+	join := func(undo func()) error {
+		if prev == nil {
+			return nil
+		}
+
+		err := <-done
+		if err != nil && undo != nil {
+			undo()
+		}
+		err = c.finish_write_back(prev, err)
+		if err != nil {
+			vals = vals[:len(vals)-1]
+			return err
+		}
+		prev_m.Write = time.Since(prev_start)
+		prev_m.BytesWritten = s.io_stats().BytesWritten - prev_io.BytesWritten
+		prev_m.Evicted = prev.evicted
+		c.observe_access(name, prev_m)
+		prev = nil
+
+		return nil
+	}
+	fail := func(err error) ([]uint64, error) {
+		join_err := join(nil)
+		if join_err != nil {
+			err = join_err
+		}
+		return vals, err
+	}
+
+	for _, r := range steps {
+		var m AccessMetrics
+		x, new_leaf := 0, 0
+		if r.a < 0 {
+			x = gen_int(s.leaves)
+		} else {
+			x, new_leaf, err = c.remap(name, r.a)
+			if err != nil {
+				return fail(err)
+			}
+		}
+
+		// read the path below what it shares with the one being written
+		// back, the shared buckets are what that write back puts there
+		shared := 0
+		if prev != nil {
+			shared = s.L + 1 - bits.Len(uint(x^prev.x))
+		}
+		blks, err := c.read_path(name, x, shared, &m)
+		if err != nil {
+			return fail(err)
+		}
+		for l := 0; l < shared; l++ {
+			blks = append(blks, prev.plain[l]...)
+		}
+
+		old_pos, had := c.pos[name][r.a]
+		var ret uint64
+		err = c.apply_path(name, blks, func(st *stash) error {
+			if r.a < 0 {
+				return nil
+			}
+			var err error
+			ret, err = r.op(st, new_leaf)
+			if err == nil {
+				c.set_pos(name, r.a, new_leaf)
+			}
+			return err
+		}, &m)
+		if err != nil {
+			return fail(err)
+		}
+
+		wb, err := c.evict_path(name, x, c.take_pos_delta(name))
+		if err != nil {
+			return fail(err)
+		}
+
+		// this write back has to land after the one in flight, and if that
+		// one failed this request never happened: its position map change
+		// goes and the stash goes back to before the failed eviction
+		err = join(func() {
+			if had {
+				c.pos[name][r.a] = old_pos
+			} else if r.a >= 0 {
+				delete(c.pos[name], r.a)
+			}
+			c.pos_delta[name] = make(map[int]int)
+		})
+		if err != nil {
+			return vals, err
+		}
+
+		// every bucket of the path is in the stash now, until it's written
+		path, _ := s.get_path(x)
+		c.evict[name].fetch(path)
+		if wb.w != nil {
+			wb.rec.Fetched = c.evict[name].fetched_ids(path)
+		}
+		vals = append(vals, ret)
+		prev, prev_m = wb, m
+		prev_start, prev_io = time.Now(), s.io_stats()
+		done = make(chan error, 1)
+		go func() { done <- wb.run() }()
+	}
+
+	err = join(nil)
+	if err != nil {
+		return vals, err
+	}
+	c.background(name, false)
+
+	return vals, nil
+}
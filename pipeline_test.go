@@ -0,0 +1,204 @@
+package oram2pc
+
+import (
+	"errors"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+// a random mix of reads and writes, with plenty of repeated addresses
+func random_requests(rng *rand.Rand, N int, n int) []Request {
+	reqs := make([]Request, n)
+	for i := range reqs {
+		reqs[i] = Request{Write: rng.Intn(2) == 0, Addr: rng.Intn(N), Data: rng.Uint64()}
+		if i > 0 && rng.Intn(4) == 0 {
+			reqs[i].Addr = reqs[i-1].Addr
+		}
+	}
+
+	return reqs
+}
+
+func Test_pipeline(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, opts := range []ServerOptions{{}, {Backend: BackendSingle}, {Backend: BackendSingle, Subtree: 3}} {
+		N := 64
+		c := InitClient(N, 4)
+		opts.Dir = filepath.Join(t.TempDir(), "tree")
+		err := c.AddServerWith("test", N, 4, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := &record_metrics{io: make(map[string]int)}
+		c.SetMetrics(rec)
+
+		model := make(map[int]uint64)
+		total := 0
+		for batch := 0; batch < 5; batch++ {
+			reqs := random_requests(rng, N, 50)
+			vals, err := c.AccessPipelined("test", reqs)
+			if err != nil || len(vals) != len(reqs) {
+				t.Fatalf("%v: batch %d: %d values, %v", opts.Backend, batch, len(vals), err)
+			}
+			total += len(reqs)
+
+			for i, r := range reqs {
+				if r.Write {
+					model[r.Addr] = r.Data
+				}
+				if vals[i] != model[r.Addr] {
+					t.Fatalf("%v: batch %d request %d: got %d, want %d", opts.Backend, batch, i, vals[i], model[r.Addr])
+				}
+			}
+		}
+
+		if len(rec.accesses) != total {
+			t.Errorf("%v: %d access observations for %d requests", opts.Backend, len(rec.accesses), total)
+		}
+
+		// plain accesses see what the pipelined ones did
+		for a := 0; a < N; a++ {
+			v, err := c.Access("test", false, a, 0)
+			if err != nil || v != model[a] {
+				t.Errorf("%v: block %d: got %d, want %d (%v)", opts.Backend, a, v, model[a], err)
+			}
+		}
+		st, err := c.Stats("test")
+		if err != nil || st.TreeBlocks+st.StashBlocks != len(model) {
+			t.Errorf("%v: stats %+v for %d blocks, %v", opts.Backend, st, len(model), err)
+		}
+		c.RemoveServer("test")
+	}
+}
+
+// reads of shared levels are skipped, so a batch reads less than Access would
+func Test_pipeline_io(t *testing.T) {
+	c := InitClient(256, 4)
+	err := c.AddServerAt("test", 256, 4, 4096, filepath.Join(t.TempDir(), "tree"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.RemoveServer("test")
+
+	reqs := random_requests(rand.New(rand.NewSource(2)), 256, 100)
+	_, err = c.AccessPipelined("test", reqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	io := c.ServerIO("test")
+	path := int64((c.L + 1) * 4 * 32)
+	if io.BytesWritten < 100*path || io.BytesRead >= 100*path || io.BytesRead < 100*path/2 {
+		t.Errorf("read %d, wrote %d for 100 paths of %d bytes", io.BytesRead, io.BytesWritten, path)
+	}
+}
+
+func Test_pipeline_errors(t *testing.T) {
+	c := InitClient(16, 4)
+	err := c.AddServerAt("test", 16, 4, 4096, filepath.Join(t.TempDir(), "tree"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.RemoveServer("test")
+
+	// stops at a bad address, everything before it is done
+	reqs := []Request{{true, 1, 11}, {true, 2, 22}, {false, 16, 0}, {true, 3, 33}}
+	vals, err := c.AccessPipelined("test", reqs)
+	if !errors.Is(err, ErrOutOfRange) || len(vals) != 2 || vals[1] != 22 {
+		t.Errorf("got %v, %v", vals, err)
+	}
+
+	// a failed write back stops the batch and is retried before the next access
+	defer func() { crash_at = nil }()
+	n := 0
+	crash_at = func(p string) bool {
+		if p == "apply 0" {
+			n += 1
+			return n == 3
+		}
+		return false
+	}
+	reqs = []Request{{true, 4, 44}, {true, 5, 55}, {true, 6, 66}, {true, 7, 77}}
+	vals, err = c.AccessPipelined("test", reqs)
+	crash_at = nil
+	if !errors.Is(err, err_crash) || len(vals) != 2 {
+		t.Errorf("got %v, %v", vals, err)
+	}
+	if _, prs := c.dirty["test"]; prs == false {
+		t.Error("failed write back didn't leave the path dirty")
+	}
+
+	want := map[int]uint64{1: 11, 2: 22, 3: 0, 4: 44, 5: 55, 6: 66, 7: 0}
+	for a, w := range want {
+		v, err := c.Access("test", false, a, 0)
+		if err != nil || v != w {
+			t.Errorf("block %d: got %d, want %d (%v)", a, v, w, err)
+		}
+	}
+}
+
+func Test_pipeline_wal(t *testing.T) {
+	dir := t.TempDir()
+	state := filepath.Join(dir, "state")
+
+	c := InitClient(32, 4)
+	err := c.AddServerWith("test", 32, 4, ServerOptions{Backend: BackendSingle, Dir: filepath.Join(dir, "tree")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Save(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := make([]Request, 32)
+	for a := range reqs {
+		reqs[a] = Request{Write: true, Addr: a, Data: uint64(a * 3)}
+	}
+	_, err = c.AccessPipelined("test", reqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	// every write back was logged, so the state file doesn't need saving
+	c2, err := LoadClient(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.RemoveServer("test")
+	for a := 0; a < 32; a++ {
+		v, err := c2.Access("test", false, a, 0)
+		if err != nil || v != uint64(a*3) {
+			t.Errorf("block %d after replay: got %d (%v)", a, v, err)
+		}
+	}
+}
+
+func Benchmark_randomwrite_pipelined(b *testing.B) {
+	// set up
+	s := "test"
+	N := 4096
+	Z := 4
+	fsize := 4096
+	c := InitClient(N, Z)
+	c.AddServer(s, N, Z, fsize)
+
+	// same writes as Benchmark_randomwrite, in batches of 64
+	reqs := make([]Request, 0, 64)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		r := rand.Int31n(int32(N))
+		reqs = append(reqs, Request{Write: true, Addr: int(r), Data: uint64(r)})
+		if len(reqs) == cap(reqs) || n == b.N-1 {
+			_, err := c.AccessPipelined(s, reqs)
+			if err != nil {
+				panic(err)
+			}
+			reqs = reqs[:0]
+		}
+	}
+
+	c.RemoveServer(s)
+}
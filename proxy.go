@@ -0,0 +1,485 @@
+/*
+ * A trusted proxy sharing one Client between many app clients
+ *
+ * In the style of TaoStore and ObliviStore, the proxy owns the client state
+ * (position map, stash, keys) and app clients send it requests, either by
+ * calling Access or over a local connection (Serve and DialProxy). Any
+ * number of requests can be in flight at once.
+ *
+ * A request for an address that's already queued doesn't read another
+ * path: it joins the queued request and is answered, in the order it
+ * arrived, from the same path. So that the server still sees one path per
+ * request, every joined request is made up for with an access to a random
+ * path, right after the real one and before anyone is answered.
+ *
+ * The client isn't safe for concurrent use, so a single goroutine takes
+ * what's queued a batch at a time and runs it through the pipeline (see
+ * pipeline.go), reading each path while the one before is written back.
+ */
+
+package oram2pc
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+)
+
+// groups the worker takes at a time
+const proxy_batch = 64
+
+// requests one connection may have in flight before the proxy stops reading it
+const proxy_conn_inflight = 64
+
+type proxy_req struct {
+	write bool
+	data  uint64
+	done  chan proxy_resp
+}
+
+type proxy_resp struct {
+	val uint64
+	err error
+}
+
+// requests for one address, served by a single path access
+type proxy_group struct {
+	a    int
+	reqs []*proxy_req
+}
+
+// what a proxy has done so far
+type ProxyStats struct {
+	Requests int64 // requests received
+	Accesses int64 // real path accesses, one per group of requests
+	Joined   int64 // requests that joined one already in flight
+	Fake     int64 // random path accesses made up for joined requests
+}
+
+type Proxy struct {
+	c      *Client
+	server string
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	inflight map[int]*proxy_group // queued groups, which requests may still join
+	queue    []*proxy_group
+	closed   bool
+	done     chan struct{} // closed when the worker has drained the queue
+	stats    ProxyStats
+
+	lns   map[net.Listener]bool
+	conns map[net.Conn]bool
+}
+
+/*
+ * Starts a proxy for one of c's servers. The proxy owns c until it's
+ * closed, nothing else may use c meanwhile.
+ */
+func NewProxy(c *Client, server string) (*Proxy, error) {
+	p, err := new_proxy(c, server)
+	if err != nil {
+		return nil, err
+	}
+	go p.run()
+
+	return p, nil
+}
+
+// a proxy whose worker isn't running yet
+func new_proxy(c *Client, server string) (*Proxy, error) {
+	_, prs := c.servers[server]
+	if prs == false {
+		return nil, errors.New("Could not find server by that name!")
+	}
+	// there are no random paths to make up for joined requests with
+	if _, prs := c.wo[server]; prs == true {
+		return nil, ErrWriteOnly
+	}
+
+	p := &Proxy{c: c, server: server, inflight: make(map[int]*proxy_group),
+		done: make(chan struct{}), lns: make(map[net.Listener]bool), conns: make(map[net.Conn]bool)}
+	p.cond = sync.NewCond(&p.mu)
+
+	return p, nil
+}
+
+/*
+ * Reads or writes block a like Client.Access. Safe to call from any number
+ * of goroutines.
+ */
+func (p *Proxy) Access(write bool, a int, data uint64) (uint64, error) {
+	req := &proxy_req{write: write, data: data, done: make(chan proxy_resp, 1)}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return 0, ErrProxyClosed
+	}
+	p.stats.Requests += 1
+	g, prs := p.inflight[a]
+	if prs == true {
+		p.stats.Joined += 1
+	} else {
+		g = &proxy_group{a: a}
+		p.inflight[a] = g
+		p.queue = append(p.queue, g)
+		p.cond.Signal()
+	}
+	g.reqs = append(g.reqs, req)
+	p.mu.Unlock()
+
+	resp := <-req.done
+	return resp.val, resp.err
+}
+
+func (p *Proxy) Stats() ProxyStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.stats
+}
+
+// serves groups in the order they arrived until the proxy is closed
+func (p *Proxy) run() {
+	defer close(p.done)
+
+	p.mu.Lock()
+	for {
+		for len(p.queue) == 0 && !p.closed {
+			p.cond.Wait()
+		}
+		if len(p.queue) == 0 {
+			p.mu.Unlock()
+			return
+		}
+
+		// later requests for these addresses start new groups
+		batch := p.queue[:min(len(p.queue), proxy_batch)]
+		p.queue = p.queue[len(batch):]
+		for _, g := range batch {
+			delete(p.inflight, g.a)
+		}
+		p.mu.Unlock()
+		p.serve_batch(batch)
+		p.mu.Lock()
+	}
+}
+
+/*
+ * Reads the block of each group with one pipelined path access and applies
+ * its requests in order, each followed by a random path per joined request,
+ * then answers them all
+ */
+func (p *Proxy) serve_batch(batch []*proxy_group) {
+	steps := []pipe_step{}
+	real := make([]int, len(batch)) // the step of each group's real access
+	vals := make([][]uint64, len(batch))
+	for i, g := range batch {
+		real[i] = len(steps)
+		steps = append(steps, pipe_step{a: g.a, op: func(st *stash, new_leaf int) (uint64, error) {
+			v, err := st.access(g.a, false, 0, new_leaf)
+			if err != nil {
+				return 0, err
+			}
+			write := false
+			vals[i] = vals[i][:0]
+			for _, r := range g.reqs {
+				if r.write {
+					v = r.data
+					write = true
+				}
+				vals[i] = append(vals[i], v)
+			}
+			return st.access(g.a, write, v, new_leaf)
+		}})
+		for range g.reqs[1:] {
+			steps = append(steps, pipe_step{a: -1})
+		}
+	}
+
+	// a request is done once its own access is, the random paths after it
+	// only hide that it joined
+	done, err := p.c.access_pipelined(p.server, steps)
+	if err != nil && len(done) < len(steps) && steps[len(done)].a < 0 {
+		p.c.log().Error("oram: proxy fake access failed", "server", p.server, "err", err)
+	}
+
+	accesses, fake := int64(0), int64(0)
+	for i := range done {
+		if steps[i].a < 0 {
+			fake += 1
+		} else {
+			accesses += 1
+		}
+	}
+	p.mu.Lock()
+	p.stats.Accesses += accesses
+	p.stats.Fake += fake
+	p.mu.Unlock()
+
+	for i, g := range batch {
+		for j, r := range g.reqs {
+			if real[i] < len(done) {
+				r.done <- proxy_resp{val: vals[i][j]}
+			} else {
+				r.done <- proxy_resp{err: err}
+			}
+		}
+	}
+}
+
+/*
+ * Stops taking requests, serves the ones already in flight and closes every
+ * listener and connection. The client is the caller's again afterwards.
+ */
+func (p *Proxy) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	p.cond.Broadcast()
+	for l := range p.lns {
+		l.Close()
+	}
+	p.mu.Unlock()
+
+	<-p.done
+
+	p.mu.Lock()
+	for conn := range p.conns {
+		conn.Close()
+	}
+	p.mu.Unlock()
+
+	return nil
+}
+
+/*
+ * Wire format of the local protocol, every message framed by send_msg
+ *
+ * request:  | id | op | addr | value |
+ *           <- 64 bits -><- 8 bits -><- 64 bits -><- 64 bits ->
+ * response: | id | code | value | error message |
+ *           <- 64 bits -><- 8 bits -><- 64 bits -><- rest ->
+ *
+ * op is 1 for a write, code is 0 on success and otherwise says which of the
+ * library's errors the message wraps.
+ */
+const proxy_req_len = 25
+
+// errors that keep their identity across the connection, by code
+var proxy_codes = []error{nil, nil, ErrOutOfRange, ErrStorage, ErrIntegrity, ErrStashOverflow, ErrProxyClosed}
+
+// an error returned by a proxy on the other end of a connection
+type proxy_err struct {
+	msg  string
+	base error
+}
+
+func (e *proxy_err) Error() string {
+	return e.msg
+}
+
+func (e *proxy_err) Unwrap() error {
+	return e.base
+}
+
+/*
+ * Serves app clients connecting to l until the proxy is closed. Requests
+ * on one connection are handled concurrently, up to proxy_conn_inflight at
+ * a time, and may be answered out of order.
+ */
+func (p *Proxy) Serve(l net.Listener) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return ErrProxyClosed
+	}
+	p.lns[l] = true
+	p.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			p.mu.Lock()
+			closed := p.closed
+			delete(p.lns, l)
+			p.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		p.mu.Lock()
+		if p.closed {
+			conn.Close()
+		} else {
+			p.conns[conn] = true
+			go p.serve_conn(conn)
+		}
+		p.mu.Unlock()
+	}
+}
+
+func (p *Proxy) serve_conn(conn net.Conn) {
+	var wmu sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, proxy_conn_inflight)
+	defer func() {
+		wg.Wait()
+		conn.Close()
+		p.mu.Lock()
+		delete(p.conns, conn)
+		p.mu.Unlock()
+	}()
+
+	for {
+		msg, err := recv_msg(conn)
+		if err != nil {
+			return
+		}
+		if len(msg) != proxy_req_len {
+			p.c.log().Warn("oram: bad proxy request", "len", len(msg))
+			return
+		}
+
+		id := binary.LittleEndian.Uint64(msg)
+		write := msg[8] == 1
+		a := int(int64(binary.LittleEndian.Uint64(msg[9:])))
+		data := binary.LittleEndian.Uint64(msg[17:])
+
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			v, err := p.Access(write, a, data)
+
+			resp := make([]byte, 17)
+			binary.LittleEndian.PutUint64(resp, id)
+			binary.LittleEndian.PutUint64(resp[9:], v)
+			if err != nil {
+				resp[8] = 1
+				for code, base := range proxy_codes {
+					if base != nil && errors.Is(err, base) {
+						resp[8] = byte(code)
+						break
+					}
+				}
+				resp = append(resp, err.Error()...)
+			}
+
+			wmu.Lock()
+			send_msg(conn, resp)
+			wmu.Unlock()
+		}()
+	}
+}
+
+/*
+ * An app client's connection to a proxy, safe for concurrent use
+ */
+type ProxyConn struct {
+	conn net.Conn
+	wmu  sync.Mutex
+
+	mu      sync.Mutex
+	next    uint64
+	pending map[uint64]chan proxy_resp
+	err     error // why the connection broke
+}
+
+func DialProxy(network string, addr string) (*ProxyConn, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	pc := &ProxyConn{conn: conn, pending: make(map[uint64]chan proxy_resp)}
+	go pc.read_loop()
+
+	return pc, nil
+}
+
+func (pc *ProxyConn) Access(write bool, a int, data uint64) (uint64, error) {
+	done := make(chan proxy_resp, 1)
+
+	pc.mu.Lock()
+	if pc.err != nil {
+		pc.mu.Unlock()
+		return 0, pc.err
+	}
+	id := pc.next
+	pc.next += 1
+	pc.pending[id] = done
+	pc.mu.Unlock()
+
+	msg := make([]byte, proxy_req_len)
+	binary.LittleEndian.PutUint64(msg, id)
+	msg[8] = bool_byte(write)
+	binary.LittleEndian.PutUint64(msg[9:], uint64(a))
+	binary.LittleEndian.PutUint64(msg[17:], data)
+
+	pc.wmu.Lock()
+	err := send_msg(pc.conn, msg)
+	pc.wmu.Unlock()
+	if err != nil {
+		pc.fail(err)
+	}
+
+	resp := <-done
+	return resp.val, resp.err
+}
+
+// hands responses to the requests waiting for them
+func (pc *ProxyConn) read_loop() {
+	for {
+		msg, err := recv_msg(pc.conn)
+		if err == nil && len(msg) < 17 {
+			err = integrity_err("proxy response of %d bytes", len(msg))
+		}
+		if err != nil {
+			pc.fail(err)
+			return
+		}
+
+		id := binary.LittleEndian.Uint64(msg)
+		resp := proxy_resp{val: binary.LittleEndian.Uint64(msg[9:])}
+		if code := int(msg[8]); code != 0 {
+			e := &proxy_err{msg: string(msg[17:])}
+			if code < len(proxy_codes) {
+				e.base = proxy_codes[code]
+			}
+			resp = proxy_resp{err: e}
+		}
+
+		pc.mu.Lock()
+		done, prs := pc.pending[id]
+		delete(pc.pending, id)
+		pc.mu.Unlock()
+		if prs == true {
+			done <- resp
+		}
+	}
+}
+
+// fails every waiting request and every later one with err
+func (pc *ProxyConn) fail(err error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.err == nil {
+		pc.err = storage_err("proxy connection", err)
+	}
+	for id, done := range pc.pending {
+		done <- proxy_resp{err: pc.err}
+		delete(pc.pending, id)
+	}
+}
+
+func (pc *ProxyConn) Close() error {
+	return pc.conn.Close()
+}
@@ -0,0 +1,262 @@
+package oram2pc
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func proxy_client(t *testing.T, N int) (*Client, *record_metrics) {
+	c := InitClient(N, 4)
+	err := c.AddServerAt("test", N, 4, 4096, filepath.Join(t.TempDir(), "tree"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.RemoveServer("test") })
+
+	rec := &record_metrics{io: make(map[string]int)}
+	c.SetMetrics(rec)
+
+	return c, rec
+}
+
+func Test_proxy_concurrent(t *testing.T) {
+	c, rec := proxy_client(t, 32)
+	p, err := NewProxy(c, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each goroutine owns a few blocks, and they all hammer block 0
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				a := 1 + g*3 + i%3
+				_, err := p.Access(true, a, uint64(a*100+i))
+				if err != nil {
+					t.Error(err)
+				}
+				_, err = p.Access(g%2 == 0, 0, uint64(g))
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	p.Close()
+
+	st := p.Stats()
+	if st.Requests != 160 || st.Accesses+st.Joined != st.Requests || st.Fake != st.Joined {
+		t.Errorf("stats: %+v", st)
+	}
+	// the server sees one path per request, joined or not
+	if len(rec.accesses) != 160 {
+		t.Errorf("%d path accesses for 160 requests", len(rec.accesses))
+	}
+
+	for g := 0; g < 8; g++ {
+		for i := 7; i < 10; i++ {
+			a := 1 + g*3 + i%3
+			v, err := c.Access("test", false, a, 0)
+			if err != nil || v != uint64(a*100+i) {
+				t.Errorf("block %d: got %d, want %d (%v)", a, v, a*100+i, err)
+			}
+		}
+	}
+
+	_, err = p.Access(false, 0, 0)
+	if !errors.Is(err, ErrProxyClosed) {
+		t.Errorf("access after close: %v", err)
+	}
+}
+
+// waits until the proxy has received n requests
+func wait_requests(p *Proxy, n int64) {
+	for p.Stats().Requests < n {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func Test_proxy_dedup(t *testing.T) {
+	c, rec := proxy_client(t, 16)
+	c.Access("test", true, 3, 10)
+
+	// queue everything up before the worker runs, so requests for block 3
+	// join the first one and see each other's writes in order
+	p, err := new_proxy(c, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ops := []struct {
+		write bool
+		a     int
+		data  uint64
+		want  uint64
+	}{
+		{false, 3, 0, 10},
+		{true, 3, 11, 11},
+		{false, 3, 0, 11},
+		{false, 5, 0, 0},
+		{true, 3, 12, 12},
+		{false, 3, 0, 12},
+	}
+
+	var wg sync.WaitGroup
+	for i, o := range ops {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := p.Access(o.write, o.a, o.data)
+			if err != nil || v != o.want {
+				t.Errorf("op %d: got %d, want %d (%v)", i, v, o.want, err)
+			}
+		}()
+		wait_requests(p, int64(i+1))
+	}
+
+	go p.run()
+	wg.Wait()
+
+	// the random paths are done before anyone is answered
+	rec.mu.Lock()
+	n := len(rec.accesses)
+	rec.mu.Unlock()
+	if n != 1+6 {
+		t.Errorf("%d path accesses by the time every request was answered, want 7", n)
+	}
+	p.Close()
+
+	st := p.Stats()
+	if st.Requests != 6 || st.Accesses != 2 || st.Joined != 4 || st.Fake != 4 {
+		t.Errorf("stats: %+v", st)
+	}
+
+	v, err := c.Access("test", false, 3, 0)
+	if err != nil || v != 12 {
+		t.Errorf("block 3 after the proxy: got %d (%v)", v, err)
+	}
+}
+
+func Test_proxy_conn(t *testing.T) {
+	c, _ := proxy_client(t, 32)
+	p, err := NewProxy(c, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := filepath.Join(t.TempDir(), "proxy.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- p.Serve(l) }()
+
+	conns := make([]*ProxyConn, 3)
+	for i := range conns {
+		conns[i], err = DialProxy("unix", sock)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i, pc := range conns {
+		for a := i; a < 32; a += len(conns) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := pc.Access(true, a, uint64(a+1000))
+				if err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	for a := 0; a < 32; a++ {
+		v, err := conns[a%2].Access(false, a, 0)
+		if err != nil || v != uint64(a+1000) {
+			t.Errorf("block %d: got %d (%v)", a, v, err)
+		}
+	}
+
+	_, err = conns[0].Access(false, 32, 0)
+	if !errors.Is(err, ErrOutOfRange) {
+		t.Errorf("expected ErrOutOfRange over the connection, got %v", err)
+	}
+
+	p.Close()
+	if err := <-served; err != nil {
+		t.Errorf("serve: %v", err)
+	}
+	_, err = conns[1].Access(false, 0, 0)
+	if err == nil {
+		t.Error("access on a closed proxy should fail")
+	}
+	for _, pc := range conns {
+		pc.Close()
+	}
+}
+
+func Test_proxy_conn_inflight(t *testing.T) {
+	c, _ := proxy_client(t, 256)
+	p, err := new_proxy(c, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// with the worker stopped, the proxy stops reading the connection once
+	// proxy_conn_inflight requests are waiting
+	client, server := net.Pipe()
+	p.conns[server] = true
+	go p.serve_conn(server)
+	pc := &ProxyConn{conn: client, pending: make(map[uint64]chan proxy_resp)}
+	go pc.read_loop()
+
+	n := 2 * proxy_conn_inflight
+	var wg sync.WaitGroup
+	for a := 0; a < n; a++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := pc.Access(true, a, uint64(a+1))
+			if err != nil || v != uint64(a+1) {
+				t.Errorf("block %d: got %d (%v)", a, v, err)
+			}
+		}()
+	}
+	wait_requests(p, proxy_conn_inflight)
+	time.Sleep(50 * time.Millisecond)
+	if got := p.Stats().Requests; got != proxy_conn_inflight {
+		t.Errorf("%d requests taken off one connection, want %d", got, proxy_conn_inflight)
+	}
+
+	go p.run()
+	wg.Wait()
+	p.Close()
+	pc.Close()
+}
+
+func Test_proxy_write_only(t *testing.T) {
+	c := InitClient(16, 4)
+	err := c.AddServerWith("test", 16, 4, ServerOptions{Dir: filepath.Join(t.TempDir(), "tree"), WriteOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.RemoveServer("test")
+
+	_, err = NewProxy(c, "test")
+	if !errors.Is(err, ErrWriteOnly) {
+		t.Errorf("proxy for a write-only server: %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+/*
+ * Records: byte strings and strings of any length up to a maximum
+ *
+ * A record is framed with its length and cut into chunks of 10 bytes, each
+ * one stored with its index and encoded with pt_encode:
+ *
+ * frame: | length | value | zeros |
+ *        <- 32 bits -><- length bytes -><- up to the chunk boundary ->
+ *
+ * chunk: pt_encode(| index | 10 bytes of the frame |)
+ *                  <- 16 bits -><- 80 bits ->
+ *
+ * which is 128 bits, two block values. A record of up to n bytes always
+ * takes RecordBlocks(n) blocks however long it is, so the server can't tell
+ * records apart by their length. The index makes chunks that were swapped
+ * within a record fail to decode. It's only the chunk's position, so a
+ * chunk from the same position of another record decodes fine; the ORAM's
+ * encryption is what keeps the server from moving chunks around.
+ */
+
+package oram2pc
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	record_header = 4  // the length in front of the value
+	chunk_data    = 10 // frame bytes in a chunk
+	chunk_size    = 16 // bytes a chunk takes once encoded
+)
+
+func record_chunks(n int) int {
+	return (record_header + n + chunk_data - 1) / chunk_data
+}
+
+// number of blocks a record of up to n bytes takes
+func RecordBlocks(n int) int {
+	return record_chunks(n) * chunk_size / block_payload
+}
+
+/*
+ * Byte strings of up to Len bytes, framed and chunked as above. An all-zero
+ * slot decodes to an empty record.
+ */
+type RecordEncoder struct {
+	Len int
+}
+
+func (e RecordEncoder) Size() int {
+	return record_chunks(e.Len) * chunk_size
+}
+
+func (e RecordEncoder) Encode(v []byte, buf []byte) error {
+	if len(v) > e.Len {
+		return errors.New("Record is too large for the record encoder!")
+	}
+	n := record_chunks(e.Len)
+	if n > 1<<16 {
+		return errors.New("Record encoder has too many chunks!")
+	}
+
+	frame := make([]byte, n*chunk_data)
+	binary.LittleEndian.PutUint32(frame, uint32(len(v)))
+	copy(frame[record_header:], v)
+
+	raw := make([]byte, 2+chunk_data)
+	for i := 0; i < n; i++ {
+		binary.LittleEndian.PutUint16(raw, uint16(i))
+		copy(raw[2:], frame[i*chunk_data:(i+1)*chunk_data])
+		copy(buf[i*chunk_size:], pt_encode(raw))
+	}
+
+	return nil
+}
+
+func (e RecordEncoder) Decode(buf []byte) ([]byte, error) {
+	n := record_chunks(e.Len)
+	unset := true
+	for _, b := range buf[:n*chunk_size] {
+		if b != 0 {
+			unset = false
+			break
+		}
+	}
+	if unset {
+		return []byte{}, nil
+	}
+
+	frame := make([]byte, 0, n*chunk_data)
+	for i := 0; i < n; i++ {
+		raw := pt_decode(buf[i*chunk_size : (i+1)*chunk_size])
+		if len(raw) != 2+chunk_data || int(binary.LittleEndian.Uint16(raw)) != i {
+			return nil, integrity_err("chunk %d of a record doesn't decode", i)
+		}
+		frame = append(frame, raw[2:]...)
+	}
+
+	length := int(binary.LittleEndian.Uint32(frame))
+	if length > e.Len {
+		return nil, integrity_err("record of %d bytes, at most %d fit", length, e.Len)
+	}
+
+	return frame[record_header : record_header+length], nil
+}
+
+// strings of up to Len bytes, stored like records
+type StringEncoder struct {
+	Len int
+}
+
+func (e StringEncoder) Size() int {
+	return RecordEncoder(e).Size()
+}
+
+func (e StringEncoder) Encode(v string, buf []byte) error {
+	return RecordEncoder(e).Encode([]byte(v), buf)
+}
+
+func (e StringEncoder) Decode(buf []byte) (string, error) {
+	v, err := RecordEncoder(e).Decode(buf)
+	return string(v), err
+}
+
+/*
+ * Reads or writes the record of up to n bytes in blocks a, a+1, ...
+ * a+RecordBlocks(n)-1. Every block is read and written back either way,
+ * and the record read is returned, or v on a write.
+ */
+func (c *Client) AccessRecord(name string, write bool, a int, n int, v []byte) ([]byte, error) {
+	arr, err := NewObliviousArray[[]byte](c, name, a, 1, RecordEncoder{Len: n})
+	if err != nil {
+		return nil, err
+	}
+
+	if write {
+		err := arr.Set(0, v)
+		if err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+
+	return arr.Get(0)
+}
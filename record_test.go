@@ -0,0 +1,83 @@
+package oram2pc
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func Test_record(t *testing.T) {
+	c := InitClient(128, 4)
+	c.AddServer("test", 128, 4, 4096)
+	defer c.RemoveServer("test")
+
+	if RecordBlocks(6) != 2 || RecordBlocks(7) != 4 || RecordBlocks(100) != 22 {
+		t.Errorf("record blocks: %d %d %d", RecordBlocks(6), RecordBlocks(7), RecordBlocks(100))
+	}
+
+	// lengths around the chunk boundaries, and values with the padding byte in them
+	vals := [][]byte{{}, []byte("$"), []byte("a$b$$"), []byte("six by"), []byte("seven b"), bytes.Repeat([]byte{0x24, 0, 0xff}, 33)}
+	for _, v := range vals {
+		_, err := c.AccessRecord("test", true, 10, 100, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := c.AccessRecord("test", false, 10, 100, nil)
+		if err != nil || !bytes.Equal(r, v) {
+			t.Errorf("record %q: got %q (%v)", v, r, err)
+		}
+	}
+
+	r, err := c.AccessRecord("test", false, 40, 100, nil)
+	if err != nil || len(r) != 0 {
+		t.Errorf("unset record: got %q (%v)", r, err)
+	}
+	if _, err := c.AccessRecord("test", true, 10, 100, make([]byte, 101)); err == nil {
+		t.Error("wrote a record longer than its slot")
+	}
+	if _, err := c.AccessRecord("test", true, 120, 100, nil); err == nil {
+		t.Error("wrote a record past the last block")
+	}
+
+	// strings in an array, each one much longer than a block
+	names, err := NewObliviousArray[string](c, "test", 50, 3, StringEncoder{Len: 40})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{strings.Repeat("x", 40), "", "oblivious"}
+	for i, s := range want {
+		names.Set(i, s)
+	}
+	for i, s := range want {
+		v, err := names.Get(i)
+		if err != nil || v != s {
+			t.Errorf("names[%d]: got %q, want %q (%v)", i, v, s, err)
+		}
+	}
+}
+
+func Test_record_corrupt(t *testing.T) {
+	enc := RecordEncoder{Len: 30}
+	buf := make([]byte, enc.Size())
+	err := enc.Encode([]byte("a record of some length"), buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// chunks swapped, a chunk that isn't base64, and a length too long
+	swapped := bytes.Clone(buf)
+	copy(swapped, buf[chunk_size:2*chunk_size])
+	copy(swapped[chunk_size:], buf[:chunk_size])
+	garbled := bytes.Clone(buf)
+	garbled[3] = '!'
+	long := make([]byte, RecordEncoder{Len: 40}.Size())
+	RecordEncoder{Len: 40}.Encode(make([]byte, 31), long)
+
+	for what, b := range map[string][]byte{"swapped": swapped, "garbled": garbled, "too long": long} {
+		_, err := enc.Decode(b)
+		if !errors.Is(err, ErrIntegrity) {
+			t.Errorf("%s: %v", what, err)
+		}
+	}
+}
@@ -5,12 +5,11 @@ package oram2pc
 
 import (
 	"errors"
-	"io/ioutil"
-	"math"
 	// "net"
 	"os"
 	"path/filepath"
-	"strconv"
+	"sync"
+	"time"
 )
 
 /*
@@ -22,12 +21,37 @@ type Bucket []Block
  * The server
  */
 type Server struct {
-	N     int    // total number of blocks outsourced
-	L     int    // height of binary tree
-	B     int    // block size in bytes, currently fixed at 32
-	Z     int    // capacity of each bucket in blocks
-	dir   string // directory that holds the tree, stored as files
-	fsize int    // filesize of each file that represents a level
+	N      int    // total number of blocks outsourced
+	L      int    // height of binary tree
+	leaves int    // number of leaves, at most 2^L and not tied to N
+	B      int    // block size in bytes, currently fixed at 32
+	Z      int    // capacity of each bucket in blocks
+	dir    string // directory that holds the tree, stored as files
+	fsize  int    // filesize of each file that represents a level
+
+	format  BucketFormat
+	backend Backend
+	direct  bool    // open the single file with O_DIRECT
+	subtree int     // levels per subtree in the single file, 0 for heap order
+	store   storage // set by open_storage
+
+	iomu    sync.Mutex // reads and a write back may run at once
+	io      IOStats    // running totals of the I/O done on the tree
+	name    string     // what the client calls this server, for metrics
+	metrics Metrics
+}
+
+/*
+ * Counts of the I/O a server has done since it was created
+ *
+ * Seeks counts the separate places on disk the I/O went to: a bucket in
+ * its own file or a contiguous region of the single file.
+ */
+type IOStats struct {
+	BytesRead    int64
+	BytesWritten int64
+	Fsyncs       int64
+	Seeks        int64
 }
 
 /*
@@ -39,120 +63,196 @@ type Server struct {
  *   Z: Capacity of each bucket in blocks
  */
 func init_server(N int, Z int, fsize int) *Server {
-	s := &Server{N: N, B: 32, Z: Z}
+	s := &Server{N: N, B: 32, Z: Z, metrics: nop_metrics{}}
 	s.dir = filepath.Join(os.TempDir(), gen_alphanum_string(10))
-	// height of tree: log2(N)
-	s.L = int(math.Ceil(math.Log2(float64(N))))
+	// height of tree: log2(N), with a full bottom level
+	s.set_leaves(1 << uint(ceil_log2(N)))
 
 	s.fsize = fsize
+	s.store = &level_files{s}
 
 	return s
 }
 
-// get full path to the nth bucket on the lth level
-func (s *Server) get_fp(l int, n int) string {
-	fname := filepath.Join(s.dir, strconv.Itoa(l)+"."+strconv.Itoa(n))
-	return fname
+/*
+ * Sizes the tree for a number of leaves. When it isn't a power of two the
+ * bottom level is cut short on the right, and so is every level above it:
+ * only the nodes with a leaf below them exist.
+ */
+func (s *Server) set_leaves(leaves int) {
+	s.leaves = leaves
+	s.L = ceil_log2(leaves)
 }
 
-func (s *Server) create_tree() {
-	// create directory
-	os.Mkdir(s.dir, 0755)
+/*
+ * Bucket size for a tree of N blocks with only the given number of leaves
+ *
+ * A tree with fewer leaves than blocks has fewer buckets to hold them, so Z
+ * grows with the blocks per leaf to keep the same room per block as a tree
+ * with a leaf for every block.
+ */
+func SparseZ(N int, leaves int, Z int) int {
+	if leaves <= 0 || leaves >= N {
+		return Z
+	}
+
+	return Z * ((N + leaves - 1) / leaves)
+}
 
-	// write each file with all zeroes
-	buf := make([]byte, s.fsize)
-	for i := 0; i <= s.L; i++ {
-		// for each level of the tree, create at least 1 file
-		lvl_bytes := (1 << uint(i)) * s.Z * s.B
+// number of nodes on level l
+func (s *Server) width(l int) int {
+	return ((s.leaves - 1) >> uint(s.L-l)) + 1
+}
+
+// number of nodes in the tree
+func (s *Server) buckets() int {
+	total := 0
+	for l := 0; l <= s.L; l++ {
+		total += s.width(l)
+	}
 
-		for j := 0; j <= (lvl_bytes / s.fsize); j++ {
-			fp := s.get_fp(i, j)
+	return total
+}
 
-			err := ioutil.WriteFile(fp, buf, 0644)
-			if err != nil {
-				panic(err)
-			}
+// picks the storage for the server's backend, once dir and backend are set
+func (s *Server) open_storage() error {
+	switch s.backend {
+	case BackendFiles:
+		s.store = &level_files{s}
+	case BackendSingle:
+		if s.direct && o_direct == 0 {
+			return errors.New("O_DIRECT is not supported on this platform!")
 		}
+		if s.subtree < 0 {
+			return errors.New("Subtree height can't be negative!")
+		}
+		s.store = &single_file{s: s, lo: new_layout(s.L, s.subtree)}
+	default:
+		return errors.New("Unknown storage backend!")
 	}
+
+	return nil
+}
+
+func (s *Server) create_tree() error {
+	return s.store.create()
 }
 
 func (s *Server) remove_tree() error {
+	s.store.close()
+
 	// delete directory
 	err := os.RemoveAll(s.dir)
 	return err
 }
 
-func (s *Server) write_node(b Bucket, l int, n int) {
-	max_n := (1 << uint(l))
-	if n < 0 || n >= max_n {
-		return
+// records an I/O operation that started at start
+func (s *Server) observe(op string, bytes int, start time.Time) {
+	s.iomu.Lock()
+	defer s.iomu.Unlock()
+
+	switch op {
+	case IORead:
+		s.io.BytesRead += int64(bytes)
+	case IOWrite:
+		s.io.BytesWritten += int64(bytes)
+	case IOSync:
+		s.io.Fsyncs += 1
 	}
+	s.metrics.ObserveIO(s.name, op, bytes, time.Since(start))
+}
 
-	// get raw bytes of bucket
-	bucket_bytes := bucket_join(b, nil)
+func (s *Server) seeks(n int) {
+	s.iomu.Lock()
+	defer s.iomu.Unlock()
 
-	fp, off := s.foffset(l, n)
-	f, err := os.OpenFile(fp, os.O_RDWR, 0644)
-	if err != nil {
-		panic(err)
-	}
+	s.io.Seeks += int64(n)
+}
 
-	_, err = f.WriteAt(bucket_bytes, int64(off))
-	if err != nil {
-		panic(err)
-	}
+func (s *Server) io_stats() IOStats {
+	s.iomu.Lock()
+	defer s.iomu.Unlock()
 
-	err = f.Sync()
-	if err != nil {
-		panic(err)
+	return s.io
+}
+
+func (s *Server) check_node(l int, n int) error {
+	if l < 0 || l > s.L || n < 0 || n >= s.width(l) {
+		return range_err("node %d on level %d", n, l)
 	}
 
-	err = f.Close()
-	if err != nil {
-		panic(err)
+	return nil
+}
+
+func (s *Server) write_node(b Bucket, l int, n int) error {
+	return s.write_nodes([]node{{l, n}}, []Bucket{b})
+}
+
+/*
+ * Writes bux[i] to node nodes[i] and makes them all durable, which is as few
+ * syscalls and fsyncs as the backend can manage
+ */
+func (s *Server) write_nodes(nodes []node, bux []Bucket) error {
+	bufs := make([][]byte, len(nodes))
+	for i, nd := range nodes {
+		err := s.check_node(nd.l, nd.n)
+		if err != nil {
+			return err
+		}
+
+		// get raw bytes of bucket
+		bufs[i] = bucket_join(bux[i], nil)
+		if len(bufs[i]) != s.bucket_size() {
+			return integrity_err("bucket of %d bytes", len(bufs[i]))
+		}
 	}
+
+	return s.store.write_nodes(nodes, bufs)
 }
 
 func (s *Server) read_node(l int, n int) (Bucket, error) {
-	// get file and offset into that file
-	fp, offset := s.foffset(l, n)
-
-	f, err := os.Open(fp)
+	bux, err := s.read_nodes([]node{{l, n}})
 	if err != nil {
 		return nil, err
 	}
 
+	return bux[0], nil
+}
+
+// reads the buckets of nodes, in as few places on disk as the layout allows
+func (s *Server) read_nodes(nodes []node) ([]Bucket, error) {
 	// in bytes
-	bucket_size := s.B * s.Z
+	bucket_size := s.bucket_size()
+
+	bufs := make([][]byte, len(nodes))
+	for i, nd := range nodes {
+		err := s.check_node(nd.l, nd.n)
+		if err != nil {
+			return nil, err
+		}
+		bufs[i] = make([]byte, bucket_size)
+	}
 
 	// read all bytes at once
-	buf := make([]byte, bucket_size)
-	m, err := f.ReadAt(buf, int64(offset))
-	if m < len(buf) || err != nil {
+	err := s.store.read_nodes(nodes, bufs)
+	if err != nil {
 		return nil, err
 	}
 
 	// organize bytes into buckets
-	bucket := make(Bucket, s.Z)
-	for i := range bucket {
-		left := i * s.B
-		right := (i + 1) * s.B
-		bucket[i] = buf[left:right]
-	}
-
-	err = f.Close()
-	if err != nil {
-		return nil, err
+	bux := make([]Bucket, len(nodes))
+	for j, buf := range bufs {
+		bux[j] = s.bytes_bucket(buf)
 	}
 
-	return bucket, nil
+	return bux, nil
 }
 
-// returns the path to block n
+// returns the path to leaf n
 func (s *Server) get_path(n int) ([]int, error) {
-	if n < 0 || n >= s.N {
-		// block not found
-		return nil, errors.New("Block number out of range")
+	if n < 0 || n >= s.leaves {
+		// no such leaf
+		return nil, range_err("leaf %d of %d", n, s.leaves)
 	}
 
 	// for each level of the tree, get which index the bucket is
@@ -167,20 +267,6 @@ func (s *Server) get_path(n int) ([]int, error) {
 	return path, nil
 }
 
-// returns the file and an offset into that file for a bucket at a given level
-func (s *Server) foffset(l int, n int) (string, int) {
-	// bounds check
-	if n < 0 || n >= (1<<uint(l)) {
-		return "", 0
-	}
-
-	total_bytes := s.B * s.Z * n
-	off := total_bytes % s.fsize
-	fp := s.get_fp(l, total_bytes/s.fsize)
-
-	return fp, off
-}
-
 // access the files stored on disk to retrieve buckets of a path
 func (s *Server) get_path_buckets(n int) ([]Bucket, error) {
 	path, err := s.get_path(n)
@@ -188,15 +274,10 @@ func (s *Server) get_path_buckets(n int) ([]Bucket, error) {
 		return nil, err
 	}
 
-	bux := make([]Bucket, s.L+1)
-	for i := range bux {
-		bucket, err := s.read_node(i, path[i])
-		if err != nil {
-			return nil, err
-		}
-
-		bux[i] = bucket
+	nodes := make([]node, len(path))
+	for l := range path {
+		nodes[l] = node{l, path[l]}
 	}
 
-	return bux, nil
+	return s.read_nodes(nodes)
 }
@@ -0,0 +1,210 @@
+/*
+ * Data-oblivious sorting networks over blocks
+ *
+ * A sorting network is a fixed list of compare-and-swap steps that only
+ * depends on the number of elements, so running it with constant-time swaps
+ * never reveals anything about the data. The same network is used to sort
+ * plaintext blocks in the client and to build sorting circuits for the 2PC
+ * backends.
+ */
+
+package oram2pc
+
+import (
+	"math"
+)
+
+/*
+ * A list of comparators (i, j) with i < j: after each one the element at i
+ * is not larger than the element at j
+ */
+type SortNetwork [][2]int
+
+// smallest power of two >= n
+func next_pow2(n int) int {
+	p := 1
+	for p < n {
+		p <<= 1
+	}
+
+	return p
+}
+
+// keep comparators of the padded network that only touch real elements,
+// the padding behaves like +inf at the end so the rest are no-ops
+func (net SortNetwork) trim(n int) SortNetwork {
+	out := make(SortNetwork, 0, len(net))
+	for _, c := range net {
+		if c[1] < n {
+			out = append(out, c)
+		}
+	}
+
+	return out
+}
+
+/*
+ * Bitonic sorter for n elements
+ *
+ * Uses the variant where every comparator sorts in the same direction (the
+ * first step of each merge compares mirrored positions), which is what lets
+ * a power-of-two network be trimmed to any n.
+ */
+func BitonicNetwork(n int) SortNetwork {
+	p := next_pow2(n)
+	net := SortNetwork{}
+
+	for k := 2; k <= p; k <<= 1 {
+		// merge pairs of sorted runs of length k/2
+		for i := 0; i < p; i++ {
+			j := i ^ (k - 1)
+			if j > i {
+				net = append(net, [2]int{i, j})
+			}
+		}
+
+		for d := k >> 2; d > 0; d >>= 1 {
+			for i := 0; i < p; i++ {
+				j := i ^ d
+				if j > i {
+					net = append(net, [2]int{i, j})
+				}
+			}
+		}
+	}
+
+	return net.trim(n)
+}
+
+/*
+ * Batcher's odd-even merge sort for n elements, uses fewer comparators than
+ * the bitonic sorter
+ */
+func OddEvenMergeNetwork(n int) SortNetwork {
+	p := next_pow2(n)
+	net := SortNetwork{}
+
+	for k := 1; k < p; k <<= 1 {
+		for j := k; j > 0; j >>= 1 {
+			for i := j % k; i+j < p; i += 2 * j {
+				for m := 0; m < j && i+m+j < p; m++ {
+					a, b := i+m, i+m+j
+					// only compare within the same pair of runs being merged
+					if a/(2*k) == b/(2*k) {
+						net = append(net, [2]int{a, b})
+					}
+				}
+			}
+		}
+	}
+
+	return net.trim(n)
+}
+
+// number of comparator layers (parallel depth) of the network
+func (net SortNetwork) Depth() int {
+	depth := make(map[int]int)
+	max := 0
+	for _, c := range net {
+		d := depth[c[0]]
+		if depth[c[1]] > d {
+			d = depth[c[1]]
+		}
+		d += 1
+		depth[c[0]], depth[c[1]] = d, d
+		if d > max {
+			max = d
+		}
+	}
+
+	return max
+}
+
+/*
+ * Runs the network with caller-supplied constant-time operations
+ *
+ * less(i, j) returns 1 if element j should come before element i and 0
+ * otherwise, swap(cond, i, j) swaps the elements if cond == 1. Both have to
+ * run in constant time for the sort to be oblivious.
+ */
+func (net SortNetwork) Apply(less func(int, int) int, swap func(int, int, int)) {
+	for _, c := range net {
+		swap(less(c[1], c[0]), c[0], c[1])
+	}
+}
+
+// 1 if a < b, without branching
+func ct_less(a uint64, b uint64) int {
+	return int(((^a & b) | (^(a ^ b) & (a - b))) >> 63)
+}
+
+// swaps the contents of two equal-length blocks if cond == 1
+func ct_swap(cond int, a Block, b Block) {
+	mask := byte(-cond)
+	for i := range a {
+		t := (a[i] ^ b[i]) & mask
+		a[i] ^= t
+		b[i] ^= t
+	}
+}
+
+/*
+ * Sorts plaintext blocks in place by key(blk), obliviously
+ */
+func (net SortNetwork) SortBlocks(blks []Block, key func(Block) uint64) {
+	less := func(i int, j int) int {
+		return ct_less(key(blks[i]), key(blks[j]))
+	}
+	swap := func(cond int, i int, j int) {
+		ct_swap(cond, blks[i], blks[j])
+	}
+
+	net.Apply(less, swap)
+}
+
+// sort key for blocks by id, dummy blocks sort last
+func block_id_key(blk Block) uint64 {
+	return ct_select(ct_is_dummy(blk), math.MaxUint64, ct_block_id(blk))
+}
+
+// 1 iff a < b as unsigned little endian wire vectors
+func (cb *CircuitBuilder) LessThan(a []int, b []int) int {
+	// borrow out of a - b
+	borrow := cb.Zero()
+	for i := range a {
+		x := cb.XOR(a[i], b[i])
+		borrow = cb.XOR(borrow, cb.AND(x, cb.XOR(b[i], borrow)))
+	}
+
+	return borrow
+}
+
+// swaps two wire vectors if cond is set, one AND per bit
+func (cb *CircuitBuilder) CondSwap(cond int, a []int, b []int) ([]int, []int) {
+	x := make([]int, len(a))
+	y := make([]int, len(b))
+	for i := range a {
+		t := cb.AND(cond, cb.XOR(a[i], b[i]))
+		x[i] = cb.XOR(a[i], t)
+		y[i] = cb.XOR(b[i], t)
+	}
+
+	return x, y
+}
+
+/*
+ * Circuit version of SortBlocks: returns the blocks sorted by the wires
+ * picked out by key (e.g. the id wires, see block_wires)
+ */
+func (cb *CircuitBuilder) SortBlocks(net SortNetwork, blks [][]int, key func([]int) []int) [][]int {
+	out := make([][]int, len(blks))
+	copy(out, blks)
+
+	for _, c := range net {
+		i, j := c[0], c[1]
+		cond := cb.LessThan(key(out[j]), key(out[i]))
+		out[i], out[j] = cb.CondSwap(cond, out[i], out[j])
+	}
+
+	return out
+}
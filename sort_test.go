@@ -0,0 +1,133 @@
+package oram2pc
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func random_blocks(n int) []Block {
+	blks := make([]Block, n)
+	for i := range blks {
+		if rand.Intn(4) == 0 {
+			blks[i] = dummy_block()
+		} else {
+			blks[i] = block_encode(rand.Intn(1000), rand.Uint64())
+		}
+	}
+
+	return blks
+}
+
+func check_sorted(t *testing.T, name string, blks []Block) {
+	ok := sort.SliceIsSorted(blks, func(i, j int) bool {
+		return block_id_key(blks[i]) < block_id_key(blks[j])
+	})
+	if !ok {
+		t.Errorf("%s: blocks not sorted", name)
+	}
+}
+
+func Test_sort_networks(t *testing.T) {
+	for n := 0; n <= 70; n++ {
+		for _, net := range []SortNetwork{BitonicNetwork(n), OddEvenMergeNetwork(n)} {
+			blks := random_blocks(n)
+			before := make(map[string]int)
+			for _, b := range blks {
+				before[string(b)] += 1
+			}
+
+			net.SortBlocks(blks, block_id_key)
+			check_sorted(t, fmt.Sprintf("n=%d", n), blks)
+
+			// same multiset of blocks afterwards
+			for _, b := range blks {
+				before[string(b)] -= 1
+			}
+			for _, v := range before {
+				if v != 0 {
+					t.Fatalf("n=%d: sort lost or duplicated blocks", n)
+				}
+			}
+		}
+	}
+
+	if len(OddEvenMergeNetwork(64)) >= len(BitonicNetwork(64)) {
+		t.Error("odd-even merge sort should use fewer comparators")
+	}
+	if BitonicNetwork(64).Depth() != 21 {
+		t.Errorf("bitonic depth for 64 is %d, want 21", BitonicNetwork(64).Depth())
+	}
+}
+
+func Test_sort_ct_less(t *testing.T) {
+	vals := []uint64{0, 1, 2, 1 << 62, 1 << 63, 1<<63 + 1, ^uint64(0)}
+	for _, a := range vals {
+		for _, b := range vals {
+			if (ct_less(a, b) == 1) != (a < b) {
+				t.Errorf("ct_less(%x, %x) = %d", a, b, ct_less(a, b))
+			}
+		}
+	}
+}
+
+func Test_sort_circuit(t *testing.T) {
+	n := 9
+	cb := NewCircuitBuilder()
+	in := make([][]int, n)
+	for i := range in {
+		in[i] = cb.GarblerInput(128)
+	}
+	id_key := func(blk []int) []int {
+		id, _ := block_wires(blk)
+		return id
+	}
+	out := cb.SortBlocks(OddEvenMergeNetwork(n), in, id_key)
+	for i := range out {
+		cb.Output(out[i]...)
+	}
+	c := cb.Build()
+
+	blks := make([]Block, n)
+	bits := []bool{}
+	for i := range blks {
+		blks[i] = block_encode(rand.Intn(100), rand.Uint64())
+		bits = append(bits, block_bits(blks[i])...)
+	}
+
+	res := c.Eval(bits, nil)
+	sorted := make([]Block, n)
+	for i := range sorted {
+		sorted[i] = Block(bits_to_bytes(res[128*i : 128*(i+1)]))
+	}
+	check_sorted(t, "circuit", sorted)
+
+	// and jointly, on XOR shares with GMW
+	p0, p1, done := gmw_parties(false)
+	defer done()
+	s0, s1 := share_blocks(blks)
+	shares := func(s []Block) []bool {
+		b := []bool{}
+		for i := range s {
+			b = append(b, block_bits(s[i])...)
+		}
+		return b
+	}
+
+	res0 := make(chan []bool)
+	go func() {
+		r, _ := p0.EvalShared(c, shares(s0))
+		res0 <- r
+	}()
+	r1, err := p1.EvalShared(c, shares(s1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r0 := <-res0
+	for i := range r1 {
+		if (r0[i] != r1[i]) != res[i] {
+			t.Fatal("GMW sort doesn't match plaintext circuit")
+		}
+	}
+}
@@ -0,0 +1,207 @@
+/*
+ * A fixed-size stash with data-oblivious operations
+ *
+ * Every operation scans the whole stash and uses conditional moves instead
+ * of branches, so which slots are touched and how long it takes doesn't
+ * depend on the block being accessed, whether it is found, or whether the
+ * access is a read or a write. This is also what makes the operations
+ * straightforward to turn into circuits (see StashScan and Evict in
+ * circuit.go).
+ */
+
+package oram2pc
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+)
+
+// plaintext dummy block compared against in constant time
+var ct_dummy = dummy_block()
+
+type stash struct {
+	blks    []Block // always full length, free slots hold dummy blocks
+	touches int     // slot reads and writes, to check obliviousness in tests
+}
+
+func new_stash(size int) *stash {
+	st := &stash{blks: make([]Block, size)}
+	for i := range st.blks {
+		st.blks[i] = dummy_block()
+	}
+
+	return st
+}
+
+// 1 if a == b, 0 otherwise
+func ct_eq(a uint64, b uint64) int {
+	x := a ^ b
+	return int(((x | -x) >> 63) ^ 1)
+}
+
+// returns a if v == 1 and b if v == 0
+func ct_select(v int, a uint64, b uint64) uint64 {
+	mask := -uint64(v)
+	return (a & mask) | (b &^ mask)
+}
+
+func ct_is_dummy(blk Block) int {
+	return subtle.ConstantTimeCompare(blk, ct_dummy)
+}
+
+// id of a plaintext block, meaningless for dummy blocks
+func ct_block_id(blk Block) uint64 {
+	return uint64(binary.LittleEndian.Uint32(blk[:4]))
+}
+
+func ct_block_leaf(blk Block) uint64 {
+	return uint64(binary.LittleEndian.Uint32(blk[4:8]))
+}
+
+func ct_block_val(blk Block) uint64 {
+	return binary.LittleEndian.Uint64(blk[8:16])
+}
+
+// number of real blocks in the stash
+func (st *stash) size() int {
+	n := 0
+	for i := range st.blks {
+		n += 1 - ct_is_dummy(st.blks[i])
+	}
+
+	return n
+}
+
+// a copy of the stash's blocks, to roll back to if an access fails
+func (st *stash) snapshot() []Block {
+	blks := make([]Block, len(st.blks))
+	for i := range st.blks {
+		blks[i] = append(Block(nil), st.blks[i]...)
+	}
+
+	return blks
+}
+
+func (st *stash) restore(blks []Block) {
+	st.blks = blks
+}
+
+// adds free slots until the stash holds size blocks
+func (st *stash) grow(size int) {
+	for len(st.blks) < size {
+		st.blks = append(st.blks, dummy_block())
+	}
+}
+
+/*
+ * Adds blk to the first free slot if cond == 1, blk keeps its leaf
+ *
+ * Returns an error if there was no free slot, which is a stash overflow.
+ */
+func (st *stash) add(blk Block, cond int) error {
+	placed := 1 - cond
+	for i := range st.blks {
+		take := ct_is_dummy(st.blks[i]) & (1 - placed)
+		subtle.ConstantTimeCopy(take, st.blks[i], blk)
+		placed |= take
+		st.touches += 1
+	}
+
+	if placed == 0 {
+		return ErrStashOverflow
+	}
+
+	return nil
+}
+
+/*
+ * Reads or writes block a, remapping it to new_leaf
+ *
+ * Returns the value of block a, or data for a write. A write to a block
+ * that isn't in the stash adds it, a read of such a block returns 0.
+ */
+func (st *stash) access(a int, write bool, data uint64, new_leaf int) (uint64, error) {
+	w := subtle.ConstantTimeByteEq(bool_byte(write), 1)
+	new_blk := block_encode(a, data)
+	block_set_leaf(new_blk, new_leaf)
+
+	leaf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(leaf, uint32(new_leaf))
+
+	var ret uint64
+	found := 0
+	for i := range st.blks {
+		blk := st.blks[i]
+		match := ct_eq(ct_block_id(blk), uint64(a)) & (1 - ct_is_dummy(blk))
+
+		ret = ct_select(match, ct_block_val(blk), ret)
+		subtle.ConstantTimeCopy(match&w, blk, new_blk)
+		subtle.ConstantTimeCopy(match, blk[4:8], leaf)
+		found |= match
+		st.touches += 1
+	}
+
+	err := st.add(new_blk, w&(1-found))
+	ret = ct_select(w, data, ret)
+
+	return ret, err
+}
+
+/*
+ * Removes up to Z blocks per bucket that can live on the path to leaf x,
+ * filling the path from the leaf up (greedy Path ORAM eviction)
+ *
+ * Returns the plaintext buckets for levels 0..L, padded with dummy blocks.
+ */
+func (st *stash) evict(x int, L int, Z int) []Bucket {
+	bux := make([]Bucket, L+1)
+	for l := L; l >= 0; l-- {
+		bux[l] = make(Bucket, Z)
+		prefix := uint64(x >> uint(L-l))
+
+		for z := 0; z < Z; z++ {
+			out := dummy_block()
+			done := 0
+			for i := range st.blks {
+				fits := ct_eq(ct_block_leaf(st.blks[i])>>uint(L-l), prefix)
+				take := fits & (1 - ct_is_dummy(st.blks[i])) & (1 - done)
+
+				subtle.ConstantTimeCopy(take, out, st.blks[i])
+				subtle.ConstantTimeCopy(take, st.blks[i], ct_dummy)
+				done |= take
+				st.touches += 1
+			}
+
+			bux[l][z] = out
+		}
+	}
+
+	return bux
+}
+
+/*
+ * Takes block a out of the stash, returns its value and 1 if it was there
+ */
+func (st *stash) take(a int) (uint64, int) {
+	var ret uint64
+	found := 0
+	for i := range st.blks {
+		blk := st.blks[i]
+		match := ct_eq(ct_block_id(blk), uint64(a)) & (1 - ct_is_dummy(blk))
+
+		ret = ct_select(match, ct_block_val(blk), ret)
+		subtle.ConstantTimeCopy(match, blk, ct_dummy)
+		found |= match
+		st.touches += 1
+	}
+
+	return ret, found
+}
+
+func bool_byte(b bool) uint8 {
+	if b {
+		return 1
+	}
+
+	return 0
+}
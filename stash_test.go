@@ -0,0 +1,161 @@
+package oram2pc
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// fills a stash with some real blocks spread around the slots
+func test_stash(size int) *stash {
+	st := new_stash(size)
+	for i := 0; i < size/2; i++ {
+		blk := block_encode(i, uint64(i)*3)
+		block_set_leaf(blk, i%8)
+		st.add(blk, 1)
+	}
+
+	return st
+}
+
+func Test_stash_access(t *testing.T) {
+	st := test_stash(32)
+
+	if v, _ := st.access(5, false, 0, 1); v != 15 {
+		t.Errorf("read block 5: got %d, want 15", v)
+	}
+	if v, _ := st.access(5, true, 99, 2); v != 99 {
+		t.Errorf("write block 5: got %d, want 99", v)
+	}
+	if v, _ := st.access(5, false, 0, 3); v != 99 {
+		t.Errorf("read block 5 after write: got %d, want 99", v)
+	}
+	if v, _ := st.access(100, false, 0, 3); v != 0 {
+		t.Errorf("read missing block: got %d, want 0", v)
+	}
+	st.access(100, true, 7, 3)
+	if v, _ := st.access(100, false, 0, 3); v != 7 {
+		t.Errorf("read inserted block: got %d, want 7", v)
+	}
+	if st.size() != 17 {
+		t.Errorf("stash has %d blocks, want 17", st.size())
+	}
+
+	// nothing fits once the stash is full
+	full := test_stash(2)
+	full.add(block_encode(50, 0), 1)
+	if _, err := full.access(51, true, 1, 0); err == nil {
+		t.Error("expected a stash overflow")
+	}
+}
+
+func Test_stash_evict(t *testing.T) {
+	st := test_stash(32)
+
+	// leaf 5 of a height 3 tree: blocks mapped to leaves 4..7 share the
+	// bucket at level 1, only leaf 5 reaches the leaf bucket
+	bux := st.evict(5, 3, 4)
+	for l := range bux {
+		for _, blk := range bux[l] {
+			id, _, dummy := block_decode(blk)
+			if dummy {
+				continue
+			}
+			if (id%8)>>uint(3-l) != 5>>uint(3-l) {
+				t.Errorf("block %d on leaf %d evicted to level %d", id, id%8, l)
+			}
+		}
+	}
+
+	for _, blk := range st.blks {
+		id, _, dummy := block_decode(blk)
+		if !dummy && id%8 >= 4 && id%8 <= 7 && id%8 != 5 {
+			// the level 1 and 2 buckets have room for all of these
+			t.Errorf("block %d should have been evicted", id)
+		}
+	}
+}
+
+func Test_stash_oblivious_touches(t *testing.T) {
+	want := -1
+	for _, op := range []struct {
+		a     int
+		write bool
+	}{{3, false}, {3, true}, {15, false}, {200, false}, {200, true}, {0, true}} {
+		st := test_stash(40)
+		st.access(op.a, op.write, 1, 2)
+		st.evict(rand.Intn(8), 3, 4)
+
+		if want == -1 {
+			want = st.touches
+		}
+		if st.touches != want {
+			t.Errorf("access %v touched %d slots, want %d", op, st.touches, want)
+		}
+	}
+}
+
+// the cases a branching scan would tell apart: a block that's there or
+// not, read or written
+var stash_cases = []struct {
+	name  string
+	a     int
+	write bool
+}{{"present read", 0, false}, {"present write", 127, true}, {"missing read", 1000, false}, {"missing write", 1000, true}}
+
+func Test_stash_oblivious_scan(t *testing.T) {
+	want := -1
+	for _, sc := range stash_cases {
+		st := test_stash(256)
+		for i := 0; i < 100; i++ {
+			st.access(sc.a, sc.write, uint64(i), 1)
+		}
+
+		if want == -1 {
+			want = st.touches
+		}
+		if st.touches != want {
+			t.Errorf("%s touched %d slots, want %d", sc.name, st.touches, want)
+		}
+	}
+}
+
+// the cases should take the same time, compare them with -bench
+func Benchmark_stash_access(b *testing.B) {
+	for _, sc := range stash_cases {
+		b.Run(sc.name, func(b *testing.B) {
+			st := test_stash(256)
+			for i := 0; i < b.N; i++ {
+				st.access(sc.a, sc.write, uint64(i), 1)
+			}
+		})
+	}
+}
+
+func Test_access_random(t *testing.T) {
+	N := 64
+	c := InitClient(N, 4)
+	c.AddServer("test", N, 4, 4096)
+	defer c.RemoveServer("test")
+
+	vals := make(map[int]uint64)
+	for i := 0; i < 1000; i++ {
+		a := rand.Intn(N)
+		if rand.Intn(2) == 0 {
+			v := rand.Uint64()
+			_, err := c.Access("test", true, a, v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			vals[a] = v
+			continue
+		}
+
+		v, err := c.Access("test", false, a, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != vals[a] {
+			t.Fatalf("read %d: got %x, want %x", a, v, vals[a])
+		}
+	}
+}
@@ -0,0 +1,249 @@
+/*
+ * Storage backends for a server's tree
+ *
+ * The files backend is the original layout: each level of the tree is cut
+ * into files of fsize bytes named level.index, and every bucket written is
+ * opened, written, synced and closed on its own. The single file backend
+ * keeps the whole tree in one preallocated file with page aligned buckets.
+ */
+
+package oram2pc
+
+import (
+	"errors"
+	"io/ioutil"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// a bucket of the tree, by level and index in the level
+type node struct {
+	l int
+	n int
+}
+
+// numbers nodes in heap order, the root is 0
+func heap_id(nd node) int {
+	return (1 << uint(nd.l)) - 1 + nd.n
+}
+
+func id_node(id int) node {
+	l := bits.Len(uint(id+1)) - 1
+	return node{l, id + 1 - (1 << uint(l))}
+}
+
+/*
+ * Where and how a server keeps its buckets. Nodes are checked by the server
+ * before they get here, and every I/O done is reported with s.observe.
+ */
+type storage interface {
+	create() error
+
+	// reads nodes[i] into bufs[i]
+	read_nodes(nodes []node, bufs [][]byte) error
+
+	// writes bufs[i] to nodes[i] and syncs them
+	write_nodes(nodes []node, bufs [][]byte) error
+
+	// releases anything held open, the tree stays on disk
+	close() error
+}
+
+/*
+ * How a server stores its tree
+ */
+type Backend int
+
+const (
+	BackendFiles  Backend = iota // files of fsize bytes per level
+	BackendSingle                // one preallocated file, page aligned buckets
+)
+
+var backend_names = map[Backend]string{BackendFiles: "files", BackendSingle: "single"}
+
+func (b Backend) String() string {
+	name, prs := backend_names[b]
+	if prs == false {
+		return "Backend(" + strconv.Itoa(int(b)) + ")"
+	}
+
+	return name
+}
+
+func ParseBackend(name string) (Backend, error) {
+	for b, n := range backend_names {
+		if n == name {
+			return b, nil
+		}
+	}
+
+	return 0, errors.New("Unknown storage backend!")
+}
+
+/*
+ * Options for adding a server, the zero value is the files backend in a
+ * random temp dir
+ */
+type ServerOptions struct {
+	Backend Backend
+	Direct  bool // single file backend: bypass the page cache with O_DIRECT
+	Subtree int  // single file backend: levels per subtree, 0 for heap order
+	Leaves  int  // leaves of the tree, 0 for the power of two at or above N
+	Format  BucketFormat
+	Fsize   int    // files backend: size of each file (4096 if 0)
+	Dir     string // where the tree lives
+
+	Eviction  Eviction // when paths are written back, nil for every access
+	WriteOnly bool     // hide only writes, see writeonly.go
+}
+
+/*
+ * The level files backend
+ */
+type level_files struct {
+	s *Server
+}
+
+// get full path to the nth bucket on the lth level
+func (lf *level_files) get_fp(l int, n int) string {
+	fname := filepath.Join(lf.s.dir, strconv.Itoa(l)+"."+strconv.Itoa(n))
+	return fname
+}
+
+// returns the file and an offset into that file for a bucket at a given level
+func (lf *level_files) foffset(l int, n int) (string, int) {
+	s := lf.s
+	if s.format == FormatCompact {
+		per := lf.per_file()
+		return lf.get_fp(l, n/per), (n % per) * s.bucket_size()
+	}
+
+	total_bytes := s.B * s.Z * n
+	off := total_bytes % s.fsize
+	fp := lf.get_fp(l, total_bytes/s.fsize)
+
+	return fp, off
+}
+
+// compact buckets don't divide the file size, so each file holds whole ones
+func (lf *level_files) per_file() int {
+	return max(lf.s.fsize/lf.s.bucket_size(), 1)
+}
+
+func (lf *level_files) create() error {
+	s := lf.s
+
+	// create directory
+	err := os.MkdirAll(s.dir, 0755)
+	if err != nil {
+		return storage_err("create tree", err)
+	}
+
+	// write each file with all zeroes
+	buf := make([]byte, s.fsize)
+	for i := 0; i <= s.L; i++ {
+		// for each level of the tree, create at least 1 file
+		files := s.width(i)*s.Z*s.B/s.fsize + 1
+		if s.format == FormatCompact {
+			files = (s.width(i) + lf.per_file() - 1) / lf.per_file()
+		}
+
+		for j := 0; j < files; j++ {
+			fp := lf.get_fp(i, j)
+
+			err := ioutil.WriteFile(fp, buf, 0644)
+			if err != nil {
+				return storage_err("create tree", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (lf *level_files) read_nodes(nodes []node, bufs [][]byte) error {
+	for i, nd := range nodes {
+		err := lf.read_node(nd.l, nd.n, bufs[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (lf *level_files) read_node(l int, n int, buf []byte) error {
+	// get file and offset into that file
+	fp, offset := lf.foffset(l, n)
+
+	f, err := os.Open(fp)
+	if err != nil {
+		return storage_err("read node", err)
+	}
+	defer f.Close()
+
+	start := time.Now()
+	m, err := f.ReadAt(buf, int64(offset))
+	if err != nil {
+		// a short read means the file was truncated
+		return storage_err("read node", err)
+	}
+	lf.s.observe(IORead, m, start)
+	lf.s.seeks(1)
+
+	return nil
+}
+
+func (lf *level_files) write_nodes(nodes []node, bufs [][]byte) error {
+	for i, nd := range nodes {
+		if crash("apply " + strconv.Itoa(i)) {
+			return err_crash
+		}
+
+		err := lf.write_node(nd.l, nd.n, bufs[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (lf *level_files) write_node(l int, n int, buf []byte) error {
+	fp, off := lf.foffset(l, n)
+	f, err := os.OpenFile(fp, os.O_RDWR, 0644)
+	if err != nil {
+		return storage_err("write node", err)
+	}
+
+	start := time.Now()
+	_, err = f.WriteAt(buf, int64(off))
+	if err != nil {
+		f.Close()
+		return storage_err("write node", err)
+	}
+	lf.s.observe(IOWrite, len(buf), start)
+	lf.s.seeks(1)
+
+	start = time.Now()
+	err = f.Sync()
+	if err != nil {
+		f.Close()
+		return storage_err("write node", err)
+	}
+	lf.s.observe(IOSync, 0, start)
+
+	err = f.Close()
+	if err != nil {
+		return storage_err("write node", err)
+	}
+
+	return nil
+}
+
+func (lf *level_files) close() error {
+	return nil
+}
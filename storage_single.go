@@ -0,0 +1,258 @@
+/*
+ * The single file backend
+ *
+ * The tree is one preallocated file, dir/tree, with every bucket in its own
+ * page aligned slot, ordered by a layout (heap order or subtrees, see
+ * layout.go). Aligned slots let the file be opened with O_DIRECT. The
+ * buckets of a path in one subtree are read with a single pread, and
+ * written with one pwritev per run of adjacent slots followed by a single
+ * fsync for the whole path.
+ */
+
+package oram2pc
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+const page_size = 4096
+
+type single_file struct {
+	s  *Server
+	lo layout
+	mu sync.Mutex
+	f  *os.File // opened on first use
+}
+
+func (sf *single_file) path() string {
+	return filepath.Join(sf.s.dir, "tree")
+}
+
+// bytes between the starts of two buckets
+func (sf *single_file) slot() int {
+	return align_up(sf.s.bucket_size(), page_size)
+}
+
+// slots up to the last node that exists, the layouts fill each level in order
+func (sf *single_file) slots() int64 {
+	var last int64
+	for l := 0; l <= sf.s.L; l++ {
+		last = max(last, sf.lo.slot(l, sf.s.width(l)-1))
+	}
+
+	return last + 1
+}
+
+func (sf *single_file) offset(l int, n int) int64 {
+	return sf.lo.slot(l, n) * int64(sf.slot())
+}
+
+func (sf *single_file) open(flags int) error {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+
+	if sf.f != nil {
+		return nil
+	}
+
+	if sf.s.direct {
+		flags |= o_direct
+	}
+	f, err := os.OpenFile(sf.path(), os.O_RDWR|flags, 0644)
+	if err != nil {
+		return storage_err("open tree", err)
+	}
+	sf.f = f
+
+	return nil
+}
+
+func (sf *single_file) create() error {
+	err := os.MkdirAll(sf.s.dir, 0755)
+	if err != nil {
+		return storage_err("create tree", err)
+	}
+
+	err = sf.open(os.O_CREATE | os.O_EXCL)
+	if err != nil {
+		return err
+	}
+
+	err = preallocate(sf.f, sf.slots()*int64(sf.slot()))
+	if err != nil {
+		return storage_err("create tree", err)
+	}
+
+	return nil
+}
+
+/*
+ * Reads nodes a subtree at a time: one pread from the first to the last of
+ * the subtree's slots that are wanted
+ */
+func (sf *single_file) read_nodes(nodes []node, bufs [][]byte) error {
+	err := sf.open(0)
+	if err != nil {
+		return err
+	}
+
+	slot := int64(sf.slot())
+	regions := []int64{}
+	span := make(map[int64][2]int64) // first and last slot wanted per region
+	for _, nd := range nodes {
+		r, i := sf.lo.region(nd.l, nd.n), sf.lo.slot(nd.l, nd.n)
+		sp, prs := span[r]
+		if prs == false {
+			regions = append(regions, r)
+			sp = [2]int64{i, i}
+		}
+		span[r] = [2]int64{min(sp[0], i), max(sp[1], i)}
+	}
+
+	data := make(map[int64][]byte)
+	for _, r := range regions {
+		sp := span[r]
+		var buf []byte
+		if sf.s.direct {
+			// O_DIRECT reads whole aligned slots into aligned memory
+			buf = aligned_buf(int((sp[1] - sp[0] + 1) * slot))
+		} else {
+			buf = make([]byte, (sp[1]-sp[0]+1)*slot)
+		}
+
+		start := time.Now()
+		m, err := sf.f.ReadAt(buf, sp[0]*slot)
+		if err != nil {
+			return storage_err("read nodes", err)
+		}
+		sf.s.observe(IORead, m, start)
+		sf.s.seeks(1)
+		data[r] = buf
+	}
+
+	for i, nd := range nodes {
+		r := sf.lo.region(nd.l, nd.n)
+		off := (sf.lo.slot(nd.l, nd.n) - span[r][0]) * slot
+		copy(bufs[i], data[r][off:])
+	}
+
+	return nil
+}
+
+func (sf *single_file) write_nodes(nodes []node, bufs [][]byte) error {
+	err := sf.open(0)
+	if err != nil {
+		return err
+	}
+
+	slot := sf.slot()
+	zeros := make([]byte, slot)
+	align := 1
+	if sf.s.direct {
+		align = page_size
+	}
+
+	// sort the slots so adjacent ones go out in one pwritev
+	order := make([]int, len(nodes))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return sf.offset(nodes[order[i]].l, nodes[order[i]].n) < sf.offset(nodes[order[j]].l, nodes[order[j]].n)
+	})
+
+	// a run is a list of whole slots starting at off
+	write_run := func(run int, off int64, iovs [][]byte) error {
+		if crash("apply " + strconv.Itoa(run)) {
+			return err_crash
+		}
+
+		start := time.Now()
+		m, err := pwritev(sf.f, iovs, off, align)
+		if err != nil {
+			return storage_err("write nodes", err)
+		}
+		sf.s.observe(IOWrite, m, start)
+
+		return nil
+	}
+
+	runs := 0
+	var iovs [][]byte
+	var run_off, next int64 = 0, -1
+	for _, i := range order {
+		off := sf.offset(nodes[i].l, nodes[i].n)
+		if off != next && len(iovs) > 0 {
+			err := write_run(runs, run_off, iovs)
+			if err != nil {
+				return err
+			}
+			runs += 1
+			iovs = nil
+		}
+		if len(iovs) == 0 {
+			run_off = off
+		}
+
+		if sf.s.direct {
+			b := aligned_buf(slot)
+			copy(b, bufs[i])
+			iovs = append(iovs, b)
+		} else {
+			iovs = append(iovs, bufs[i], zeros[len(bufs[i]):])
+		}
+		next = off + int64(slot)
+	}
+	if len(iovs) > 0 {
+		err := write_run(runs, run_off, iovs)
+		if err != nil {
+			return err
+		}
+		runs += 1
+	}
+
+	sf.s.seeks(runs)
+
+	start := time.Now()
+	err = sf.f.Sync()
+	if err != nil {
+		return storage_err("sync tree", err)
+	}
+	sf.s.observe(IOSync, 0, start)
+
+	return nil
+}
+
+func (sf *single_file) close() error {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+
+	if sf.f == nil {
+		return nil
+	}
+
+	err := sf.f.Close()
+	sf.f = nil
+	return err
+}
+
+func align_up(n int, a int) int {
+	return (n + a - 1) / a * a
+}
+
+// n bytes of page aligned memory, as O_DIRECT wants
+func aligned_buf(n int) []byte {
+	buf := make([]byte, n+page_size)
+	off := int(uintptr(unsafe.Pointer(&buf[0])) & (page_size - 1))
+	if off != 0 {
+		off = page_size - off
+	}
+
+	return buf[off : off+n : off+n]
+}
@@ -0,0 +1,125 @@
+package oram2pc
+
+import (
+	"errors"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func backend_client(t testing.TB, N int, opts ServerOptions) *Client {
+	c := InitClient(N, 4)
+	err := c.AddServerWith("test", N, 4, opts)
+	if errors.Is(err, syscall.EINVAL) && opts.Direct {
+		t.Skip("O_DIRECT isn't supported by the temp dir's filesystem")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func Test_single_file(t *testing.T) {
+	for _, direct := range []bool{false, true} {
+		single_file_roundtrip(t, ServerOptions{Backend: BackendSingle, Direct: direct})
+	}
+}
+
+// writes, reads, saves and reloads a store on the single file backend
+func single_file_roundtrip(t *testing.T, opts ServerOptions) {
+	dir := t.TempDir()
+	opts.Dir = filepath.Join(dir, "tree")
+	c := backend_client(t, 64, opts)
+
+	for a := 0; a < 64; a++ {
+		_, err := c.Access("test", true, a, uint64(a)*3)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a whole path goes out with one fsync
+	before := c.ServerIO("test")
+	for a := 0; a < 64; a++ {
+		v, err := c.Access("test", false, a, 0)
+		if err != nil || v != uint64(a)*3 {
+			t.Errorf("%+v: block %d: got %d, %v", opts, a, v, err)
+		}
+	}
+	after := c.ServerIO("test")
+	if after.Fsyncs-before.Fsyncs != 64 {
+		t.Errorf("%+v: %d fsyncs for 64 accesses", opts, after.Fsyncs-before.Fsyncs)
+	}
+
+	state := filepath.Join(dir, "state")
+	err := c.Save(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	c2, err := LoadClient(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vals, err := c2.Dump("test")
+	if err != nil || len(vals) != 64 || vals[10] != 30 {
+		t.Errorf("%+v: dump after load: %d blocks, %v", opts, len(vals), err)
+	}
+	c2.RemoveServer("test")
+}
+
+func Test_single_file_layout(t *testing.T) {
+	s := init_server(64, 4, 4096)
+	sf := &single_file{s: s, lo: new_layout(s.L, 0)}
+
+	if sf.slot()%page_size != 0 || sf.slot() < s.B*s.Z {
+		t.Errorf("slot of %d bytes for %d byte buckets", sf.slot(), s.B*s.Z)
+	}
+
+	// heap order, one slot per node
+	seen := make(map[int64]bool)
+	for l := 0; l <= s.L; l++ {
+		for n := 0; n < 1<<uint(l); n++ {
+			off := sf.offset(l, n)
+			if off%page_size != 0 || seen[off] {
+				t.Fatalf("node %d of level %d at %d", n, l, off)
+			}
+			seen[off] = true
+		}
+	}
+	if sf.offset(0, 0) != 0 || sf.offset(1, 1) != 2*int64(sf.slot()) {
+		t.Error("buckets aren't in heap order")
+	}
+
+	buf := aligned_buf(100)
+	if len(buf) != 100 || cap(buf) != 100 {
+		t.Errorf("aligned_buf(100) has len %d, cap %d", len(buf), cap(buf))
+	}
+}
+
+func bench_backend(b *testing.B, opts ServerOptions) {
+	c := backend_client(b, 4096, opts)
+	defer c.RemoveServer("test")
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		_, err := c.Access("test", true, n%4096, uint64(n))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Benchmark_backend_files(b *testing.B) {
+	bench_backend(b, ServerOptions{Backend: BackendFiles})
+}
+
+func Benchmark_backend_single(b *testing.B) {
+	bench_backend(b, ServerOptions{Backend: BackendSingle})
+}
+
+func Benchmark_backend_single_direct(b *testing.B) {
+	bench_backend(b, ServerOptions{Backend: BackendSingle, Direct: true})
+}
@@ -0,0 +1,182 @@
+/*
+ * ORAM client operations evaluated jointly by two parties
+ *
+ * The client state is XOR-shared between the parties: each one holds a
+ * share of every stash block, of the block id and of the data. The circuits
+ * below recombine the shares inside the computation and mask every output
+ * with fresh randomness from both sides, so each party ends up with a share
+ * of the result and learns nothing else.
+ */
+
+package oram2pc
+
+import (
+	"crypto/rand"
+	"errors"
+)
+
+// splits blocks into two XOR shares
+func share_blocks(blks []Block) ([]Block, []Block) {
+	a := make([]Block, len(blks))
+	b := make([]Block, len(blks))
+	for i := range blks {
+		a[i] = make(Block, len(blks[i]))
+		rand.Read(a[i])
+		b[i], _ = xor_bytes(blks[i], a[i])
+	}
+
+	return a, b
+}
+
+// recombines two XOR shares of a list of blocks
+func unshare_blocks(a []Block, b []Block) ([]Block, error) {
+	if len(a) != len(b) {
+		return nil, integrity_err("%d and %d shares", len(a), len(b))
+	}
+
+	blks := make([]Block, len(a))
+	for i := range a {
+		blk, err := xor_bytes(a[i], b[i])
+		if err != nil {
+			return nil, err
+		}
+		blks[i] = blk
+	}
+
+	return blks, nil
+}
+
+func random_bits(n int) []bool {
+	buf := make([]byte, (n+7)/8)
+	rand.Read(buf)
+	return bytes_to_bits(buf)[:n]
+}
+
+// the input wires one party contributes to a stash access circuit
+type stash_access_wires struct {
+	stash [][]int
+	id    []int
+	leaf  []int
+	write int
+	data  []int
+	mask  []int
+}
+
+func stash_access_input(n int, input func(int) []int) stash_access_wires {
+	var w stash_access_wires
+	w.stash = make([][]int, n)
+	for i := range w.stash {
+		w.stash[i] = input(128)
+	}
+	w.id = input(32)
+	w.leaf = input(32)
+	w.write = input(1)[0]
+	w.data = input(64)
+	w.mask = input(128*n + 64)
+
+	return w
+}
+
+/*
+ * Builds the circuit for one ORAM access on a stash of n blocks
+ *
+ * It does what stash.access does: a full scan for the block, overwriting it
+ * on a write, or inserting it into the first dummy slot if it is not in the
+ * stash yet. Outputs are the new stash followed by the value read, XORed
+ * with both parties' masks.
+ */
+func stash_access_circuit(n int) *Circuit {
+	cb := NewCircuitBuilder()
+	g := stash_access_input(n, cb.GarblerInput)
+	e := stash_access_input(n, cb.EvaluatorInput)
+
+	stash := make([][]int, n)
+	for i := range stash {
+		stash[i] = cb.XORBits(g.stash[i], e.stash[i])
+	}
+	id := cb.XORBits(g.id, e.id)
+	leaf := cb.XORBits(g.leaf, e.leaf)
+	write := cb.XOR(g.write, e.write)
+	data := cb.XORBits(g.data, e.data)
+	new_blk := append(append(append([]int{}, id...), leaf...), data...)
+
+	val, found := cb.StashScan(stash, id)
+
+	// overwrite the matching block on a write
+	out := make([]int, 0, 128*n+64)
+	placed := cb.NOT(cb.AND(write, cb.NOT(found)))
+	for i := range stash {
+		match := cb.BlockMatch(stash[i], id)
+		hit := cb.AND(write, match)
+		blk := cb.Mux(hit, stash[i], new_blk)
+
+		// remap the block to its new leaf
+		blk_leaf := cb.Mux(match, block_leaf_wires(blk), leaf)
+		blk = append(append(append([]int{}, blk[:32]...), blk_leaf...), blk[64:]...)
+
+		// or put it in the first free slot if it wasn't there
+		free := cb.AND(cb.IsDummy(stash[i]), cb.NOT(placed))
+		blk = cb.Mux(free, blk, new_blk)
+		placed = cb.OR(placed, free)
+
+		out = append(out, blk...)
+	}
+
+	// a write returns the data written, like Access
+	out = append(out, cb.Mux(write, val, data)...)
+
+	out = cb.XORBits(out, g.mask)
+	out = cb.XORBits(out, e.mask)
+	cb.Output(out...)
+
+	return cb.Build()
+}
+
+/*
+ * Runs a joint ORAM access on a secret-shared stash with garbled circuits
+ *
+ * stash, id, leaf, write and data are this party's shares, leaf is the new
+ * leaf of the block. Returns this party's shares of the updated stash and
+ * of the value read. The stash needs a free (dummy) slot to insert a block
+ * that isn't in it yet.
+ */
+func (p *GCParty) StashAccess(stash []Block, id uint32, leaf uint32, write bool, data uint64) ([]Block, uint64, error) {
+	n := len(stash)
+	c := stash_access_circuit(n)
+
+	input := make([]bool, 0, len(c.GarblerInputs))
+	for i := range stash {
+		input = append(input, block_bits(stash[i])...)
+	}
+	input = append(input, uint32_to_bits(id)...)
+	input = append(input, uint32_to_bits(leaf)...)
+	input = append(input, write)
+	input = append(input, uint64_to_bits(data)...)
+	mask := random_bits(128*n + 64)
+	input = append(input, mask...)
+
+	out, err := p.Run(c, input)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(out) != len(mask) {
+		return nil, 0, errors.New("Stash access returned the wrong number of bits!")
+	}
+
+	// the garbler takes out ^ its mask, the evaluator keeps its mask
+	share := mask
+	if p.Garbler {
+		share = make([]bool, len(out))
+		for i := range out {
+			share[i] = out[i] != mask[i]
+		}
+	}
+
+	new_stash := make([]Block, n)
+	for i := range new_stash {
+		new_stash[i] = Block(bits_to_bytes(share[128*i : 128*(i+1)]))
+	}
+	val := bits_to_uint64(share[128*n:])
+
+	return new_stash, val, nil
+}
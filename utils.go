@@ -5,21 +5,19 @@
 package oram2pc
 
 import (
-	"bytes"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
-	"log"
-	"math"
-	"math/big"
+	"math/bits"
 )
 
 const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
-func xor_bytes(a []byte, b []byte) []byte {
+func xor_bytes(a []byte, b []byte) ([]byte, error) {
 	if len(a) != len(b) {
-		log.Fatal("XOR_bytes: arguments are not the same length!")
+		return nil, integrity_err("xor_bytes: %d and %d bytes", len(a), len(b))
 	}
 
 	r := make([]byte, len(a))
@@ -27,42 +25,19 @@ func xor_bytes(a []byte, b []byte) []byte {
 		r[i] = a[i] ^ b[i]
 	}
 
-	return r
-}
-
-func random_perm(size int64) []int64 {
-	p := make([]int64, size, size)
-
-	var i int64
-	for i = 0; i < size; i++ {
-		p[i] = i
-	}
-
-	// use fisher-yates shuffling
-	for i = 0; i < size-2; i++ {
-		j_big, err := rand.Int(rand.Reader, big.NewInt(size-1-i))
-		if err != nil {
-			log.Println(err)
-		}
-		j := j_big.Int64()
-
-		p[i], p[j] = p[j], p[i]
-	}
-
-	return p
+	return r, nil
 }
 
 // generate a uint32 in [0, max)
 func gen_uint32(max uint32) uint32 {
 	for {
-		// get random bytes
-		max_f := float64(max - 1)
-		num_bits := uint(math.Ceil(math.Log2(max_f)))
+		// get random bytes, enough bits to represent max - 1
+		num_bits := uint(bits.Len32(max - 1))
 
 		r := make([]byte, 4)
 		_, err := rand.Read(r)
 		if err != nil {
-			log.Println(err)
+			logger.Error("gen_uint32: reading randomness failed", "err", err)
 		}
 
 		// trim bytes to get the right number of bits
@@ -76,6 +51,15 @@ func gen_uint32(max uint32) uint32 {
 	}
 }
 
+// smallest L with 2^L >= n
+func ceil_log2(n int) int {
+	if n <= 1 {
+		return 0
+	}
+
+	return bits.Len(uint(n - 1))
+}
+
 // this is a stupid hack but I'm lazy
 func gen_int(max int) int {
 	return int(gen_uint32(uint32(max)))
@@ -102,13 +86,16 @@ func pad(v []byte, c byte) []byte {
 }
 
 func unpad(v []byte, c byte) []byte {
-	// undo right pad
-	padding := make([]byte, 1)
-	padding[0] = c
-	return bytes.Replace(v, padding, nil, len(v))
+	// undo right pad, only the trailing c's are padding
+	n := len(v)
+	for n > 0 && v[n-1] == c {
+		n -= 1
+	}
+
+	return v[:n]
 }
 
-// padding and b64 encoding for plaintext, pad to 128 bits
+// padding and b64 encoding for plaintext, pad to 128 bits, so v is at most 12 bytes
 func pt_encode(v []byte) []byte {
 	encoded_len := base64.RawStdEncoding.EncodedLen(len(v))
 	b64_v := make([]byte, encoded_len)
@@ -121,17 +108,27 @@ func pt_decode(v []byte) []byte {
 	unpadded := unpad(v, 0x24)
 	decoded_len := base64.RawStdEncoding.DecodedLen(len(unpadded))
 	decoded_v := make([]byte, decoded_len)
-	_, err := base64.RawStdEncoding.Decode(decoded_v, unpadded)
+	n, err := base64.RawStdEncoding.Decode(decoded_v, unpadded)
 	if err != nil {
 		return nil
 	}
 
-	return decoded_v
+	return decoded_v[:n]
 }
 
-// dunno if this should be done this way but whatever
+// HMAC-SHA256 keyed with k in counter mode, at least len(r) bytes
 func prf(k []byte, r []byte) []byte {
-	return sha256.New().Sum(append(k, r...))
+	out := make([]byte, 0, len(r)+sha256.Size)
+	ctr := make([]byte, 4)
+	for i := uint32(0); len(out) < len(r); i++ {
+		binary.LittleEndian.PutUint32(ctr, i)
+		mac := hmac.New(sha256.New, k)
+		mac.Write(r)
+		mac.Write(ctr)
+		out = mac.Sum(out)
+	}
+
+	return out
 }
 
 // multi-message secure encryption defined in Pass & Shelat 3.7 (pg 94)
@@ -143,18 +140,20 @@ func encrypt(m []byte, k []byte) []byte {
 		return nil
 	}
 
-	// xor with PRF(r)
-	xor_part := xor_bytes(m, prf(k, r)[:len(r)])
+	// xor with PRF(r), the lengths always match
+	xor_part, _ := xor_bytes(m, prf(k, r)[:len(r)])
 
 	cip := append(r, xor_part...)
 	return cip
 }
 
-func decrypt(cip []byte, k []byte) []byte {
+func decrypt(cip []byte, k []byte) ([]byte, error) {
+	// r and the message have the same length
+	if len(cip) == 0 || len(cip)%2 != 0 {
+		return nil, integrity_err("ciphertext of %d bytes", len(cip))
+	}
 	r := cip[:len(cip)/2]
 	xor_part := cip[len(cip)/2:]
 
-	m := xor_bytes(xor_part, prf(k, r)[:len(r)])
-
-	return m
+	return xor_bytes(xor_part, prf(k, r)[:len(r)])
 }
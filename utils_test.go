@@ -2,6 +2,7 @@ package oram2pc
 
 import (
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"testing"
 )
@@ -15,6 +16,11 @@ func Test_utils(t *testing.T) {
 	fmt.Println(pad(m, 0x24))
 	fmt.Println(unpad(pad(m, 0x24), 0x24))
 
+	// only trailing padding comes off
+	if u := unpad([]byte("a$b$$"), 0x24); string(u) != "a$b" {
+		t.Errorf("unpad: got %q, want \"a$b\"", u)
+	}
+
 	fmt.Println("Testing plaintext encoding and decoding functions:")
 	fmt.Println(pt_encode(m))
 	fmt.Println(pt_decode(pt_encode(m)))
@@ -25,4 +31,9 @@ func Test_utils(t *testing.T) {
 	fmt.Println("Testing encrypting and decrypting...")
 	fmt.Println(cip)
 	fmt.Println(decrypt(cip, k))
+
+	_, err := decrypt(cip[1:], k)
+	if !errors.Is(err, ErrIntegrity) {
+		t.Errorf("decrypting a truncated ciphertext: got %v, want ErrIntegrity", err)
+	}
 }
@@ -0,0 +1,847 @@
+/*
+ * A file system in the blocks of one server
+ *
+ * Everything is kept in a region of blocks read and written with
+ * Client.Access, so a VFS survives Save and LoadClient along with the
+ * rest of the client and is mounted again with OpenVFS:
+ *
+ * | superblock | inodes | page links | pages |
+ *
+ * An inode holds the kind of file, its size, when it was last written and
+ * the pages its data is in, one per PageSize bytes or 0 for a hole. A
+ * directory is a file of entries sorted by name:
+ *
+ * | inode | name length | name |
+ * <- 32 bits -><- 8 bits -><- name length bytes ->
+ *
+ * Free inodes and free pages are linked lists, through the inodes and
+ * through the page links, with their heads in the superblock. Inode 0 is
+ * the root directory.
+ *
+ * The server only sees accesses to blocks, but how many there are depends
+ * on the depth of a path, the size of the directories on it and the number
+ * of bytes read or written. Like the Client, a VFS is for one goroutine at
+ * a time.
+ */
+
+package oram2pc
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const vfs_magic = 0x7366766f // "ovfs"
+
+// kinds of inodes
+const (
+	kind_free = iota
+	kind_file
+	kind_dir
+)
+
+type VFSOptions struct {
+	Base     int // first block of the file system on the server
+	Inodes   int // files and directories, the root included
+	Pages    int // pages of file data
+	PageSize int // bytes per page, 64 if 0
+	Direct   int // pages per file, which caps the size of a file, 16 if 0
+}
+
+type superblock struct {
+	Magic     uint32
+	Inodes    uint32
+	Pages     uint32
+	PageSize  uint32
+	Direct    uint32
+	FreeInode uint32 // first free inode, 0 if none
+	FreePage  uint32 // first free page, 0 if none
+	FreeCount uint32 // number of free pages
+}
+
+type inode struct {
+	kind  uint32
+	next  uint32 // next free inode, while free
+	size  int64
+	mtime int64    // unix nanoseconds
+	pages []uint32 // Direct of them, numbered from 1
+}
+
+// inodes with room for direct pages
+type inode_encoder struct {
+	direct int
+}
+
+func (e inode_encoder) Size() int {
+	return 4 + 4 + 8 + 8 + 4*e.direct
+}
+
+func (e inode_encoder) Encode(nd inode, buf []byte) error {
+	binary.LittleEndian.PutUint32(buf, nd.kind)
+	binary.LittleEndian.PutUint32(buf[4:], nd.next)
+	binary.LittleEndian.PutUint64(buf[8:], uint64(nd.size))
+	binary.LittleEndian.PutUint64(buf[16:], uint64(nd.mtime))
+	for i := 0; i < e.direct; i++ {
+		var p uint32
+		if i < len(nd.pages) {
+			p = nd.pages[i]
+		}
+		binary.LittleEndian.PutUint32(buf[24+4*i:], p)
+	}
+
+	return nil
+}
+
+func (e inode_encoder) Decode(buf []byte) (inode, error) {
+	nd := inode{
+		kind:  binary.LittleEndian.Uint32(buf),
+		next:  binary.LittleEndian.Uint32(buf[4:]),
+		size:  int64(binary.LittleEndian.Uint64(buf[8:])),
+		mtime: int64(binary.LittleEndian.Uint64(buf[16:])),
+		pages: make([]uint32, e.direct),
+	}
+	for i := range nd.pages {
+		nd.pages[i] = binary.LittleEndian.Uint32(buf[24+4*i:])
+	}
+
+	return nd, nil
+}
+
+type VFS struct {
+	c      *Client
+	server string
+	sb     superblock
+
+	super  *ObliviousArray[superblock]
+	inodes *ObliviousArray[inode]
+	links  *ObliviousArray[uint32]
+	pages  *ObliviousArray[[]byte]
+}
+
+// lays the arrays of a file system out from block base
+func vfs_layout(c *Client, server string, base int, sb superblock) (*VFS, error) {
+	v := &VFS{c: c, server: server, sb: sb}
+	var err error
+	v.super, err = NewObliviousArray[superblock](c, server, base, 1, BinaryEncoder[superblock]{})
+	if err != nil {
+		return nil, err
+	}
+	base += v.super.NumBlocks()
+	v.inodes, err = NewObliviousArray[inode](c, server, base, int(sb.Inodes), inode_encoder{int(sb.Direct)})
+	if err != nil {
+		return nil, err
+	}
+	base += v.inodes.NumBlocks()
+	v.links, err = NewObliviousArray[uint32](c, server, base, int(sb.Pages), IntEncoder[uint32]{})
+	if err != nil {
+		return nil, err
+	}
+	base += v.links.NumBlocks()
+	v.pages, err = NewObliviousArray[[]byte](c, server, base, int(sb.Pages), BytesEncoder{Len: int(sb.PageSize)})
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+/*
+ * Makes an empty file system in the blocks of a server from opts.Base on,
+ * overwriting whatever they held
+ */
+func FormatVFS(c *Client, server string, opts VFSOptions) (*VFS, error) {
+	if opts.PageSize == 0 {
+		opts.PageSize = 64
+	}
+	if opts.Direct == 0 {
+		opts.Direct = 16
+	}
+	if opts.Inodes < 1 || opts.Pages < 1 || opts.PageSize < 0 || opts.Direct < 0 {
+		return nil, errors.New("File system needs at least one inode and one page!")
+	}
+
+	sb := superblock{
+		Magic:     vfs_magic,
+		Inodes:    uint32(opts.Inodes),
+		Pages:     uint32(opts.Pages),
+		PageSize:  uint32(opts.PageSize),
+		Direct:    uint32(opts.Direct),
+		FreePage:  1,
+		FreeCount: uint32(opts.Pages),
+	}
+	if opts.Inodes > 1 {
+		sb.FreeInode = 1
+	}
+	v, err := vfs_layout(c, server, opts.Base, sb)
+	if err != nil {
+		return nil, err
+	}
+
+	// the root, then every other inode and page on the free lists
+	err = v.put_inode(0, inode{kind: kind_dir, mtime: time.Now().UnixNano()})
+	if err != nil {
+		return nil, err
+	}
+	for i := 1; i < opts.Inodes; i++ {
+		err := v.put_inode(i, inode{next: uint32((i + 1) % opts.Inodes)})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for p := 1; p <= opts.Pages; p++ {
+		err := v.links.Set(p-1, uint32((p+1)%(opts.Pages+1)))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return v, v.save_super()
+}
+
+// mounts the file system FormatVFS made from block base of a server
+func OpenVFS(c *Client, server string, base int) (*VFS, error) {
+	super, err := NewObliviousArray[superblock](c, server, base, 1, BinaryEncoder[superblock]{})
+	if err != nil {
+		return nil, err
+	}
+	sb, err := super.Get(0)
+	if err != nil {
+		return nil, err
+	}
+	if sb.Magic != vfs_magic {
+		return nil, errors.New("No file system at that block!")
+	}
+
+	return vfs_layout(c, server, base, sb)
+}
+
+// the largest a file can get
+func (v *VFS) MaxFileSize() int64 {
+	return int64(v.sb.Direct) * int64(v.sb.PageSize)
+}
+
+// bytes of pages not used by any file
+func (v *VFS) FreeBytes() int64 {
+	return int64(v.sb.FreeCount) * int64(v.sb.PageSize)
+}
+
+func (v *VFS) save_super() error {
+	return v.super.Set(0, v.sb)
+}
+
+func (v *VFS) get_inode(ino int) (inode, error) {
+	return v.inodes.Get(ino)
+}
+
+func (v *VFS) put_inode(ino int, nd inode) error {
+	return v.inodes.Set(ino, nd)
+}
+
+func (v *VFS) alloc_inode(kind uint32) (int, error) {
+	ino := int(v.sb.FreeInode)
+	if ino == 0 {
+		return 0, errors.New("File system is out of inodes!")
+	}
+	nd, err := v.get_inode(ino)
+	if err != nil {
+		return 0, err
+	}
+
+	v.sb.FreeInode = nd.next
+	err = v.save_super()
+	if err != nil {
+		return 0, err
+	}
+
+	return ino, v.put_inode(ino, inode{kind: kind, mtime: time.Now().UnixNano()})
+}
+
+func (v *VFS) free_inode(ino int) error {
+	err := v.put_inode(ino, inode{next: v.sb.FreeInode})
+	if err != nil {
+		return err
+	}
+	v.sb.FreeInode = uint32(ino)
+
+	return v.save_super()
+}
+
+// takes a page off the free list, the caller checks there is one
+func (v *VFS) alloc_page() (uint32, error) {
+	p := v.sb.FreePage
+	next, err := v.links.Get(int(p) - 1)
+	if err != nil {
+		return 0, err
+	}
+	v.sb.FreePage = next
+	v.sb.FreeCount -= 1
+
+	return p, nil
+}
+
+func (v *VFS) free_page(p uint32) error {
+	err := v.links.Set(int(p)-1, v.sb.FreePage)
+	if err != nil {
+		return err
+	}
+	v.sb.FreePage = p
+	v.sb.FreeCount += 1
+
+	return nil
+}
+
+// reads from off into buf, up to the end of the file
+func (v *VFS) read_at(nd inode, buf []byte, off int64) (int, error) {
+	ps := int64(v.sb.PageSize)
+	n := 0
+	for n < len(buf) && off < nd.size {
+		i, o := off/ps, off%ps
+		m := int(min(ps-o, nd.size-off, int64(len(buf)-n)))
+		if p := nd.pages[i]; p == 0 {
+			clear(buf[n : n+m])
+		} else {
+			page, err := v.pages.Get(int(p) - 1)
+			if err != nil {
+				return n, err
+			}
+			copy(buf[n:n+m], page[o:])
+		}
+		n += m
+		off += int64(m)
+	}
+
+	return n, nil
+}
+
+// copies the overlap of src, at offset from, into dst, at offset at
+func copy_at(dst []byte, at int, src []byte, from int) {
+	lo, hi := max(at, from), min(at+len(dst), from+len(src))
+	if lo < hi {
+		copy(dst[lo-at:hi-at], src[lo-from:hi-from])
+	}
+}
+
+/*
+ * Writes data at off, allocating the pages it lands in. The inode is
+ * changed but not stored.
+ */
+func (v *VFS) write_at(nd *inode, data []byte, off int64) error {
+	if len(data) == 0 {
+		return nil
+	}
+	ps := int64(v.sb.PageSize)
+	end := off + int64(len(data))
+	if end > v.MaxFileSize() {
+		return errors.New("File would be larger than the maximum size!")
+	}
+	holes := 0
+	for i := off / ps; i*ps < end; i++ {
+		if nd.pages[i] == 0 {
+			holes += 1
+		}
+	}
+	if holes > int(v.sb.FreeCount) {
+		return errors.New("File system is full!")
+	}
+
+	for len(data) > 0 {
+		i, o := off/ps, off%ps
+		m := int(min(ps-o, int64(len(data))))
+		fresh := nd.pages[i] == 0
+		if fresh {
+			p, err := v.alloc_page()
+			if err != nil {
+				return err
+			}
+			nd.pages[i] = p
+		}
+
+		// a page fresh off the free list still has another file's data
+		_, err := v.pages.access(int(nd.pages[i])-1, func(part []byte, at int) {
+			if fresh {
+				clear(part)
+			}
+			copy_at(part, at, data[:m], int(o))
+		})
+		if err != nil {
+			return err
+		}
+		data = data[m:]
+		off += int64(m)
+	}
+	nd.size = max(nd.size, end)
+	nd.mtime = time.Now().UnixNano()
+
+	return v.save_super()
+}
+
+// cuts or extends a file to size, the inode is changed but not stored
+func (v *VFS) truncate(nd *inode, size int64) error {
+	if size > v.MaxFileSize() {
+		return errors.New("File would be larger than the maximum size!")
+	}
+	ps := int64(v.sb.PageSize)
+	keep := (size + ps - 1) / ps
+	for i := keep; i < int64(len(nd.pages)); i++ {
+		if nd.pages[i] != 0 {
+			err := v.free_page(nd.pages[i])
+			if err != nil {
+				return err
+			}
+			nd.pages[i] = 0
+		}
+	}
+
+	// what's past the end reads as zeros if the file grows again
+	if o := size % ps; o != 0 && size < nd.size && nd.pages[keep-1] != 0 {
+		_, err := v.pages.access(int(nd.pages[keep-1])-1, func(part []byte, at int) {
+			if at+len(part) > int(o) {
+				clear(part[max(int(o)-at, 0):])
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	nd.size = size
+	nd.mtime = time.Now().UnixNano()
+
+	return v.save_super()
+}
+
+type dir_entry struct {
+	name string
+	ino  int
+}
+
+func (v *VFS) read_dir(nd inode) ([]dir_entry, error) {
+	buf := make([]byte, nd.size)
+	_, err := v.read_at(nd, buf, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []dir_entry{}
+	for len(buf) > 0 {
+		if len(buf) < 5 || len(buf) < 5+int(buf[4]) {
+			return nil, integrity_err("directory entry cut short")
+		}
+		n := 5 + int(buf[4])
+		entries = append(entries, dir_entry{name: string(buf[5:n]), ino: int(binary.LittleEndian.Uint32(buf))})
+		buf = buf[n:]
+	}
+
+	return entries, nil
+}
+
+// stores the entries of directory ino, sorted by name
+func (v *VFS) write_dir(ino int, nd inode, entries []dir_entry) error {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	buf := []byte{}
+	for _, e := range entries {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(e.ino))
+		buf = append(buf, byte(len(e.name)))
+		buf = append(buf, e.name...)
+	}
+
+	err := v.write_at(&nd, buf, 0)
+	if err == nil {
+		err = v.truncate(&nd, int64(len(buf)))
+	}
+	if err != nil {
+		return err
+	}
+
+	return v.put_inode(ino, nd)
+}
+
+func (v *VFS) lookup(name string) (int, inode, error) {
+	if !fs.ValidPath(name) {
+		return 0, inode{}, fs.ErrInvalid
+	}
+	ino := 0
+	nd, err := v.get_inode(0)
+	if err != nil || name == "." {
+		return ino, nd, err
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		if nd.kind != kind_dir {
+			return 0, inode{}, fs.ErrNotExist
+		}
+		entries, err := v.read_dir(nd)
+		if err != nil {
+			return 0, inode{}, err
+		}
+		i := sort.Search(len(entries), func(i int) bool { return entries[i].name >= part })
+		if i == len(entries) || entries[i].name != part {
+			return 0, inode{}, fs.ErrNotExist
+		}
+		ino = entries[i].ino
+		nd, err = v.get_inode(ino)
+		if err != nil {
+			return 0, inode{}, err
+		}
+	}
+
+	return ino, nd, nil
+}
+
+// adds a new inode of kind to its parent's entries as name
+func (v *VFS) create(name string, kind uint32) (int, inode, error) {
+	if name == "." {
+		return 0, inode{}, fs.ErrExist
+	}
+	if len(path.Base(name)) > 255 {
+		return 0, inode{}, errors.New("File name is too long!")
+	}
+	dir, dnd, err := v.lookup(path.Dir(name))
+	if err != nil {
+		return 0, inode{}, err
+	}
+	if dnd.kind != kind_dir {
+		return 0, inode{}, errors.New("Not a directory!")
+	}
+
+	ino, err := v.alloc_inode(kind)
+	if err != nil {
+		return 0, inode{}, err
+	}
+	entries, err := v.read_dir(dnd)
+	if err == nil {
+		err = v.write_dir(dir, dnd, append(entries, dir_entry{name: path.Base(name), ino: ino}))
+	}
+	if err != nil {
+		v.free_inode(ino)
+		return 0, inode{}, err
+	}
+	nd, err := v.get_inode(ino)
+
+	return ino, nd, err
+}
+
+func path_err(op string, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+func (v *VFS) Mkdir(name string) error {
+	_, _, err := v.lookup(name)
+	if err == nil {
+		return path_err("mkdir", name, fs.ErrExist)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return path_err("mkdir", name, err)
+	}
+
+	_, _, err = v.create(name, kind_dir)
+	return path_err("mkdir", name, err)
+}
+
+// makes an empty file, or empties the file there is
+func (v *VFS) Create(name string) error {
+	ino, nd, err := v.lookup(name)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		_, _, err = v.create(name, kind_file)
+	case err != nil:
+	case nd.kind != kind_file:
+		err = errors.New("Is a directory!")
+	default:
+		err = v.truncate(&nd, 0)
+		if err == nil {
+			err = v.put_inode(ino, nd)
+		}
+	}
+
+	return path_err("create", name, err)
+}
+
+// the inode of the file name, which has to be a regular file
+func (v *VFS) file(name string) (int, inode, error) {
+	ino, nd, err := v.lookup(name)
+	if err == nil && nd.kind != kind_file {
+		err = errors.New("Is a directory!")
+	}
+
+	return ino, nd, err
+}
+
+// writes data at off in an existing file, growing it if need be
+func (v *VFS) WriteAt(name string, data []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, path_err("write", name, fs.ErrInvalid)
+	}
+	ino, nd, err := v.file(name)
+	if err == nil {
+		err = v.write_at(&nd, data, off)
+	}
+	if err == nil {
+		err = v.put_inode(ino, nd)
+	}
+	if err != nil {
+		return 0, path_err("write", name, err)
+	}
+
+	return len(data), nil
+}
+
+// creates or replaces the file name with data
+func (v *VFS) WriteFile(name string, data []byte) error {
+	if int64(len(data)) > v.MaxFileSize() {
+		return path_err("write", name, errors.New("File would be larger than the maximum size!"))
+	}
+	err := v.Create(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = v.WriteAt(name, data, 0)
+	return err
+}
+
+func (v *VFS) Truncate(name string, size int64) error {
+	if size < 0 {
+		return path_err("truncate", name, fs.ErrInvalid)
+	}
+	ino, nd, err := v.file(name)
+	if err == nil {
+		err = v.truncate(&nd, size)
+	}
+	if err == nil {
+		err = v.put_inode(ino, nd)
+	}
+
+	return path_err("truncate", name, err)
+}
+
+// removes a file or an empty directory
+func (v *VFS) Remove(name string) error {
+	if name == "." {
+		return path_err("remove", name, fs.ErrInvalid)
+	}
+	ino, nd, err := v.lookup(name)
+	if err != nil {
+		return path_err("remove", name, err)
+	}
+	if nd.kind == kind_dir && nd.size > 0 {
+		return path_err("remove", name, errors.New("Directory not empty!"))
+	}
+
+	dir, dnd, err := v.lookup(path.Dir(name))
+	if err != nil {
+		return path_err("remove", name, err)
+	}
+	entries, err := v.read_dir(dnd)
+	if err != nil {
+		return path_err("remove", name, err)
+	}
+	kept := entries[:0]
+	for _, e := range entries {
+		if e.ino != ino {
+			kept = append(kept, e)
+		}
+	}
+	err = v.write_dir(dir, dnd, kept)
+	if err == nil {
+		err = v.truncate(&nd, 0)
+	}
+	if err == nil {
+		err = v.free_inode(ino)
+	}
+
+	return path_err("remove", name, err)
+}
+
+/*
+ * io/fs
+ */
+
+type vfs_info struct {
+	name string
+	nd   inode
+}
+
+func (fi vfs_info) Name() string       { return fi.name }
+func (fi vfs_info) Size() int64        { return fi.nd.size }
+func (fi vfs_info) ModTime() time.Time { return time.Unix(0, fi.nd.mtime) }
+func (fi vfs_info) IsDir() bool        { return fi.nd.kind == kind_dir }
+func (fi vfs_info) Sys() any           { return nil }
+
+func (fi vfs_info) Mode() fs.FileMode {
+	if fi.IsDir() {
+		return fs.ModeDir | 0755
+	}
+
+	return 0644
+}
+
+// an open file or directory, reading what's there at the time of each call
+type vfs_file struct {
+	v    *VFS
+	name string
+	ino  int
+	off  int64
+
+	entries []fs.DirEntry // of a directory, once ReadDir is called
+}
+
+func (v *VFS) Open(name string) (fs.File, error) {
+	ino, _, err := v.lookup(name)
+	if err != nil {
+		return nil, path_err("open", name, err)
+	}
+
+	return &vfs_file{v: v, name: name, ino: ino}, nil
+}
+
+func (f *vfs_file) Stat() (fs.FileInfo, error) {
+	nd, err := f.v.get_inode(f.ino)
+	if err != nil {
+		return nil, path_err("stat", f.name, err)
+	}
+
+	return vfs_info{name: path.Base(f.name), nd: nd}, nil
+}
+
+func (f *vfs_file) ReadAt(buf []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, path_err("read", f.name, fs.ErrInvalid)
+	}
+	nd, err := f.v.get_inode(f.ino)
+	if err == nil && nd.kind != kind_file {
+		err = errors.New("Is a directory!")
+	}
+	if err != nil {
+		return 0, path_err("read", f.name, err)
+	}
+
+	n, err := f.v.read_at(nd, buf, off)
+	if err != nil {
+		return n, path_err("read", f.name, err)
+	}
+	if n < len(buf) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (f *vfs_file) Read(buf []byte) (int, error) {
+	n, err := f.ReadAt(buf, f.off)
+	f.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+
+	return n, err
+}
+
+func (f *vfs_file) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		nd, err := f.v.get_inode(f.ino)
+		if err != nil {
+			return 0, path_err("seek", f.name, err)
+		}
+		offset += nd.size
+	default:
+		return 0, path_err("seek", f.name, fs.ErrInvalid)
+	}
+	if offset < 0 {
+		return 0, path_err("seek", f.name, fs.ErrInvalid)
+	}
+	f.off = offset
+
+	return offset, nil
+}
+
+func (f *vfs_file) ReadDir(n int) ([]fs.DirEntry, error) {
+	if f.entries == nil {
+		entries, err := f.v.ReadDir(f.name)
+		if err != nil {
+			return nil, err
+		}
+		f.entries = entries
+	}
+
+	if n <= 0 {
+		entries := f.entries
+		f.entries = f.entries[len(f.entries):]
+		return entries, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(f.entries))
+	entries := f.entries[:n]
+	f.entries = f.entries[n:]
+
+	return entries, nil
+}
+
+func (f *vfs_file) Close() error {
+	return nil
+}
+
+func (v *VFS) Stat(name string) (fs.FileInfo, error) {
+	_, nd, err := v.lookup(name)
+	if err != nil {
+		return nil, path_err("stat", name, err)
+	}
+
+	return vfs_info{name: path.Base(name), nd: nd}, nil
+}
+
+// the entries of directory name, sorted by name
+func (v *VFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	_, nd, err := v.lookup(name)
+	if err == nil && nd.kind != kind_dir {
+		err = errors.New("Not a directory!")
+	}
+	if err != nil {
+		return nil, path_err("readdir", name, err)
+	}
+	entries, err := v.read_dir(nd)
+	if err != nil {
+		return nil, path_err("readdir", name, err)
+	}
+
+	list := make([]fs.DirEntry, len(entries))
+	for i, e := range entries {
+		nd, err := v.get_inode(e.ino)
+		if err != nil {
+			return nil, path_err("readdir", name, err)
+		}
+		list[i] = fs.FileInfoToDirEntry(vfs_info{name: e.name, nd: nd})
+	}
+
+	return list, nil
+}
+
+func (v *VFS) ReadFile(name string) ([]byte, error) {
+	_, nd, err := v.file(name)
+	if err != nil {
+		return nil, path_err("read", name, err)
+	}
+
+	buf := make([]byte, nd.size)
+	_, err = v.read_at(nd, buf, 0)
+	if err != nil {
+		return nil, path_err("read", name, err)
+	}
+
+	return buf, nil
+}
@@ -0,0 +1,197 @@
+package oram2pc
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func new_test_vfs(t *testing.T, c *Client) *VFS {
+	err := c.AddServerAt("test", c.N, 4, 4096, filepath.Join(t.TempDir(), "tree"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := FormatVFS(c, "test", VFSOptions{Base: 8, Inodes: 16, Pages: 40, PageSize: 16, Direct: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return v
+}
+
+func Test_vfs(t *testing.T) {
+	c := InitClient(256, 4)
+	v := new_test_vfs(t, c)
+	defer c.RemoveServer("test")
+
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(v.Mkdir("docs"))
+	must(v.Mkdir("docs/old"))
+	must(v.WriteFile("docs/a.txt", []byte("a file spread over a few pages")))
+	must(v.WriteFile("docs/old/b", []byte("b")))
+	must(v.WriteFile("top", nil))
+
+	err := fstest.TestFS(v, "docs", "docs/a.txt", "docs/old", "docs/old/b", "top")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := v.Mkdir("docs"); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("mkdir of an existing directory: %v", err)
+	}
+	if err := v.WriteFile("nope/x", nil); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("write in a missing directory: %v", err)
+	}
+	if err := v.WriteFile("top/x", nil); err == nil {
+		t.Error("wrote a file inside a file")
+	}
+	if err := v.Remove("docs"); err == nil {
+		t.Error("removed a directory that isn't empty")
+	}
+	if _, err := v.Open("../x"); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("opened an invalid path: %v", err)
+	}
+
+	// removing everything gives every page back
+	free := v.FreeBytes()
+	must(v.Remove("docs/old/b"))
+	must(v.Remove("docs/old"))
+	must(v.Remove("docs/a.txt"))
+	must(v.Remove("docs"))
+	must(v.Remove("top"))
+	if v.FreeBytes() != 40*16 || free >= 40*16 {
+		t.Errorf("%d bytes free after removing everything, %d before", v.FreeBytes(), free)
+	}
+	if entries, _ := v.ReadDir("."); len(entries) != 0 {
+		t.Errorf("root still has %d entries", len(entries))
+	}
+}
+
+func Test_vfs_write_at(t *testing.T) {
+	c := InitClient(256, 4)
+	v := new_test_vfs(t, c)
+	defer c.RemoveServer("test")
+
+	err := v.Create("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	model := []byte{}
+	write := func(off int, data string) {
+		t.Helper()
+		_, err := v.WriteAt("f", []byte(data), int64(off))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(model) < off+len(data) {
+			model = append(model, make([]byte, off+len(data)-len(model))...)
+		}
+		copy(model[off:], data)
+	}
+	truncate := func(size int) {
+		t.Helper()
+		err := v.Truncate("f", int64(size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size < len(model) {
+			model = model[:size]
+		} else {
+			model = append(model, make([]byte, size-len(model))...)
+		}
+	}
+	check := func(what string) {
+		t.Helper()
+		data, err := v.ReadFile("f")
+		if err != nil || !bytes.Equal(data, model) {
+			t.Errorf("%s: got %q, want %q (%v)", what, data, model, err)
+		}
+	}
+
+	write(0, "hello")
+	write(40, "past a hole")
+	check("hole")
+	write(3, "LO, world across pages")
+	check("overwrite")
+	truncate(20)
+	check("shrink")
+	truncate(70)
+	check("grow")
+	write(100, "end")
+	check("end")
+
+	// a page freed by one file reads as zeros in the next
+	v.WriteFile("g", bytes.Repeat([]byte{'x'}, 64))
+	v.Remove("g")
+	v.WriteFile("g", nil)
+	v.WriteAt("g", []byte("y"), 30)
+	if data, _ := v.ReadFile("g"); !bytes.Equal(data, append(make([]byte, 30), 'y')) {
+		t.Errorf("reused pages: got %q", data)
+	}
+
+	f, _ := v.Open("f")
+	defer f.Close()
+	buf := make([]byte, 4)
+	n, err := f.(io.ReaderAt).ReadAt(buf, 101)
+	if n != 2 || err != io.EOF || string(buf[:2]) != "nd" {
+		t.Errorf("read at the end: %d %q (%v)", n, buf[:n], err)
+	}
+
+	if _, err := v.WriteAt("f", []byte("x"), v.MaxFileSize()); err == nil {
+		t.Error("wrote past the maximum file size")
+	}
+	if err := v.WriteFile("big", make([]byte, 41*16)); err == nil {
+		t.Error("wrote more than the file system holds")
+	}
+}
+
+func Test_vfs_persist(t *testing.T) {
+	dir := t.TempDir()
+	state := filepath.Join(dir, "state")
+
+	c := InitClient(512, 4)
+	err := c.AddServerAt("test", 512, 4, 4096, filepath.Join(dir, "tree"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := FormatVFS(c, "test", VFSOptions{Base: 100, Inodes: 8, Pages: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.Mkdir("d")
+	v.WriteFile("d/f", []byte("kept in the tree"))
+	err = c.Save(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	c2, err := LoadClient(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.RemoveServer("test")
+	if _, err := OpenVFS(c2, "test", 0); err == nil {
+		t.Error("opened a file system where there is none")
+	}
+	v2, err := OpenVFS(c2, "test", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := fs.ReadFile(v2, "d/f")
+	if err != nil || string(data) != "kept in the tree" {
+		t.Errorf("after reload: %q (%v)", data, err)
+	}
+	if v2.FreeBytes() != v.FreeBytes() {
+		t.Errorf("%d bytes free after reload, %d before", v2.FreeBytes(), v.FreeBytes())
+	}
+}
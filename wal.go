@@ -0,0 +1,276 @@
+/*
+ * Write-ahead log for path write back
+ *
+ * Once a client has been saved, every write back first appends a record to
+ * a log next to the state file: the new buckets of the path plus what
+ * changed in the client state (position map entries and the stash after
+ * eviction, sealed like in the state file, see keys.go). Only once the record is synced are the buckets written to the
+ * tree. Opening the client replays the records the state file is missing,
+ * and a torn record at the end (a crash while logging) is dropped, which
+ * rolls that access back since none of its buckets were written yet.
+ *
+ * Save is the checkpoint: the state file then holds everything and the log
+ * is emptied.
+ */
+
+package oram2pc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash/crc32"
+	"os"
+)
+
+// the log is checkpointed into the state file once it's this big
+const wal_max_size = 4 << 20
+
+/*
+ * Test hook to simulate a crash: called at each step of a write back, a
+ * true return makes that step the last thing that happens
+ */
+var crash_at func(point string) bool
+
+var err_crash = errors.New("Simulated crash!")
+
+func crash(point string) bool {
+	return crash_at != nil && crash_at(point)
+}
+
+type wal_record struct {
+	Seq     uint64
+	Leaf    int
+	Buckets [][]byte // the path's buckets from the root down, encrypted
+	State   []byte // the record's wal_secrets, sealed under the key of Epoch
+	Fetched []int // buckets left stale on the server, see evict.go
+	Epoch   int   // the key the buckets are under
+
+	// a key rotation sweep writes these buckets instead of a path, and
+	// nothing else changes
+	Nodes []int
+}
+
+// what a path record keeps from the server
+type wal_secrets struct {
+	Pos   map[int]int
+	Stash []Block
+}
+
+type wal struct {
+	path string
+	seq  uint64 // sequence number of the last record written or replayed
+	size int64
+}
+
+func wal_path(state string, server string) string {
+	return state + "." + server + ".wal"
+}
+
+/*
+ * Appends rec and syncs it. Records are framed as
+ * | length | crc32 | gob of the record |
+ * <- 32 bits -><- 32 bits -><- length bytes ->
+ */
+func (w *wal) append(rec wal_record) error {
+	// a failed append may still reach the disk, so never reuse its number
+	w.seq += 1
+	rec.Seq = w.seq
+
+	var payload bytes.Buffer
+	err := gob.NewEncoder(&payload).Encode(rec)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 8, 8+payload.Len())
+	binary.LittleEndian.PutUint32(buf, uint32(payload.Len()))
+	binary.LittleEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(payload.Bytes()))
+	buf = append(buf, payload.Bytes()...)
+
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return storage_err("append to log", err)
+	}
+	defer f.Close()
+
+	if crash("wal torn") {
+		f.Write(buf[:len(buf)/2])
+		return err_crash
+	}
+
+	_, err = f.Write(buf)
+	if err != nil {
+		return storage_err("append to log", err)
+	}
+	if crash("wal written") {
+		return err_crash
+	}
+
+	err = f.Sync()
+	if err != nil {
+		return storage_err("sync log", err)
+	}
+	if crash("wal synced") {
+		return err_crash
+	}
+
+	w.size += int64(len(buf))
+
+	return nil
+}
+
+/*
+ * Reads every complete record in the log. A torn or corrupt record ends the
+ * log and is cut off, along with anything after it.
+ */
+func (w *wal) read() ([]wal_record, error) {
+	data, err := os.ReadFile(w.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, storage_err("read log", err)
+	}
+
+	recs := []wal_record{}
+	off := 0
+	for off+8 <= len(data) {
+		n := int(binary.LittleEndian.Uint32(data[off:]))
+		sum := binary.LittleEndian.Uint32(data[off+4:])
+		if n > len(data)-off-8 || crc32.ChecksumIEEE(data[off+8:off+8+n]) != sum {
+			break
+		}
+
+		var rec wal_record
+		err := gob.NewDecoder(bytes.NewReader(data[off+8 : off+8+n])).Decode(&rec)
+		if err != nil {
+			break
+		}
+		recs = append(recs, rec)
+		off += 8 + n
+	}
+
+	if off < len(data) {
+		logger.Warn("oram: dropping torn log record", "log", w.path, "bytes", len(data)-off)
+		err := os.Truncate(w.path, int64(off))
+		if err != nil {
+			return nil, storage_err("truncate log", err)
+		}
+	}
+	w.size = int64(off)
+
+	return recs, nil
+}
+
+// empties the log once the state file has everything in it
+func (w *wal) reset() error {
+	if w.path == "" {
+		return nil
+	}
+
+	err := os.Remove(w.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return storage_err("reset log", err)
+	}
+	w.size = 0
+
+	return nil
+}
+
+/*
+ * Redoes the records of a server's log that are newer than the state file,
+ * writing their buckets and bringing the position map, stash and key
+ * rotation up to date
+ */
+func (c *Client) replay(name string, w *wal) error {
+	recs, err := w.read()
+	if err != nil {
+		return err
+	}
+
+	s := c.servers[name]
+	replayed := false
+	for _, rec := range recs {
+		if rec.Seq <= w.seq {
+			continue
+		}
+
+		nodes, err := rec.nodes(s)
+		if err != nil {
+			return err
+		}
+		var sec wal_secrets
+		if rec.Nodes == nil {
+			err := c.open_state(name, rec.Epoch, rec.State, &sec)
+			if err != nil {
+				return err
+			}
+		}
+		for i, nd := range nodes {
+			err := s.write_node(s.bytes_bucket(rec.Buckets[i]), nd.l, nd.n)
+			if err != nil {
+				return err
+			}
+		}
+		if k := c.keys[name]; rec.Epoch == k.epoch {
+			k.written(nodes)
+		}
+		w.seq = rec.Seq
+		c.log().Info("oram: replayed log record", "server", name, "seq", rec.Seq)
+		if rec.Nodes != nil {
+			continue
+		}
+
+		for a, x := range sec.Pos {
+			c.pos[name][a] = x
+		}
+		c.stash[name].blks = sec.Stash
+		c.evict[name].set_fetched(rec.Fetched)
+		replayed = true
+	}
+
+	// the first record after a save rewrites any path the save left dirty
+	if replayed {
+		delete(c.dirty, name)
+	}
+
+	return nil
+}
+
+// the nodes rec has buckets for
+func (rec *wal_record) nodes(s *Server) ([]node, error) {
+	var nodes []node
+	if rec.Nodes != nil {
+		for _, id := range rec.Nodes {
+			nodes = append(nodes, id_node(id))
+		}
+	} else {
+		path, err := s.get_path(rec.Leaf)
+		if err != nil {
+			return nil, integrity_err("log record %d doesn't fit the tree", rec.Seq)
+		}
+		for l, n := range path {
+			nodes = append(nodes, node{l, n})
+		}
+	}
+
+	for _, nd := range nodes {
+		if len(rec.Buckets) != len(nodes) || nd.n >= s.width(nd.l) {
+			return nil, integrity_err("log record %d doesn't fit the tree", rec.Seq)
+		}
+	}
+
+	return nodes, nil
+}
+
+// splits the bytes of a bucket back into its blocks
+func bytes_bucket(b []byte, size int) Bucket {
+	bucket := make(Bucket, len(b)/size)
+	for i := range bucket {
+		bucket[i] = b[i*size : (i+1)*size]
+	}
+
+	return bucket
+}
@@ -0,0 +1,151 @@
+package oram2pc
+
+import (
+	"errors"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// every step of a write back and a checkpoint the client can die at
+func crash_points(L int) []string {
+	points := []string{"wal torn", "wal written", "wal synced"}
+	for l := 0; l <= L; l++ {
+		points = append(points, "apply "+strconv.Itoa(l))
+	}
+
+	return append(points, "checkpoint")
+}
+
+func Test_wal_crash(t *testing.T) {
+	defer func() { crash_at = nil }()
+
+	for _, point := range crash_points(4) {
+		wal_crash(t, BackendFiles, point)
+	}
+
+	// the single file writes runs of adjacent buckets, a path has at least one
+	for _, point := range crash_points(0) {
+		wal_crash(t, BackendSingle, point)
+	}
+}
+
+// dies at point while writing block 3, then recovers from the state file
+func wal_crash(t *testing.T, backend Backend, point string) {
+	dir := t.TempDir()
+	state := filepath.Join(dir, "state")
+
+	c := InitClient(16, 4)
+	err := c.AddServerWith("test", 16, 4, ServerOptions{Backend: backend, Dir: filepath.Join(dir, "tree")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := backend.String() + ", " + point
+	for a := 0; a < 16; a++ {
+		c.Access("test", true, a, uint64(a))
+	}
+	err = c.Save(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// some logged accesses the state file doesn't have yet
+	for a := 0; a < 8; a++ {
+		c.Access("test", true, a, uint64(a)+100)
+	}
+
+	crash_at = func(p string) bool { return p == point }
+	_, err = c.Access("test", true, 3, 999)
+	if point == "checkpoint" && err == nil {
+		err = c.Save(state)
+	}
+	crash_at = nil
+	if !errors.Is(err, err_crash) {
+		t.Fatalf("%s: expected a crash, got %v", name, err)
+	}
+
+	c2, err := LoadClient(state)
+	if err != nil {
+		t.Fatalf("%s: recovery failed: %v", name, err)
+	}
+
+	// the crashed write happened iff its log record made it to disk
+	committed := point != "wal torn"
+	for a := 0; a < 16; a++ {
+		want := uint64(a)
+		if a < 8 {
+			want += 100
+		}
+		if a == 3 && committed {
+			want = 999
+		}
+
+		v, err := c2.Access("test", false, a, 0)
+		if err != nil || v != want {
+			t.Errorf("%s: block %d: got %d, want %d (%v)", name, a, v, want, err)
+		}
+	}
+
+	st, err := c2.Stats("test")
+	if err != nil || st.TreeBlocks+st.StashBlocks != 16 {
+		t.Errorf("%s: blocks lost or duplicated: %+v, %v", name, st, err)
+	}
+
+	// and it recovers again from its own log
+	c3, err := LoadClient(state)
+	if err != nil {
+		t.Fatalf("%s: second recovery failed: %v", name, err)
+	}
+	vals, err := c3.Dump("test")
+	if err != nil || len(vals) != 16 {
+		t.Errorf("%s: second recovery: %d blocks, %v", name, len(vals), err)
+	}
+}
+
+func Test_wal_checkpoint(t *testing.T) {
+	dir := t.TempDir()
+	state := filepath.Join(dir, "state")
+
+	c := InitClient(16, 4)
+	err := c.AddServerAt("test", 16, 4, 4096, filepath.Join(dir, "tree"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.wals) != 0 {
+		t.Error("a client without a state file shouldn't log")
+	}
+
+	err = c.Save(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for a := 0; a < 16; a++ {
+		c.Access("test", true, a, uint64(a))
+	}
+
+	w := c.wals["test"]
+	if w.seq != 16 || w.size == 0 {
+		t.Errorf("log after 16 accesses: seq %d, %d bytes", w.seq, w.size)
+	}
+
+	err = c.Save(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs, err := w.read()
+	if err != nil || len(recs) != 0 {
+		t.Errorf("log not emptied by a save: %d records, %v", len(recs), err)
+	}
+}
+
+// a server's log is named after it, so its name can't lead out of the directory
+func Test_wal_server_name(t *testing.T) {
+	c := InitClient(16, 4)
+	for _, name := range []string{"a/b", "../b", string(filepath.Separator) + "b"} {
+		err := c.AddServer(name, 16, 4, 4096)
+		if err == nil {
+			c.RemoveServer(name)
+			t.Errorf("added a server named %q", name)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+/*
+ * Write-only ORAM, after HIVE (Blass et al., CCS '14)
+ *
+ * For stores that only need to hide which blocks are written, like
+ * encrypted logs on shared storage. A write-only server keeps its buckets
+ * the same way as any other, but they aren't a tree: a bucket is just Z
+ * slots, and the client remembers which slot every block is in instead of
+ * a leaf.
+ *
+ *   a read  fetches the one bucket the block's slot is in, or nothing if it is
+ *           in the stash or was never written, so it hides nothing
+ *   a write puts the block in the stash, then reads wo_buckets random
+ *           buckets and writes them back with as many stash blocks as fit
+ *           in their free slots
+ *
+ * A slot is free if it holds a dummy block or an old copy of a block that
+ * has been written again since, unless the last Save still has the block
+ * there. A tree has more than twice as many slots as blocks, so each write
+ * finds free slots for more blocks than it adds and the stash stays small,
+ * as long as the client saves now and then.
+ *
+ * Writes aren't logged, so a write is only durable after a Save. What the
+ * last Save points to is never overwritten, so a client loaded from it
+ * after a crash finds every block as it was then.
+ */
+
+package oram2pc
+
+import (
+	"crypto/subtle"
+	"time"
+)
+
+// buckets rewritten by every write
+const wo_buckets = 2
+
+// write-only state of a server
+type wo_state struct {
+	pos   map[int]int // slot of every block not in the stash
+	saved map[int]int // pos as of the last Save
+}
+
+// a write-only server loaded with pos, as saved
+func new_wo_state(pos map[int]int) *wo_state {
+	if pos == nil {
+		pos = make(map[int]int)
+	}
+
+	w := &wo_state{pos: pos}
+	w.checkpoint()
+	return w
+}
+
+// slots are numbered by bucket in heap order, Z to a bucket
+func wo_slot(nd node, z int, Z int) int {
+	return heap_id(nd)*Z + z
+}
+
+// remembers where every block is as of a Save
+func (w *wo_state) checkpoint() {
+	w.saved = make(map[int]int, len(w.pos))
+	for a, x := range w.pos {
+		w.saved[a] = x
+	}
+}
+
+// whether slot x, holding blk, can take another block
+func (w *wo_state) free(blk Block, x int) bool {
+	id, _, dummy := block_decode(blk)
+	if dummy {
+		return true
+	}
+	cur, prs := w.pos[id]
+	old, was := w.saved[id]
+
+	return (prs == false || cur != x) && (was == false || old != x)
+}
+
+// whether blk, found in slot x, is a dummy or an old copy
+func (w *wo_state) stale(blk Block, x int) bool {
+	id, _, dummy := block_decode(blk)
+	if dummy {
+		return true
+	}
+	cur, prs := w.pos[id]
+
+	return prs == false || cur != x
+}
+
+/*
+ * Takes the first real block out of the stash, returns it and 1 if there
+ * was one
+ */
+func (st *stash) take_any() (Block, int) {
+	out := dummy_block()
+	done := 0
+	for i := range st.blks {
+		take := (1 - ct_is_dummy(st.blks[i])) & (1 - done)
+		subtle.ConstantTimeCopy(take, out, st.blks[i])
+		subtle.ConstantTimeCopy(take, st.blks[i], ct_dummy)
+		done |= take
+		st.touches += 1
+	}
+
+	return out, done
+}
+
+// checks that block a exists and the server is ready to be accessed
+func (c *Client) wo_check(name string, a int) error {
+	err := c.flush_dirty(name)
+	if err != nil {
+		return err
+	}
+
+	return c.check_addr(a)
+}
+
+// reads block a straight from its slot
+func (c *Client) wo_read(name string, a int) (uint64, error) {
+	err := c.wo_check(name, a)
+	if err != nil {
+		return 0, err
+	}
+	s := c.servers[name]
+	w := c.wo[name]
+
+	var m AccessMetrics
+	x, prs := w.pos[a]
+	if prs == false {
+		start := time.Now()
+		val, err := c.stash[name].access(a, false, 0, 0)
+		m.Stash = time.Since(start)
+		if err == nil {
+			c.observe_access(name, m)
+		}
+		return val, err
+	}
+
+	nd := id_node(x / s.Z)
+	io_start := s.io_stats()
+	start := time.Now()
+	bucket, err := s.read_node(nd.l, nd.n)
+	if err != nil {
+		return 0, err
+	}
+	m.Read = time.Since(start)
+	m.BytesRead = s.io_stats().BytesRead - io_start.BytesRead
+
+	start = time.Now()
+	blks, err := c.open_bucket(name, nd, bucket)
+	if err != nil {
+		return 0, err
+	}
+	m.Decrypt = time.Since(start)
+
+	id, val, dummy := block_decode(blks[x%s.Z])
+	if dummy || id != a {
+		return 0, integrity_err("block %d missing from slot %d", a, x)
+	}
+	c.observe_access(name, m)
+
+	return val, nil
+}
+
+// random distinct buckets of s
+func wo_pick(s *Server, n int) []node {
+	n = min(n, s.buckets())
+	picked := make(map[node]bool)
+	nodes := make([]node, 0, n)
+	for len(nodes) < n {
+		nd := id_node(gen_int((2 << uint(s.L)) - 1))
+		if nd.n < s.width(nd.l) && picked[nd] == false {
+			picked[nd] = true
+			nodes = append(nodes, nd)
+		}
+	}
+
+	return nodes
+}
+
+/*
+ * Writes block a through the stash, rewriting wo_buckets random buckets
+ *
+ * If the buckets can't be rewritten the error is returned, but the write
+ * still happened: the block stays in the stash like every block that was
+ * on its way out, and goes to the server with a later write.
+ */
+func (c *Client) wo_write(name string, a int, data uint64) error {
+	err := c.wo_check(name, a)
+	if err != nil {
+		return err
+	}
+	s := c.servers[name]
+	w := c.wo[name]
+	st := c.stash[name]
+
+	var m AccessMetrics
+	start := time.Now()
+	_, err = st.access(a, true, data, 0)
+	if err != nil {
+		return err
+	}
+	delete(w.pos, a)
+	saved := st.snapshot()
+	m.Stash = time.Since(start)
+
+	nodes := wo_pick(s, wo_buckets)
+	io_start := s.io_stats()
+	start = time.Now()
+	buckets, err := s.read_nodes(nodes)
+	if err != nil {
+		return err
+	}
+	m.Read = time.Since(start)
+	m.BytesRead = s.io_stats().BytesRead - io_start.BytesRead
+
+	// fill free slots from the stash, the blocks moved are only mapped to
+	// their slot once it's written
+	moved := make(map[int]int)
+	start = time.Now()
+	for i := range buckets {
+		blks, err := c.open_bucket(name, nodes[i], buckets[i])
+		if err != nil {
+			st.restore(saved)
+			return err
+		}
+		for z := range blks {
+			x := wo_slot(nodes[i], z, s.Z)
+			if w.free(blks[z], x) == false {
+				continue
+			}
+			blk, _ := st.take_any()
+			if id, _, dummy := block_decode(blk); !dummy {
+				moved[id] = x
+			}
+			blks[z] = blk
+		}
+		buckets[i] = c.seal_bucket(name, nodes[i], blks)
+	}
+
+	io_start = s.io_stats()
+	err = s.write_nodes(nodes, buckets)
+	if err != nil {
+		st.restore(saved)
+		c.log().Error("oram: write-only write failed", "server", name, "err", err)
+		return err
+	}
+	m.Write = time.Since(start)
+	m.BytesWritten = s.io_stats().BytesWritten - io_start.BytesWritten
+	m.Evicted = len(moved)
+	c.keys[name].written(nodes)
+	for id, x := range moved {
+		w.pos[id] = x
+	}
+	c.observe_access(name, m)
+
+	return nil
+}
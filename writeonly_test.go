@@ -0,0 +1,166 @@
+package oram2pc
+
+import (
+	"errors"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func Test_write_only(t *testing.T) {
+	dir := t.TempDir()
+	c := InitClient(64, 4)
+	err := c.AddServerWith("test", 64, 4, ServerOptions{Dir: filepath.Join(dir, "tree"), WriteOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a write rewrites wo_buckets buckets, a read reads at most one
+	bucket := int64(4 * 32)
+	rec := &record_metrics{io: make(map[string]int)}
+	c.SetMetrics(rec)
+	model := make(map[int]uint64)
+	for i := 0; i < 500; i++ {
+		a := rand.Intn(64)
+		start := c.ServerIO("test")
+		if rand.Intn(2) == 0 {
+			v := rand.Uint64()
+			_, err := c.Access("test", true, a, v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			model[a] = v
+
+			io := c.ServerIO("test")
+			if io.BytesRead-start.BytesRead != wo_buckets*bucket || io.BytesWritten-start.BytesWritten != wo_buckets*bucket {
+				t.Fatalf("write did %d bytes of reads and %d of writes", io.BytesRead-start.BytesRead, io.BytesWritten-start.BytesWritten)
+			}
+		} else {
+			v, err := c.Access("test", false, a, 0)
+			if err != nil || v != model[a] {
+				t.Fatalf("block %d: got %d, want %d (%v)", a, v, model[a], err)
+			}
+
+			io := c.ServerIO("test")
+			if io.BytesRead-start.BytesRead > bucket || io.BytesWritten != start.BytesWritten {
+				t.Fatalf("read did %d bytes of reads and %d of writes", io.BytesRead-start.BytesRead, io.BytesWritten-start.BytesWritten)
+			}
+		}
+		if c.StashSize("test") > 8 {
+			t.Fatalf("stash holds %d blocks", c.StashSize("test"))
+		}
+	}
+
+	if len(rec.accesses) != 500 {
+		t.Errorf("%d accesses observed, want 500", len(rec.accesses))
+	}
+	for _, m := range rec.accesses {
+		if m.BytesWritten != 0 && m.BytesWritten != wo_buckets*bucket {
+			t.Fatalf("observed a write of %d bytes", m.BytesWritten)
+		}
+	}
+	c.SetMetrics(nil)
+
+	vals, err := c.Dump("test")
+	if err != nil || len(vals) != len(model) {
+		t.Fatalf("dump: got %d blocks, want %d (%v)", len(vals), len(model), err)
+	}
+	for a, v := range model {
+		if vals[a] != v {
+			t.Errorf("dump: block %d is %d, want %d", a, vals[a], v)
+		}
+	}
+
+	// the block map survives a save
+	state := filepath.Join(dir, "state")
+	err = c.Save(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := LoadClient(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.RemoveServer("test")
+	for a, v := range model {
+		got, err := c2.Access("test", false, a, 0)
+		if err != nil || got != v {
+			t.Errorf("block %d after load: got %d, want %d (%v)", a, got, v, err)
+		}
+	}
+	_, err = c2.Access("test", true, 3, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := c2.Access("test", false, 3, 0); v != 9 {
+		t.Errorf("write after load: got %d", v)
+	}
+}
+
+func Test_write_only_errors(t *testing.T) {
+	c := InitClient(16, 4)
+	err := c.AddServerWith("test", 16, 4, ServerOptions{Dir: filepath.Join(t.TempDir(), "tree"), WriteOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.RemoveServer("test")
+
+	if _, err := c.Access("test", true, 16, 1); !errors.Is(err, ErrOutOfRange) {
+		t.Errorf("write past the last block: %v", err)
+	}
+	if err := c.fake_access("test"); !errors.Is(err, ErrWriteOnly) {
+		t.Errorf("path access: %v", err)
+	}
+	if err := c.SetEviction("test", EvictEvery(2)); !errors.Is(err, ErrWriteOnly) {
+		t.Errorf("set eviction: %v", err)
+	}
+	err = c.AddServerWith("evicting", 16, 4, ServerOptions{Dir: filepath.Join(t.TempDir(), "tree"), WriteOnly: true, Eviction: EvictEvery(2)})
+	if err == nil {
+		t.Error("added a write-only server with an eviction policy")
+	}
+}
+
+// writes after a Save leave what it points to alone, so loading it again
+// after a crash gets the saved values back
+func Test_write_only_crash(t *testing.T) {
+	dir := t.TempDir()
+	state := filepath.Join(dir, "state")
+	c := InitClient(64, 4)
+	err := c.AddServerWith("test", 64, 4, ServerOptions{Dir: filepath.Join(dir, "tree"), WriteOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for a := 0; a < 64; a++ {
+		_, err := c.Access("test", true, a, uint64(a))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = c.Save(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 300; i++ {
+		a := i % 16
+		_, err := c.Access("test", true, a, uint64(1000+i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, err := c.Access("test", false, a, 0); err != nil || v != uint64(1000+i) {
+			t.Fatalf("block %d: got %d, want %d (%v)", a, v, 1000+i, err)
+		}
+	}
+
+	c2, err := LoadClient(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.RemoveServer("test")
+	for a := 0; a < 64; a++ {
+		v, err := c2.Access("test", false, a, 0)
+		if err != nil || v != uint64(a) {
+			t.Errorf("block %d after the crash: got %d, want %d (%v)", a, v, a, err)
+		}
+	}
+}